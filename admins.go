@@ -0,0 +1,216 @@
+package ditt
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"time"
+)
+
+// DefaultAdminLogin is the login of the admin account created when there is none
+const DefaultAdminLogin = "admin"
+
+// AdminAccount holds the credentials of an administrator
+type AdminAccount struct {
+	Login        string    `json:"login" bson:"login"`
+	PasswordHash string    `json:"-" bson:"password_hash"`
+	CreatedAt    time.Time `json:"created_at" bson:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+// AddAdmin creates an admin account. It fails with Conflict if an admin or a user is already registered with the login
+func AddAdmin(ctx context.Context, login string, password string) error {
+	if login == "" || password == "" {
+		return BadInput
+	}
+
+	_, err := Env.DataStore.GetAdmin(ctx, login)
+	if err == nil {
+		return Conflict
+	}
+	if !errors.Is(err, NotFound) {
+		return err
+	}
+
+	_, err = Env.DataStore.Get(ctx, login)
+	if err == nil {
+		return Conflict
+	}
+	if !errors.Is(err, NotFound) {
+		return err
+	}
+
+	hash, err := hashPasswordValue(password)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	return Env.DataStore.SaveAdmin(ctx, &AdminAccount{
+		Login:        login,
+		PasswordHash: hash,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	})
+}
+
+// SetAdminPassword replaces the password of an admin account and revokes its sessions
+func SetAdminPassword(ctx context.Context, login string, password string) error {
+	if password == "" {
+		return BadInput
+	}
+
+	admin, err := Env.DataStore.GetAdmin(ctx, login)
+	if err != nil {
+		return err
+	}
+
+	hash, err := hashPasswordValue(password)
+	if err != nil {
+		return err
+	}
+
+	admin.PasswordHash = hash
+	admin.UpdatedAt = time.Now()
+	err = Env.DataStore.SaveAdmin(ctx, admin)
+	if err != nil {
+		return err
+	}
+	return Env.DataStore.DeleteUserSessions(ctx, login)
+}
+
+// RemoveAdmin deletes an admin account, its API keys and revokes its sessions. It fails with Conflict if it is the last one
+func RemoveAdmin(ctx context.Context, login string) error {
+	_, err := Env.DataStore.GetAdmin(ctx, login)
+	if err != nil {
+		return err
+	}
+
+	count, err := Env.DataStore.CountAdmins(ctx)
+	if err != nil {
+		return err
+	}
+
+	if count <= 1 {
+		return Conflict
+	}
+
+	err = Env.DataStore.DeleteAdmin(ctx, login)
+	if err != nil {
+		return err
+	}
+
+	err = Env.DataStore.DeleteUserAPIKeys(ctx, login)
+	if err != nil {
+		return err
+	}
+	return Env.DataStore.DeleteUserSessions(ctx, login)
+}
+
+// BootstrapAdmin creates the DefaultAdminLogin account with a random password if there is no admin account.
+// The password is returned so that it can be shown once. It is empty if no account was created
+func BootstrapAdmin(ctx context.Context) (string, error) {
+	count, err := Env.DataStore.CountAdmins(ctx)
+	if err != nil || count > 0 {
+		return "", err
+	}
+
+	password, err := GenerateRandomPassword(16)
+	if err != nil {
+		return "", err
+	}
+
+	err = AddAdmin(ctx, DefaultAdminLogin, password)
+	if err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+// GenerateRandomPassword generates a password of "length" characters with at least a digit and a special character
+func GenerateRandomPassword(length int) (string, error) {
+	const (
+		digits   = "0123456789"
+		specials = "=+*!@#$"
+		all      = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz" + digits + specials
+	)
+
+	if length < 2 {
+		return "", BadInput
+	}
+
+	pick := func(charset string) (byte, error) {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
+		if err != nil {
+			return 0, err
+		}
+		return charset[n.Int64()], nil
+	}
+
+	buf := make([]byte, length)
+	for i := range buf {
+		charset := all
+		switch i {
+		case 0:
+			charset = digits
+		case 1:
+			charset = specials
+		}
+
+		c, err := pick(charset)
+		if err != nil {
+			return "", err
+		}
+		buf[i] = c
+	}
+
+	// shuffles so that the digit and the special character are not always first
+	for i := len(buf) - 1; i > 0; i-- {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		j := n.Int64()
+		buf[i], buf[j] = buf[j], buf[i]
+	}
+	return string(buf), nil
+}
+
+// isAdmin tells whether "login" is the login of an admin account
+func isAdmin(ctx context.Context, login string) (bool, error) {
+	_, err := Env.DataStore.GetAdmin(ctx, login)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, NotFound) {
+		return false, nil
+	}
+	return false, err
+}
+
+// checkAdminCredentials verifies the password of an admin account and upgrades its hash if it was not computed with the configured hashing.
+// It fails with NotFound if there is no admin with the login
+func checkAdminCredentials(ctx context.Context, login string, password string) (bool, error) {
+	admin, err := Env.DataStore.GetAdmin(ctx, login)
+	if err != nil {
+		return false, err
+	}
+
+	ok, upgrade, err := verifyPasswordValue(admin.PasswordHash, password)
+	if err != nil {
+		Env.Logger.WithContext(ctx).Warn("password verification failed", "admin", login, "error", err)
+		return false, nil
+	}
+
+	if ok && upgrade {
+		admin.PasswordHash, err = hashPasswordValue(password)
+		if err == nil {
+			err = Env.DataStore.SaveAdmin(ctx, admin)
+		}
+		if err != nil {
+			Env.Logger.WithContext(ctx).Error("password hash upgrade failed", "admin", login, "error", err)
+		}
+	}
+	return ok, nil
+}
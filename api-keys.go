@@ -0,0 +1,91 @@
+package ditt
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix starts the secrets of the API keys so that they are told apart from access tokens
+const apiKeyPrefix = "ditt_"
+
+// APIKey is a long-lived credential that authenticates its user with the permissions restricted to its scopes
+type APIKey struct {
+	Id        string       `json:"id" bson:"id"`
+	User      string       `json:"user" bson:"user"`
+	Name      string       `json:"name" bson:"name"`
+	Scopes    []Permission `json:"scopes" bson:"scopes"`
+	Hash      string       `json:"-" bson:"hash"`
+	CreatedAt time.Time    `json:"created_at" bson:"created_at"`
+
+	// Secret is the bearer credential. It is only set on the key returned at creation
+	Secret string `json:"secret,omitempty" bson:"-"`
+}
+
+func randomHex(size int) (string, error) {
+	buf := make([]byte, size)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey generates a key with its secret. Only the hash of the secret is meant to be saved
+func newAPIKey(userId string, name string, scopes []Permission) (*APIKey, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	return &APIKey{
+		Id:        id,
+		User:      userId,
+		Name:      name,
+		Scopes:    scopes,
+		Hash:      hashAPIKeySecret(secret),
+		CreatedAt: time.Now(),
+		Secret:    apiKeyPrefix + id + "_" + secret,
+	}, nil
+}
+
+// isAPIKey tells whether the bearer credential looks like an API key secret
+func isAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, apiKeyPrefix)
+}
+
+// authenticateAPIKey loads the key matching the bearer credential. It fails with NotAuthorized if there is none
+func authenticateAPIKey(ctx context.Context, credential string) (*APIKey, error) {
+	parts := strings.Split(strings.TrimPrefix(credential, apiKeyPrefix), "_")
+	if !isAPIKey(credential) || len(parts) != 2 {
+		return nil, NotAuthorized
+	}
+
+	key, err := Env.DataStore.GetAPIKey(ctx, parts[0])
+	if err != nil {
+		if errors.Is(err, NotFound) {
+			return nil, NotAuthorized
+		}
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashAPIKeySecret(parts[1]))) != 1 {
+		return nil, NotAuthorized
+	}
+	return key, nil
+}
@@ -25,6 +25,14 @@ func (d UserData) Data() string {
 	return result.String()
 }
 
+// MarshalJSON makes UserData encoded as the JSON object it holds rather than as a string
+func (d UserData) MarshalJSON() ([]byte, error) {
+	if d == "" {
+		return []byte("null"), nil
+	}
+	return []byte(d), nil
+}
+
 // Password retrieves the value of the "password" field
 func (d UserData) Password() string {
 	result := gjson.Get(string(d), "password")
@@ -34,32 +42,173 @@ func (d UserData) Password() string {
 // UserDataList holds info about a range of UserData objects
 type UserDataList struct {
 	Offset       int        `json:"offset"`
-	UserDataList []UserData `json:"user_data_list"`
+	UserDataList []UserData `json:"data"`
+
+	// Total is the number of users matched by the list filter
+	Total int `json:"total"`
+
+	// Count is the number of users in the range
+	Count int `json:"count"`
+
+	// HasMore tells whether there are users after the range
+	HasMore bool `json:"has_more"`
+
+	// Next is the cursor of the following range. It is empty if there is none
+	Next string `json:"next,omitempty"`
+
+	// Prev is the cursor of the preceding range. It is empty if there is none
+	Prev string `json:"prev,omitempty"`
 }
 
-// ListOptions defines a range limit
+// ListOptions defines a range limit. The range starts either at Offset or at the position referenced by Cursor.
+// Filter, Sort and Fields are expressions parsed by ParseFilter, ParseSort and ParseFields. A Cursor cannot be combined with Sort
 type ListOptions struct {
-	Offset int `json:"offset"`
-	Count  int `json:"count"`
+	Offset int    `json:"offset"`
+	Count  int    `json:"count"`
+	Cursor string `json:"cursor"`
+	Filter string `json:"filter"`
+	Sort   string `json:"sort"`
+	Fields string `json:"fields"`
+
+	// IncludeSecrets tells whether the sensitive fields are kept in the listed users
+	IncludeSecrets bool `json:"include_secrets"`
+}
+
+// GetUserOptions holds GetUser parameters
+type GetUserOptions struct {
+	// IncludeSecrets tells whether the sensitive fields are kept in the user data
+	IncludeSecrets bool `json:"include_secrets"`
+}
+
+// ConflictPolicy defines how AddUsers handles a user whose id is already registered
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyFail rejects the user, stops the import and makes AddUsers return Conflict.
+	// The users processed before the conflict stay registered
+	ConflictPolicyFail ConflictPolicy = "fail"
+
+	// ConflictPolicySkip ignores the user and keeps the registered data
+	ConflictPolicySkip ConflictPolicy = "skip"
+
+	// ConflictPolicyOverwrite replaces the registered data with the user data
+	ConflictPolicyOverwrite ConflictPolicy = "overwrite"
+)
+
+// AddUsersOptions holds AddUsers parameters
+type AddUsersOptions struct {
+	OnConflict ConflictPolicy `json:"on_conflict"`
+
+	// Format is the content type of the user data list. Defaults to FormatJSON
+	Format string `json:"format"`
+
+	// CSVColumns tells which columns hold the user data fields when Format is FormatCSV
+	CSVColumns CSVColumns `json:"csv_columns"`
+
+	// MaxUsers is the number of users the list can hold. The list is rejected as a whole if it holds more.
+	// Zero means no limit
+	MaxUsers int `json:"max_users,omitempty"`
+}
+
+const (
+	// FormatMergePatch is the content type of a user update encoded as a JSON Merge Patch (RFC 7386)
+	FormatMergePatch = "application/merge-patch+json"
+
+	// FormatJSONPatch is the content type of a user update encoded as a JSON Patch (RFC 6902)
+	FormatJSONPatch = "application/json-patch+json"
+)
+
+// UpdateUserOptions holds UpdateUser parameters
+type UpdateUserOptions struct {
+	// Format is the content type of the user update. FormatJSON and FormatMergePatch are both read as a merge patch.
+	// Defaults to FormatMergePatch
+	Format string `json:"format"`
+}
+
+// UserFailure holds info about a user that could not be added
+type UserFailure struct {
+	Index  int    `json:"index"`
+	UserId string `json:"id"`
+	Error  string `json:"error"`
+}
+
+// AddUsersReport summarizes the processing of the users passed to AddUsers
+type AddUsersReport struct {
+	Accepted int           `json:"accepted"`
+	Rejected int           `json:"rejected"`
+	Skipped  int           `json:"skipped"`
+	Failures []UserFailure `json:"failures"`
+}
+
+// ExportOptions holds ExportUsers parameters
+type ExportOptions struct {
+	// IncludeSecrets tells whether the sensitive fields, the hashed passwords among them, are exported
+	IncludeSecrets bool `json:"include_secrets"`
 }
 
 type APIHandler interface {
 
-	// Login creates an authenticated session if credentials match a registered user
+	// Login creates an authenticated session if credentials match a registered user.
+	// It fails with a LockoutError while the account or the client address is locked after too many failures
 	Login(ctx context.Context, username string, password string) (bool, error)
 
-	// AddUsers parses user data list from the "reader" stream and store them in the database
-	AddUsers(ctx context.Context, reader io.Reader) error
+	// Logout revokes the session of the logged user
+	Logout(ctx context.Context) error
+
+	// AddUsers parses user data list from the "reader" stream and store them in the database.
+	// The returned report is set even if an error occurred while reading the stream
+	AddUsers(ctx context.Context, reader io.Reader, opts AddUsersOptions) (*AddUsersReport, error)
 
 	// DeleteUser deletes the user identified by "userId' from the database
 	DeleteUser(ctx context.Context, userId string) error
 
-	// GetUser retrieves the data of the user identified by "userId"
-	GetUser(ctx context.Context, userId string) (UserData, error)
+	// GetUser retrieves the data of the user identified by "userId". The sensitive fields are removed unless opts.IncludeSecrets is set
+	GetUser(ctx context.Context, userId string, opts GetUserOptions) (UserData, error)
 
 	// GetUserList retrieves a set of users from the database
 	GetUserList(ctx context.Context, opts ListOptions) (*UserDataList, error)
 
-	// UpdateUser updates the data of the user identified by "userId"
-	UpdateUser(ctx context.Context, userId string, userData UserData) error
+	// UpdateUser updates the data of the user identified by "userId". A FormatJSONPatch update is applied on the stored user
+	// with its data. Its operations can write the sensitive fields but cannot test, copy or move them, and removing the password fails
+	UpdateUser(ctx context.Context, userId string, userData UserData, opts UpdateUserOptions) error
+
+	// StartImportJob spools the user data list from the "reader" stream and stores them in the database in background
+	StartImportJob(ctx context.Context, reader io.Reader, opts AddUsersOptions) (*ImportJob, error)
+
+	// GetImportJob retrieves the state of the import job identified by "jobId"
+	GetImportJob(ctx context.Context, jobId string) (*ImportJob, error)
+
+	// CancelImportJob stops the import job identified by "jobId"
+	CancelImportJob(ctx context.Context, jobId string) error
+
+	// ExportUsers loads all the users from the database and passes each of them to the callback
+	ExportUsers(ctx context.Context, opts ExportOptions, callback UserDataCallback) error
+
+	// GetUserRoles retrieves the roles of the user identified by "userId"
+	GetUserRoles(ctx context.Context, userId string) ([]Role, error)
+
+	// SetUserRoles replaces the roles of the user identified by "userId". An empty list restores the default roles
+	SetUserRoles(ctx context.Context, userId string, roles []Role) error
+
+	// ListUserSessions retrieves the active sessions of the user identified by "userId"
+	ListUserSessions(ctx context.Context, userId string) ([]Session, error)
+
+	// RevokeUserSessions revokes all the sessions of the user identified by "userId"
+	RevokeUserSessions(ctx context.Context, userId string) error
+
+	// RevokeSession revokes the session identified by "sessionId" of the user identified by "userId"
+	RevokeSession(ctx context.Context, userId string, sessionId string) error
+
+	// CreateAPIKey creates an API key for the user identified by "userId". Its permissions are restricted to "scopes".
+	// The returned key is the only one that holds the secret
+	CreateAPIKey(ctx context.Context, userId string, name string, scopes []Permission) (*APIKey, error)
+
+	// ListAPIKeys retrieves the API keys of the user identified by "userId"
+	ListAPIKeys(ctx context.Context, userId string) ([]APIKey, error)
+
+	// DeleteAPIKey deletes the API key identified by "keyId" of the user identified by "userId"
+	DeleteAPIKey(ctx context.Context, userId string, keyId string) error
+
+	// UnlockUser clears the login failures of the account identified by "login"
+	UnlockUser(ctx context.Context, login string) error
 }
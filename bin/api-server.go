@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/rand"
 	"fmt"
 	"github.com/gorilla/sessions"
 	"github.com/kirsle/configdir"
@@ -9,23 +12,44 @@ import (
 	"github.com/spf13/cobra"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"time"
 )
 
 const (
 	cookiesFile       = "cookies-key"
+	tokenKeyFile      = "token-key"
 	cookieStoreDir    = "cookies-store"
 	adminPasswordFile = "admin-auth"
 )
 
 var (
-	port        int
-	dataDirname string
-	databaseURI string
-	cmd         *cobra.Command
+	port             int
+	adminPort        int
+	dataDirname      string
+	spoolDir         string
+	databaseURI      string
+	importWorkers    int
+	importQueueSize  int
+	selfRegistration bool
+	passwordStdin    bool
+	sessionIdle      time.Duration
+	sessionMaxAge    time.Duration
+	accessTokenTTL   time.Duration
+	refreshTokenTTL  time.Duration
+	loginThrottle    = ditt.DefaultLoginThrottlePolicy
+	passwordPolicy   = ditt.PasswordPolicy{MinLength: 8}
+	passwordHashing  = ditt.DefaultPasswordHashing
+	breachedFilename string
+	hashAlgorithm    string
+	sensitiveFields  []string
+	logLevel         string
+	logFormat        string
+	shutdownGrace    time.Duration
+	cmd              *cobra.Command
 )
 
 func init() {
@@ -38,6 +62,10 @@ func init() {
 		},
 	}
 
+	rootFlags := cmd.PersistentFlags()
+	rootFlags.StringVar(&logLevel, "log-level", ditt.LogLevelInfo.String(), "The minimum level of the written logs: debug, info, warn or error")
+	rootFlags.StringVar(&logFormat, "log-format", string(ditt.LogFormatLogfmt), "The encoding of the logs: logfmt or json")
+
 	versionCommand := &cobra.Command{
 		Use:   "version",
 		Short: "Shows the version info",
@@ -56,11 +84,98 @@ func init() {
 
 	flags := startCommand.PersistentFlags()
 	flags.IntVar(&port, "port", 80, "The HTTP server port")
+	flags.IntVar(&adminPort, "admin-port", 0, "The port of a separate HTTP server for the /healthz, /readyz, /version and /metrics endpoints. 0 serves /healthz, /readyz and /version on the API port and does not serve /metrics")
 	flags.StringVar(&databaseURI, "db-uri", "localhost", "The database URI")
 	flags.StringVar(&dataDirname, "data-dir", "", "Directory path in where file data are saved")
+	flags.IntVar(&importWorkers, "import-workers", runtime.NumCPU(), "The number of users processed concurrently during an import")
+	flags.IntVar(&importQueueSize, "import-queue-size", ditt.DefaultRunnerQueueSize, "The number of parsed users that can wait to be processed during an import")
+	flags.StringVar(&spoolDir, "spool-dir", "", "Directory path in where import job uploads are spooled. Defaults to the system temporary directory")
+	flags.BoolVar(&selfRegistration, "self-registration", false, "Allows unauthenticated callers to create their own user")
+	flags.DurationVar(&sessionIdle, "session-idle-timeout", 30*time.Minute, "The inactivity duration after which a session is revoked. 0 disables it")
+	flags.DurationVar(&sessionMaxAge, "session-max-age", 24*time.Hour, "The duration after which a session is revoked whatever its activity. 0 disables it")
+	flags.DurationVar(&accessTokenTTL, "access-token-ttl", ditt.DefaultAccessTokenTTL, "The lifetime of the access tokens")
+	flags.DurationVar(&refreshTokenTTL, "refresh-token-ttl", ditt.DefaultRefreshTokenTTL, "The lifetime of the refresh tokens")
+	flags.IntVar(&loginThrottle.MaxAccountFailures, "login-max-account-failures", loginThrottle.MaxAccountFailures, "The number of consecutive login failures on an account before it gets locked")
+	flags.IntVar(&loginThrottle.MaxAddressFailures, "login-max-address-failures", loginThrottle.MaxAddressFailures, "The number of consecutive login failures from a client address before it gets locked")
+	flags.DurationVar(&loginThrottle.BaseLockout, "login-lockout", loginThrottle.BaseLockout, "The duration of the first lockout. It doubles with each further failure")
+	flags.DurationVar(&loginThrottle.MaxLockout, "login-max-lockout", loginThrottle.MaxLockout, "The maximum duration of a lockout. 0 leaves it uncapped")
+	flags.DurationVar(&loginThrottle.Window, "login-failure-window", loginThrottle.Window, "The duration after which the login failures of an account or a client address are forgotten")
+	flags.IntVar(&passwordPolicy.MinLength, "password-min-length", passwordPolicy.MinLength, "The minimum number of characters of the user passwords")
+	flags.IntVar(&passwordPolicy.MinCharacterClasses, "password-min-classes", passwordPolicy.MinCharacterClasses, "The minimum number of classes among lowercase letters, uppercase letters, digits and others in the user passwords")
+	flags.StringVar(&breachedFilename, "breached-passwords", "", "Path of a file that lists a leaked password per line. Those passwords are rejected")
+	flags.StringVar(&hashAlgorithm, "password-hash", string(passwordHashing.Algorithm), "The algorithm new password hashes are computed with: bcrypt or argon2id")
+	flags.IntVar(&passwordHashing.BcryptCost, "bcrypt-cost", passwordHashing.BcryptCost, "The bcrypt cost")
+	flags.Uint32Var(&passwordHashing.Argon2Time, "argon2-time", passwordHashing.Argon2Time, "The number of argon2id passes over the memory")
+	flags.Uint32Var(&passwordHashing.Argon2Memory, "argon2-memory", passwordHashing.Argon2Memory, "The argon2id memory size in KiB")
+	flags.Uint8Var(&passwordHashing.Argon2Threads, "argon2-threads", passwordHashing.Argon2Threads, "The argon2id degree of parallelism")
+	flags.DurationVar(&shutdownGrace, "shutdown-grace-period", ditt.DefaultShutdownGracePeriod, "How long the running requests and imports are waited for when the server is stopped")
+	flags.StringSliceVar(&sensitiveFields, "sensitive-fields", ditt.DefaultSensitiveFields, "The paths of the user fields that are only returned to the admins who explicitly ask for them")
+
+	adminCommand := &cobra.Command{
+		Use:   "admin",
+		Short: "Manages the admin accounts",
+		Run: func(cmd *cobra.Command, args []string) {
+			_ = cmd.Help()
+		},
+	}
+
+	adminFlags := adminCommand.PersistentFlags()
+	adminFlags.StringVar(&databaseURI, "db-uri", "localhost", "The database URI")
+	adminFlags.BoolVar(&passwordStdin, "password-stdin", false, "Reads the password from the standard input instead of generating one")
+
+	adminAddCommand := &cobra.Command{
+		Use:   "add <login>",
+		Short: "Creates an admin account",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			setupLogger()
+			setupMongoDB()
+			password := readAdminPassword()
+			err := ditt.AddAdmin(context.Background(), args[0], password)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			showAdminPassword(args[0], password)
+		},
+	}
+
+	adminPasswdCommand := &cobra.Command{
+		Use:   "passwd <login>",
+		Short: "Changes the password of an admin account",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			setupLogger()
+			setupMongoDB()
+			password := readAdminPassword()
+			err := ditt.SetAdminPassword(context.Background(), args[0], password)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			showAdminPassword(args[0], password)
+		},
+	}
+
+	adminRemoveCommand := &cobra.Command{
+		Use:   "remove <login>",
+		Short: "Removes an admin account. The last admin account cannot be removed",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			setupLogger()
+			setupMongoDB()
+			err := ditt.RemoveAdmin(context.Background(), args[0])
+			if err != nil {
+				log.Fatalln(err)
+			}
+		},
+	}
+
+	adminCommand.AddCommand(adminAddCommand)
+	adminCommand.AddCommand(adminPasswdCommand)
+	adminCommand.AddCommand(adminRemoveCommand)
 
 	cmd.AddCommand(versionCommand)
 	cmd.AddCommand(startCommand)
+	cmd.AddCommand(adminCommand)
 }
 
 func showVersion() {
@@ -80,17 +195,53 @@ func startServer() {
 	}
 	fmt.Println("CONFIG DIR: ", configDir)
 
+	setupLogger()
 	setupDataDir(configDir)
+	setupPasswords()
 	setupCookies(configDir)
-	setAdminAuthentication(configDir)
+	tokenKey := loadOrCreateKey(filepath.Join(configDir, tokenKeyFile), 32)
 	setupMongoDB()
+	setupAdmin(configDir)
 
-	err = ditt.Serve(&ditt.Config{Port: port})
+	err = ditt.Serve(context.Background(), &ditt.Config{
+		Port:                port,
+		AdminPort:           adminPort,
+		ImportWorkers:       importWorkers,
+		ImportQueueSize:     importQueueSize,
+		SelfRegistration:    selfRegistration,
+		SessionIdleTimeout:  sessionIdle,
+		SessionMaxAge:       sessionMaxAge,
+		TokenSigningKey:     tokenKey,
+		AccessTokenTTL:      accessTokenTTL,
+		RefreshTokenTTL:     refreshTokenTTL,
+		LoginThrottlePolicy: &loginThrottle,
+		PasswordPolicy:      &passwordPolicy,
+		PasswordHashing:     &passwordHashing,
+		SensitiveFields:     sensitiveFields,
+		Logger:              ditt.Env.Logger,
+		ShutdownGracePeriod: shutdownGrace,
+	})
 	if err != nil {
 		log.Fatalln(err)
 	}
 }
 
+func setupPasswords() {
+	passwordHashing.Algorithm = ditt.PasswordHashAlgorithm(hashAlgorithm)
+	err := passwordHashing.Validate()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if breachedFilename != "" {
+		breached, err := ditt.LoadBreachedPasswords(breachedFilename)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		passwordPolicy.Breached = breached
+	}
+}
+
 func setupDataDir(configDir string) {
 	if dataDirname == "" {
 		dataDirname = filepath.Join(configDir, "data")
@@ -100,20 +251,21 @@ func setupDataDir(configDir string) {
 		}
 	}
 	ditt.Env.Files = ditt.NewDirFiles(dataDirname)
+	ditt.Env.SpoolDir = spoolDir
 }
 
-func setupCookies(configDir string) {
-	cookieKeyFilename := filepath.Join(configDir, cookiesFile)
-	keyData, err := ioutil.ReadFile(cookieKeyFilename)
+// loadOrCreateKey reads the key saved in "filename" or generates and saves a random key of "size" bytes
+func loadOrCreateKey(filename string, size int) []byte {
+	keyData, err := ioutil.ReadFile(filename)
 	if err != nil {
 		if os.IsNotExist(err) {
-			keyData = make([]byte, 64)
+			keyData = make([]byte, size)
 			_, err = rand.Read(keyData)
 			if err != nil {
 				log.Fatalln(err)
 			}
 
-			err = ioutil.WriteFile(cookieKeyFilename, keyData, 0600)
+			err = ioutil.WriteFile(filename, keyData, 0600)
 			if err != nil {
 				log.Fatalln(err)
 			}
@@ -121,55 +273,108 @@ func setupCookies(configDir string) {
 			log.Fatalln(err)
 		}
 	}
+	return keyData
+}
+
+func setupCookies(configDir string) {
+	keyData := loadOrCreateKey(filepath.Join(configDir, cookiesFile), 64)
 	cookiesStoreDirname := filepath.Join(configDir, cookieStoreDir)
-	err = os.MkdirAll(cookiesStoreDirname, os.ModePerm)
+	err := os.MkdirAll(cookiesStoreDirname, os.ModePerm)
 	if err != nil {
 		log.Fatalln(err)
 	}
 	ditt.Env.CookiesStore = sessions.NewFilesystemStore(cookiesStoreDirname, keyData[:31], keyData[32:])
 }
 
+func setupLogger() {
+	level, err := ditt.ParseLogLevel(logLevel)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	format := ditt.LogFormat(logFormat)
+	if !format.Valid() {
+		log.Fatalf("unknown log format '%s'\n", logFormat)
+	}
+	ditt.Env.Logger = ditt.NewLogger(os.Stderr, level, format)
+}
+
 func setupMongoDB() {
-	store, err := ditt.NewMongoUserDataStore(databaseURI)
+	store, err := ditt.NewMongoUserDataStore(databaseURI, ditt.Env.Logger)
 	if err != nil {
 		log.Fatalln("Mongo", err)
 	}
 	ditt.Env.DataStore = store
 }
 
-func setAdminAuthentication(configDir string) {
+// setupAdmin makes sure an admin account exists. The password of the legacy admin-auth file is migrated
+// if there is one, otherwise a one-time password is generated and shown
+func setupAdmin(configDir string) {
+	ctx := context.Background()
 	adminPasswordFilename := filepath.Join(configDir, adminPasswordFile)
 
 	adminPasswordBytes, err := ioutil.ReadFile(adminPasswordFilename)
-	if err != nil {
-		if os.IsNotExist(err) {
-			adminPasswordBytes = generateRandomPassword(16)
-			err = ioutil.WriteFile(adminPasswordFilename, adminPasswordBytes, 0600)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalln(err)
+	}
+
+	if err == nil {
+		count, err := ditt.Env.DataStore.CountAdmins(ctx)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		if count == 0 {
+			err = ditt.AddAdmin(ctx, ditt.DefaultAdminLogin, string(adminPasswordBytes))
 			if err != nil {
 				log.Fatalln(err)
 			}
-		} else {
+			fmt.Println("Migrated the admin password of", adminPasswordFilename)
+		}
+
+		err = os.Remove(adminPasswordFilename)
+		if err != nil {
 			log.Fatalln(err)
 		}
 	}
-	ditt.Env.AdminPassword = string(adminPasswordBytes)
+
+	password, err := ditt.BootstrapAdmin(ctx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if password != "" {
+		fmt.Println("Created the admin account. This password will not be shown again")
+		showAdminPassword(ditt.DefaultAdminLogin, password)
+	}
 }
 
-func generateRandomPassword(length int) []byte {
-	rand.Seed(time.Now().UnixNano())
-	digits := "0123456789"
-	specials := "=+*!@#$"
-	all := "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz" + digits + specials
-	buf := make([]byte, length)
-	buf[0] = digits[rand.Intn(len(digits))]
-	buf[1] = specials[rand.Intn(len(specials))]
-	for i := 2; i < length; i++ {
-		buf[i] = all[rand.Intn(len(all))]
-	}
-	rand.Shuffle(len(buf), func(i, j int) {
-		buf[i], buf[j] = buf[j], buf[i]
-	})
-	return buf
+// readAdminPassword reads the password from the standard input if --password-stdin is set, otherwise generates one
+func readAdminPassword() string {
+	if !passwordStdin {
+		password, err := ditt.GenerateRandomPassword(16)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return password
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatalln(err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// showAdminPassword prints the password unless it was given on the standard input
+func showAdminPassword(login string, password string) {
+	if passwordStdin {
+		return
+	}
+	fmt.Println()
+	fmt.Println("   Login:", login)
+	fmt.Println("Password:", password)
+	fmt.Println()
 }
 
 func main() {
@@ -3,6 +3,11 @@ package ditt
 import "context"
 
 type ctxLoggedUser struct{}
+type ctxLoggedUserRoles struct{}
+type ctxSessionId struct{}
+type ctxLoggedUserScopes struct{}
+type ctxClientAddress struct{}
+type ctxRequestId struct{}
 
 // ContextWithLoggedUser creates a new context that holds loggedUser in addition of the parent values
 func ContextWithLoggedUser(parent context.Context, loggedUser string) context.Context {
@@ -17,3 +22,74 @@ func GetLoggedUser(ctx context.Context) string {
 	}
 	return o.(string)
 }
+
+// ContextWithLoggedUserRoles creates a new context that holds the roles of the logged user in addition of the parent values
+func ContextWithLoggedUserRoles(parent context.Context, roles []Role) context.Context {
+	return context.WithValue(parent, ctxLoggedUserRoles{}, roles)
+}
+
+// GetLoggedUserRoles extracts the logged user roles from context values. The boolean tells whether the context holds them
+func GetLoggedUserRoles(ctx context.Context) ([]Role, bool) {
+	o := ctx.Value(ctxLoggedUserRoles{})
+	if o == nil {
+		return nil, false
+	}
+	return o.([]Role), true
+}
+
+// ContextWithSessionId creates a new context that holds the id of the logged user session in addition of the parent values
+func ContextWithSessionId(parent context.Context, sessionId string) context.Context {
+	return context.WithValue(parent, ctxSessionId{}, sessionId)
+}
+
+// GetSessionId extracts the logged user session id from context values
+func GetSessionId(ctx context.Context) string {
+	o := ctx.Value(ctxSessionId{})
+	if o == nil {
+		return ""
+	}
+	return o.(string)
+}
+
+// ContextWithLoggedUserScopes creates a new context that holds the permissions the logged user is restricted to in addition of the parent values
+func ContextWithLoggedUserScopes(parent context.Context, scopes []Permission) context.Context {
+	return context.WithValue(parent, ctxLoggedUserScopes{}, scopes)
+}
+
+// GetLoggedUserScopes extracts the permissions the logged user is restricted to from context values.
+// The boolean tells whether the context holds them
+func GetLoggedUserScopes(ctx context.Context) ([]Permission, bool) {
+	o := ctx.Value(ctxLoggedUserScopes{})
+	if o == nil {
+		return nil, false
+	}
+	return o.([]Permission), true
+}
+
+// ContextWithClientAddress creates a new context that holds the network address of the caller in addition of the parent values
+func ContextWithClientAddress(parent context.Context, address string) context.Context {
+	return context.WithValue(parent, ctxClientAddress{}, address)
+}
+
+// GetClientAddress extracts the network address of the caller from context values
+func GetClientAddress(ctx context.Context) string {
+	o := ctx.Value(ctxClientAddress{})
+	if o == nil {
+		return ""
+	}
+	return o.(string)
+}
+
+// ContextWithRequestId creates a new context that holds the id of the HTTP request in addition of the parent values
+func ContextWithRequestId(parent context.Context, requestId string) context.Context {
+	return context.WithValue(parent, ctxRequestId{}, requestId)
+}
+
+// GetRequestId extracts the id of the HTTP request from context values
+func GetRequestId(ctx context.Context) string {
+	o := ctx.Value(ctxRequestId{})
+	if o == nil {
+		return ""
+	}
+	return o.(string)
+}
@@ -0,0 +1,36 @@
+package ditt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+// listCursor is the content of the opaque tokens used to resume a user listing. It references a user id
+// and the direction in which the listing goes from it
+type listCursor struct {
+	Id        string        `json:"id"`
+	Direction SeekDirection `json:"dir,omitempty"`
+}
+
+func (c *listCursor) encode() string {
+	encoded, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func decodeListCursor(token string) (*listCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, BadInput
+	}
+
+	cursor := &listCursor{}
+	err = json.Unmarshal(decoded, cursor)
+	if err != nil || cursor.Id == "" {
+		return nil, BadInput
+	}
+
+	if cursor.Direction != SeekForward && cursor.Direction != SeekBackward {
+		return nil, BadInput
+	}
+	return cursor, nil
+}
@@ -0,0 +1,311 @@
+package ditt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	// FormatJSON is the content type of a user data list encoded as a JSON array of objects
+	FormatJSON = "application/json"
+
+	// FormatNDJSON is the content type of a user data list encoded as one JSON object per line
+	FormatNDJSON = "application/x-ndjson"
+
+	// FormatJSONLines is an alias of FormatNDJSON
+	FormatJSONLines = "application/jsonl"
+
+	// FormatCSV is the content type of a user data list encoded as CSV with a header row
+	FormatCSV = "text/csv"
+)
+
+// CSVColumns maps the user data fields to the names of the CSV columns that hold them
+type CSVColumns struct {
+	Id       string `json:"id"`
+	Password string `json:"password"`
+	Data     string `json:"data"`
+}
+
+// UserDataProviderFactory creates a UserDataProvider that reads users encoded in a given format from the "reader" stream
+type UserDataProviderFactory func(reader io.Reader, opts AddUsersOptions) UserDataProvider
+
+var userDataFormats = struct {
+	sync.RWMutex
+	factories map[string]UserDataProviderFactory
+}{
+	factories: map[string]UserDataProviderFactory{
+		FormatJSON:      newJsonUserDataProvider,
+		FormatNDJSON:    newNDJsonUserDataProvider,
+		FormatJSONLines: newNDJsonUserDataProvider,
+		FormatCSV:       newCsvUserDataProvider,
+	},
+}
+
+// RegisterUserDataFormat makes the format identified by "contentType" available to AddUsers
+func RegisterUserDataFormat(contentType string, factory UserDataProviderFactory) {
+	userDataFormats.Lock()
+	defer userDataFormats.Unlock()
+	userDataFormats.factories[contentType] = factory
+}
+
+func getUserDataProviderFactory(contentType string) (UserDataProviderFactory, error) {
+	userDataFormats.RLock()
+	defer userDataFormats.RUnlock()
+	factory, found := userDataFormats.factories[contentType]
+	if !found {
+		return nil, UnsupportedFormat
+	}
+	return factory, nil
+}
+
+func newJsonUserDataProvider(reader io.Reader, _ AddUsersOptions) UserDataProvider {
+	return newJsonObjectStreamParser(reader).parseUsers
+}
+
+func newNDJsonUserDataProvider(reader io.Reader, _ AddUsersOptions) UserDataProvider {
+	return func(ctx context.Context, callback UserDataCallback) error {
+		var (
+			offset int64
+			index  int
+		)
+
+		lines := bufio.NewReader(reader)
+		for lineNumber := 1; ; lineNumber++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			line, err := lines.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				return err
+			}
+			lineOffset := offset
+			offset += int64(len(line))
+
+			record := bytes.TrimSpace(line)
+			if len(record) > 0 {
+				if record[0] != '{' || !json.Valid(record) {
+					return &ParseError{Offset: lineOffset, Index: index, Line: lineNumber, Message: "expected a JSON object"}
+				}
+
+				callbackErr := callback(UserData(record))
+				if callbackErr != nil {
+					return callbackErr
+				}
+				index++
+			}
+
+			if err == io.EOF {
+				return nil
+			}
+		}
+	}
+}
+
+func newCsvUserDataProvider(reader io.Reader, opts AddUsersOptions) UserDataProvider {
+	return func(ctx context.Context, callback UserDataCallback) error {
+		columns := opts.CSVColumns
+		if columns.Id == "" {
+			columns.Id = "id"
+		}
+		if columns.Password == "" {
+			columns.Password = "password"
+		}
+		if columns.Data == "" {
+			columns.Data = "data"
+		}
+
+		csvReader := csv.NewReader(reader)
+		csvReader.ReuseRecord = true
+
+		header, err := csvReader.Read()
+		if err != nil {
+			return csvParseError(err, 0)
+		}
+
+		positions := map[string]int{}
+		for position, name := range header {
+			positions[name] = position
+		}
+
+		fields := map[string]string{
+			"id":       columns.Id,
+			"password": columns.Password,
+			"data":     columns.Data,
+		}
+		fieldPositions := map[string]int{}
+		for field, column := range fields {
+			position, found := positions[column]
+			if !found {
+				if field == "id" {
+					return &ParseError{Line: 1, Message: fmt.Sprintf("missing column '%s'", column)}
+				}
+				continue
+			}
+			fieldPositions[field] = position
+		}
+
+		for index := 0; ; index++ {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+
+			record, err := csvReader.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return csvParseError(err, index)
+			}
+
+			user := "{}"
+			for _, field := range []string{"id", "password", "data"} {
+				position, found := fieldPositions[field]
+				if !found {
+					continue
+				}
+				user, err = sjson.Set(user, field, record[position])
+				if err != nil {
+					return err
+				}
+			}
+
+			err = callback(UserData(user))
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func csvParseError(err error, index int) error {
+	var csvErr *csv.ParseError
+	if errors.As(err, &csvErr) {
+		return &ParseError{Index: index, Line: csvErr.Line, Message: csvErr.Err.Error()}
+	}
+
+	if err == io.EOF {
+		return &ParseError{Index: index, Message: "unexpected end of stream"}
+	}
+	return err
+}
+
+// userDataEncoder writes a user data list in a given format
+type userDataEncoder interface {
+	// Begin writes what precedes the first user
+	Begin() error
+
+	// Encode writes one user
+	Encode(user UserData) error
+
+	// End writes what follows the last user
+	End() error
+}
+
+func newUserDataEncoder(writer io.Writer, contentType string, opts ExportOptions) (userDataEncoder, error) {
+	switch contentType {
+	case FormatJSON:
+		return &jsonUserDataEncoder{writer: writer}, nil
+	case FormatNDJSON, FormatJSONLines:
+		return &ndjsonUserDataEncoder{writer: writer}, nil
+	case FormatCSV:
+		return newCsvUserDataEncoder(writer, opts), nil
+	default:
+		return nil, UnsupportedFormat
+	}
+}
+
+type jsonUserDataEncoder struct {
+	writer io.Writer
+	count  int
+}
+
+func (e *jsonUserDataEncoder) Begin() error {
+	_, err := e.writer.Write([]byte("["))
+	return err
+}
+
+func (e *jsonUserDataEncoder) Encode(user UserData) error {
+	if e.count > 0 {
+		if _, err := e.writer.Write([]byte(",")); err != nil {
+			return err
+		}
+	}
+	e.count++
+	_, err := e.writer.Write([]byte(user))
+	return err
+}
+
+func (e *jsonUserDataEncoder) End() error {
+	_, err := e.writer.Write([]byte("]\n"))
+	return err
+}
+
+type ndjsonUserDataEncoder struct {
+	writer io.Writer
+}
+
+func (e *ndjsonUserDataEncoder) Begin() error {
+	return nil
+}
+
+func (e *ndjsonUserDataEncoder) Encode(user UserData) error {
+	_, err := e.writer.Write(append([]byte(user), '\n'))
+	return err
+}
+
+func (e *ndjsonUserDataEncoder) End() error {
+	return nil
+}
+
+// csvUserDataEncoder writes the users with the default columns of the CSV import format
+type csvUserDataEncoder struct {
+	writer  *csv.Writer
+	columns []string
+}
+
+// newCsvUserDataEncoder creates an encoder that leaves out the columns of the sensitive fields unless opts.IncludeSecrets is set,
+// so that the CSV export removes the same fields as the other formats
+func newCsvUserDataEncoder(writer io.Writer, opts ExportOptions) *csvUserDataEncoder {
+	encoder := &csvUserDataEncoder{writer: csv.NewWriter(writer)}
+	for _, column := range []string{"id", "password", "data"} {
+		if opts.IncludeSecrets || !isSensitiveField(column) {
+			encoder.columns = append(encoder.columns, column)
+		}
+	}
+	return encoder
+}
+
+func (e *csvUserDataEncoder) Begin() error {
+	return e.writer.Write(e.columns)
+}
+
+func (e *csvUserDataEncoder) Encode(user UserData) error {
+	record := make([]string, len(e.columns))
+	for i, column := range e.columns {
+		record[i] = gjson.Get(string(user), column).String()
+	}
+
+	err := e.writer.Write(record)
+	if err != nil {
+		return err
+	}
+	// the response writer does its own buffering
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+func (e *csvUserDataEncoder) End() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
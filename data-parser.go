@@ -1,96 +1,140 @@
 package ditt
 
 import (
-	"bufio"
-	"github.com/tidwall/gjson"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"strings"
 )
 
+// ParseError holds info about an error met while parsing a user data list
+type ParseError struct {
+	// Offset is the position in bytes of the error in the stream
+	Offset int64 `json:"offset"`
+
+	// Index is the index of the record being parsed when the error occurred
+	Index int `json:"index"`
+
+	// Line is the line of the error for line based formats
+	Line int `json:"line,omitempty"`
+
+	// Message describes the error
+	Message string `json:"message"`
+}
+
+func (e *ParseError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("record %d, line %d: %s", e.Index, e.Line, e.Message)
+	}
+	return fmt.Sprintf("record %d, offset %d: %s", e.Index, e.Offset, e.Message)
+}
+
+// Is makes a ParseError match BadInput
+func (e *ParseError) Is(target error) bool {
+	return errors.Is(target, BadInput)
+}
+
+// ErrorDetails tells the record and the position of the error
+func (e *ParseError) ErrorDetails() *ErrorDetails {
+	index, offset := e.Index, e.Offset
+	return &ErrorDetails{Index: &index, Line: e.Line, Position: &offset}
+}
+
 func newJsonObjectStreamParser(reader io.Reader) *jsonObjectStreamParser {
 	return &jsonObjectStreamParser{
-		reader:   bufio.NewReader(reader),
-		userChan: make(chan UserData, 1),
+		decoder: json.NewDecoder(reader),
 	}
 }
 
+// jsonObjectStreamParser reads a JSON array of objects from a stream. Only the object being
+// parsed is held in memory
 type jsonObjectStreamParser struct {
-	startConsuming bool
-	reader         *bufio.Reader
-	userChan       chan UserData
+	decoder *json.Decoder
+	index   int
 }
 
-func (p *jsonObjectStreamParser) parseUsers(callback UserDataCallback) error {
-	var (
-		err          error
-		parsingUsers bool
-		c            rune
-		user         UserData
-	)
-	for {
-		c, _, err = p.reader.ReadRune()
-		if err != nil {
-			return err
-		}
+// error converts err into a ParseError located at "offset" unless err is a syntax error that holds its own offset
+func (p *jsonObjectStreamParser) error(err error, offset int64) error {
+	parseErr := &ParseError{
+		Offset:  offset,
+		Index:   p.index,
+		Message: err.Error(),
+	}
 
-		switch c {
-		case '[', ',':
-			if c == '[' {
-				if parsingUsers {
-					return BadInput
-				}
-				parsingUsers = true
-			}
-
-			user, err = p.parseUser()
-			if err != nil {
-				return err
-			}
-
-			if !gjson.Valid(string(user)) {
-				return BadInput
-			}
-
-			err = callback(user)
-			if err != nil {
-				return err
-			}
-		case ']':
-			if !parsingUsers {
-				return BadInput
-			}
-			return nil
-		}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		parseErr.Offset = syntaxErr.Offset
+	} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+		parseErr.Message = "unexpected end of stream"
 	}
+	return parseErr
 }
 
-func (p *jsonObjectStreamParser) parseUser() (UserData, error) {
-	var user string
-	metParenthesisAtLeastOnce := false
+func (p *jsonObjectStreamParser) expectDelim(expected json.Delim) error {
+	offset := p.decoder.InputOffset()
+	token, err := p.decoder.Token()
+	if err != nil {
+		return p.error(err, offset)
+	}
 
-	expectedClosingBraceCount := 0
+	if delim, ok := token.(json.Delim); !ok || delim != expected {
+		return p.error(fmt.Errorf("expected '%s' but found %v", expected, token), offset)
+	}
+	return nil
+}
+
+// parseUsers parses the user data list and passes each object to the callback. It stops once "ctx" is done
+func (p *jsonObjectStreamParser) parseUsers(ctx context.Context, callback UserDataCallback) error {
+	err := p.expectDelim('[')
+	if err != nil {
+		return err
+	}
+
+	for p.decoder.More() {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
 
-	for {
-		c, _, err := p.reader.ReadRune()
+		user, err := p.parseUser()
 		if err != nil {
-			if err == io.EOF && expectedClosingBraceCount > 0 {
-				return "", BadInput
-			}
-			return "", err
+			return err
 		}
 
-		user = user + string(c)
-		switch c {
-		case '{':
-			expectedClosingBraceCount++
-			metParenthesisAtLeastOnce = true
-		case '}':
-			expectedClosingBraceCount--
+		err = callback(user)
+		if err != nil {
+			return err
 		}
+		p.index++
+	}
+
+	err = p.expectDelim(']')
+	if err != nil {
+		return err
+	}
 
-		if metParenthesisAtLeastOnce && len(user) > 0 && expectedClosingBraceCount == 0 {
-			break
+	offset := p.decoder.InputOffset()
+	_, err = p.decoder.Token()
+	if err != io.EOF {
+		if err == nil {
+			err = errors.New("unexpected data after the user list")
 		}
+		return p.error(err, offset)
+	}
+	return nil
+}
+
+func (p *jsonObjectStreamParser) parseUser() (UserData, error) {
+	var raw json.RawMessage
+	offset := p.decoder.InputOffset()
+	err := p.decoder.Decode(&raw)
+	if err != nil {
+		return "", p.error(err, offset)
+	}
+
+	if len(raw) == 0 || raw[0] != '{' {
+		valueOffset := p.decoder.InputOffset() - int64(len(raw))
+		return "", p.error(errors.New("expected a JSON object"), valueOffset)
 	}
-	return UserData(strings.Trim(user, " ")), nil
+	return UserData(raw), nil
 }
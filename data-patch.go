@@ -0,0 +1,447 @@
+package ditt
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// applyMergePatch applies a JSON Merge Patch (RFC 7386) on the JSON document "doc"
+func applyMergePatch(doc []byte, patch []byte) ([]byte, error) {
+	var (
+		target      interface{}
+		patchObject interface{}
+	)
+
+	if len(bytes.TrimSpace(doc)) > 0 {
+		err := json.Unmarshal(doc, &target)
+		if err != nil {
+			return nil, BadInput
+		}
+	}
+
+	err := json.Unmarshal(patch, &patchObject)
+	if err != nil {
+		return nil, BadInput
+	}
+
+	return json.Marshal(mergePatchValue(target, patchObject))
+}
+
+func mergePatchValue(target interface{}, patch interface{}) interface{} {
+	patchMap, isObject := patch.(map[string]interface{})
+	if !isObject {
+		return patch
+	}
+
+	targetMap, isObject := target.(map[string]interface{})
+	if !isObject {
+		targetMap = map[string]interface{}{}
+	}
+
+	for name, value := range patchMap {
+		if value == nil {
+			delete(targetMap, name)
+		} else {
+			targetMap[name] = mergePatchValue(targetMap[name], value)
+		}
+	}
+	return targetMap
+}
+
+// createMergePatch computes the JSON Merge Patch (RFC 7386) that turns "original" into "modified"
+func createMergePatch(original []byte, modified []byte) ([]byte, error) {
+	var originalValue, modifiedValue interface{}
+
+	err := json.Unmarshal(original, &originalValue)
+	if err != nil {
+		return nil, BadInput
+	}
+
+	err = json.Unmarshal(modified, &modifiedValue)
+	if err != nil {
+		return nil, BadInput
+	}
+
+	originalMap, isObject := originalValue.(map[string]interface{})
+	if !isObject {
+		return nil, BadInput
+	}
+
+	modifiedMap, isObject := modifiedValue.(map[string]interface{})
+	if !isObject {
+		return nil, BadInput
+	}
+
+	return json.Marshal(mergePatchDiff(originalMap, modifiedMap))
+}
+
+func mergePatchDiff(original map[string]interface{}, modified map[string]interface{}) map[string]interface{} {
+	patch := map[string]interface{}{}
+	for name := range original {
+		if _, found := modified[name]; !found {
+			patch[name] = nil
+		}
+	}
+
+	for name, modifiedValue := range modified {
+		originalValue, found := original[name]
+		if found && reflect.DeepEqual(originalValue, modifiedValue) {
+			continue
+		}
+
+		originalMap, originalIsObject := originalValue.(map[string]interface{})
+		modifiedMap, modifiedIsObject := modifiedValue.(map[string]interface{})
+		if found && originalIsObject && modifiedIsObject {
+			patch[name] = mergePatchDiff(originalMap, modifiedMap)
+		} else {
+			patch[name] = modifiedValue
+		}
+	}
+	return patch
+}
+
+// jsonPatchOperation is an operation of a JSON Patch (RFC 6902) document
+type jsonPatchOperation struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch applies a JSON Patch (RFC 6902) on the JSON document "doc"
+func applyJSONPatch(doc []byte, patch []byte) ([]byte, error) {
+	var (
+		target     interface{}
+		operations []jsonPatchOperation
+	)
+
+	err := json.Unmarshal(doc, &target)
+	if err != nil {
+		return nil, BadInput
+	}
+
+	err = json.Unmarshal(patch, &operations)
+	if err != nil {
+		return nil, BadInput
+	}
+
+	for _, operation := range operations {
+		target, err = operation.apply(target)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(target)
+}
+
+// assertJSONPatchHidesSecrets checks that no operation of the JSON Patch "patch" reads one of the "hidden" paths.
+// The patch is applied on the stored user, so testing, copying or moving such a field would reveal its value.
+// The add, replace and remove operations can still write them
+func assertJSONPatchHidesSecrets(patch []byte, hidden []string) error {
+	var operations []jsonPatchOperation
+	err := json.Unmarshal(patch, &operations)
+	if err != nil {
+		return BadInput
+	}
+
+	for _, operation := range operations {
+		var pointer string
+		switch operation.Op {
+		case "test":
+			pointer = operation.Path
+		case "copy", "move":
+			pointer = operation.From
+		default:
+			continue
+		}
+
+		tokens, err := parseJSONPointer(pointer)
+		if err != nil {
+			return err
+		}
+
+		path := strings.Join(tokens, ".")
+		for _, hiddenPath := range hidden {
+			if path == "" || path == hiddenPath || strings.HasPrefix(path, hiddenPath+".") || strings.HasPrefix(hiddenPath, path+".") {
+				return newError(BadInput, "JSON patch operation '"+operation.Op+"' cannot read the sensitive field '"+hiddenPath+"'", nil)
+			}
+		}
+	}
+	return nil
+}
+
+func (o *jsonPatchOperation) value() (interface{}, error) {
+	if o.Value == nil {
+		return nil, BadInput
+	}
+
+	var value interface{}
+	err := json.Unmarshal(*o.Value, &value)
+	if err != nil {
+		return nil, BadInput
+	}
+	return value, nil
+}
+
+func (o *jsonPatchOperation) apply(doc interface{}) (interface{}, error) {
+	switch o.Op {
+	case "add":
+		value, err := o.value()
+		if err != nil {
+			return nil, err
+		}
+		return jsonPointerAdd(doc, o.Path, value)
+
+	case "remove":
+		doc, _, err := jsonPointerRemove(doc, o.Path)
+		return doc, err
+
+	case "replace":
+		value, err := o.value()
+		if err != nil {
+			return nil, err
+		}
+		doc, _, err = jsonPointerRemove(doc, o.Path)
+		if err != nil {
+			return nil, err
+		}
+		return jsonPointerAdd(doc, o.Path, value)
+
+	case "move":
+		if strings.HasPrefix(o.Path, o.From+"/") {
+			return nil, BadInput
+		}
+		doc, value, err := jsonPointerRemove(doc, o.From)
+		if err != nil {
+			return nil, err
+		}
+		return jsonPointerAdd(doc, o.Path, value)
+
+	case "copy":
+		value, err := jsonPointerGet(doc, o.From)
+		if err != nil {
+			return nil, err
+		}
+		return jsonPointerAdd(doc, o.Path, deepCopyJSONValue(value))
+
+	case "test":
+		expected, err := o.value()
+		if err != nil {
+			return nil, err
+		}
+		value, err := jsonPointerGet(doc, o.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(expected, value) {
+			return nil, BadInput
+		}
+		return doc, nil
+
+	default:
+		return nil, BadInput
+	}
+}
+
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, BadInput
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		token = strings.Replace(token, "~1", "/", -1)
+		tokens[i] = strings.Replace(token, "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func jsonArrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+
+	if len(token) > 1 && token[0] == '0' {
+		return 0, BadInput
+	}
+
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 {
+		return 0, BadInput
+	}
+
+	if index > length || (index == length && !allowEnd) {
+		return 0, BadInput
+	}
+	return index, nil
+}
+
+func jsonPointerGet(doc interface{}, pointer string) (interface{}, error) {
+	tokens, err := parseJSONPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, token := range tokens {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, found := node[token]
+			if !found {
+				return nil, BadInput
+			}
+			doc = value
+
+		case []interface{}:
+			index, err := jsonArrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[index]
+
+		default:
+			return nil, BadInput
+		}
+	}
+	return doc, nil
+}
+
+func jsonPointerAdd(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+	tokens, err := parseJSONPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := jsonPointerGet(doc, parentPointer)
+	if err != nil {
+		return nil, err
+	}
+
+	last := tokens[len(tokens)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return doc, nil
+
+	case []interface{}:
+		index, err := jsonArrayIndex(last, len(node), true)
+		if err != nil {
+			return nil, err
+		}
+
+		node = append(node, nil)
+		copy(node[index+1:], node[index:])
+		node[index] = value
+		return jsonPointerReplaceArray(doc, parentPointer, node)
+
+	default:
+		return nil, BadInput
+	}
+}
+
+func jsonPointerRemove(doc interface{}, pointer string) (interface{}, interface{}, error) {
+	tokens, err := parseJSONPointer(pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(tokens) == 0 {
+		return nil, doc, nil
+	}
+
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := jsonPointerGet(doc, parentPointer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	last := tokens[len(tokens)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, found := node[last]
+		if !found {
+			return nil, nil, BadInput
+		}
+		delete(node, last)
+		return doc, value, nil
+
+	case []interface{}:
+		index, err := jsonArrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		value := node[index]
+		node = append(node[:index:index], node[index+1:]...)
+		doc, err = jsonPointerReplaceArray(doc, parentPointer, node)
+		return doc, value, err
+
+	default:
+		return nil, nil, BadInput
+	}
+}
+
+// jsonPointerReplaceArray sets the array value referenced by "pointer". It is needed because
+// growing or shrinking a slice does not update the reference held by its container
+func jsonPointerReplaceArray(doc interface{}, pointer string, array []interface{}) (interface{}, error) {
+	tokens, err := parseJSONPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return array, nil
+	}
+
+	parent, err := jsonPointerGet(doc, pointer[:strings.LastIndex(pointer, "/")])
+	if err != nil {
+		return nil, err
+	}
+
+	last := tokens[len(tokens)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = array
+	case []interface{}:
+		index, err := jsonArrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		node[index] = array
+	default:
+		return nil, BadInput
+	}
+	return doc, nil
+}
+
+func deepCopyJSONValue(value interface{}) interface{} {
+	switch node := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(node))
+		for name, item := range node {
+			copied[name] = deepCopyJSONValue(item)
+		}
+		return copied
+
+	case []interface{}:
+		copied := make([]interface{}, len(node))
+		for i, item := range node {
+			copied[i] = deepCopyJSONValue(item)
+		}
+		return copied
+
+	default:
+		return value
+	}
+}
@@ -1,73 +1,174 @@
 package ditt
 
 import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // UserDataCallback is function that handle a UserData
 type UserDataCallback func(UserData) error
 
-type UserDataProvider func(callback UserDataCallback) error
+// UserDataProvider is a function that passes each UserData it loads to the callback. It must stop once "ctx" is done
+type UserDataProvider func(ctx context.Context, callback UserDataCallback) error
 
 // UserDataProcessor is a convenience for user data processor
 type UserDataProcessor interface {
-	ProcessData(data UserData) (UserData, error)
+	ProcessData(ctx context.Context, data UserData) (UserData, error)
 }
 
 // UserDataProcessorFunc is a function that implements  of UserDataProcessor
-type UserDataProcessorFunc func(data UserData) (UserData, error)
+type UserDataProcessorFunc func(ctx context.Context, data UserData) (UserData, error)
 
-func (f UserDataProcessorFunc) ProcessData(data UserData) (UserData, error) {
-	return f(data)
+func (f UserDataProcessorFunc) ProcessData(ctx context.Context, data UserData) (UserData, error) {
+	return f(ctx, data)
 }
 
 const (
 	tasksResultPublishingQueueSize = 10
+
+	// DefaultRunnerQueueSize is the default number of provided user data that can wait for a runner worker
+	DefaultRunnerQueueSize = 100
 )
 
 // UserDataProcessingResult holds info about UserData processing result
 type UserDataProcessingResult struct {
 	Err    error
+	Index  int
 	UserId string
 	Data   UserData
 }
 
 // ConcurrentUserDataProcessingRunner starts a routine. And for each provided UserData calls the callback and returns
-// the result to the caller through the "results" channel
+// the result to the caller through the "results" channel.
+// Provided UserData are queued and processed by a fixed number of workers. Once the queue is full the provider is
+// blocked until a worker is available
 type ConcurrentUserDataProcessingRunner struct {
 	Provider            UserDataProvider
 	Processor           UserDataProcessor
 	TasksResultsSignals chan<- chan UserDataProcessingResult
 	ResultSignal        chan<- chan error
+
+	// Workers is the number of routines that process the provided UserData. Defaults to the number of CPUs
+	Workers int
+
+	// QueueSize is the number of provided UserData that can wait for a worker. Defaults to DefaultRunnerQueueSize
+	QueueSize int
+
+	// Logger writes the processing failures along with the request id held by the context
+	Logger *Logger
+}
+
+type userDataProcessingTask struct {
+	index int
+	data  UserData
+}
+
+func (r ConcurrentUserDataProcessingRunner) workers() int {
+	if r.Workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return r.Workers
+}
+
+func (r ConcurrentUserDataProcessingRunner) queueSize() int {
+	if r.QueueSize <= 0 {
+		return DefaultRunnerQueueSize
+	}
+	return r.QueueSize
+}
+
+// uncanceledContext keeps the values of its parent but is never done
+type uncanceledContext struct {
+	context.Context
+}
+
+func (uncanceledContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (uncanceledContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (uncanceledContext) Err() error {
+	return nil
+}
+
+// work processes the queued tasks. Once "ctx" is done the remaining tasks are drained without being processed
+func (r ConcurrentUserDataProcessingRunner) work(ctx context.Context, tasks <-chan userDataProcessingTask, results chan<- UserDataProcessingResult, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for task := range tasks {
+		metrics.runnerQueueDepth.Add(-1)
+		if ctx.Err() != nil {
+			continue
+		}
+
+		// A started task is not canceled so that a user never ends up with its file saved and no store record
+		result := UserDataProcessingResult{Index: task.index, UserId: task.data.Id()}
+		result.Data, result.Err = r.Processor.ProcessData(uncanceledContext{ctx}, task.data)
+		if result.Err != nil {
+			r.logFailure(ctx, result)
+		}
+		results <- result
+	}
 }
 
-func (r ConcurrentUserDataProcessingRunner) dispatch() error {
+// logFailure writes the failures caused by the input at debug level and the others at warn level
+func (r ConcurrentUserDataProcessingRunner) logFailure(ctx context.Context, result UserDataProcessingResult) {
+	logger := r.Logger.WithContext(ctx)
+	if errorKind(result.Err) == Internal {
+		logger.Warn("user data processing failed", "index", result.Index, "user", result.UserId, "error", result.Err)
+		return
+	}
+	logger.Debug("user data rejected", "index", result.Index, "user", result.UserId, "error", result.Err)
+}
+
+func (r ConcurrentUserDataProcessingRunner) dispatch(ctx context.Context) error {
 	results := make(chan UserDataProcessingResult, tasksResultPublishingQueueSize)
 	defer close(results)
 
 	wg := &sync.WaitGroup{}
 	r.TasksResultsSignals <- results
 
-	err := r.Provider(func(data UserData) error {
+	tasks := make(chan userDataProcessingTask, r.queueSize())
+	for i := 0; i < r.workers(); i++ {
 		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			result := UserDataProcessingResult{UserId: data.Id()}
-			result.Data, result.Err = r.Processor.ProcessData(data)
-			results <- result
-		}()
-		return nil
+		go r.work(ctx, tasks, results, wg)
+	}
+
+	index := 0
+	err := r.Provider(ctx, func(data UserData) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// The depth is increased before queuing so that it is never decreased first by the worker
+		metrics.runnerQueueDepth.Add(1)
+		select {
+		case tasks <- userDataProcessingTask{index: index, data: data}:
+			index++
+			return nil
+		case <-ctx.Done():
+			metrics.runnerQueueDepth.Add(-1)
+			return ctx.Err()
+		}
 	})
+	close(tasks)
 	wg.Wait()
 	return err
 }
 
-func (r ConcurrentUserDataProcessingRunner) Run() {
+// Run starts the processing. The provider is stopped as soon as "ctx" is done
+func (r ConcurrentUserDataProcessingRunner) Run(ctx context.Context) {
 	go func() {
-		err := r.dispatch()
+		err := r.dispatch(ctx)
 		result := make(chan error)
 		defer close(result)
 		r.ResultSignal <- result
@@ -76,20 +177,59 @@ func (r ConcurrentUserDataProcessingRunner) Run() {
 }
 
 var writeProcessors = []UserDataProcessor{
+	UserDataProcessorFunc(checkPasswordPolicy),
 	UserDataProcessorFunc(saveDataIntoFile),
 	UserDataProcessorFunc(hashPassword),
 	// UserDataProcessorFunc(transformUserId),
 }
 
+// createProcessors are the writeProcessors but the saving of the data file. The file of a created user is saved
+// once its record is, so that a failed creation leaves the file of a registered user untouched
+var createProcessors = []UserDataProcessor{
+	UserDataProcessorFunc(checkPasswordPolicy),
+	UserDataProcessorFunc(hashPassword),
+}
+
 var readProcessors = []UserDataProcessor{
 	// UserDataProcessorFunc(removeUserId),
 	UserDataProcessorFunc(mergeWithDataFromFile),
 }
 
-func processData(processors []UserDataProcessor, data UserData) (UserData, error) {
+// newLimitedUserDataProvider creates a provider that fails with BadInput if "provider" passes more than "max" users.
+// The users are held until the end of the list so that none is passed when the list is rejected
+func newLimitedUserDataProvider(provider UserDataProvider, max int) UserDataProvider {
+	return func(ctx context.Context, callback UserDataCallback) error {
+		var users []UserData
+		err := provider(ctx, func(data UserData) error {
+			if len(users) == max {
+				return fmt.Errorf("%w: at most %d users can be added", BadInput, max)
+			}
+			users = append(users, data)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, user := range users {
+			err = callback(user)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+var exportProcessors = []UserDataProcessor{
+	UserDataProcessorFunc(removeDatabaseId),
+	UserDataProcessorFunc(mergeWithDataFromFile),
+}
+
+func processData(ctx context.Context, processors []UserDataProcessor, data UserData) (UserData, error) {
 	var err error
 	for _, processor := range processors {
-		data, err = processor.ProcessData(data)
+		data, err = processor.ProcessData(ctx, data)
 		if err != nil {
 			return "", err
 		}
@@ -97,25 +237,26 @@ func processData(processors []UserDataProcessor, data UserData) (UserData, error
 	return data, nil
 }
 
-func hashPassword(data UserData) (UserData, error) {
+func hashPassword(_ context.Context, data UserData) (UserData, error) {
 	if data == "" {
 		return data, nil
 	}
 
-	hashBytes, err := bcrypt.GenerateFromPassword([]byte(data.Password()), 12)
+	hash, err := hashPasswordValue(data.Password())
 	if err != nil {
 		return "", err
 	}
-	updateData, err := sjson.Set(string(data), "password", string(hashBytes))
+	updateData, err := sjson.Set(string(data), "password", hash)
 	return UserData(updateData), err
 }
 
-func saveDataIntoFile(data UserData) (UserData, error) {
+func saveDataIntoFile(ctx context.Context, data UserData) (UserData, error) {
 	if data == "" {
 		return data, nil
 	}
 
-	err := Env.Files.Save(data.Id(), data.Data())
+	// The raw JSON value is saved so that its type is restored when it is read
+	err := Env.Files.Save(ctx, data.Id(), gjson.Get(string(data), "data").Raw)
 	if err != nil {
 		return "", err
 	}
@@ -124,19 +265,79 @@ func saveDataIntoFile(data UserData) (UserData, error) {
 	return UserData(updateData), err
 }
 
-func mergeWithDataFromFile(data UserData) (UserData, error) {
+func mergeWithDataFromFile(ctx context.Context, data UserData) (UserData, error) {
 	if data == "" {
 		return data, nil
 	}
 
-	content, err := Env.Files.Get(data.Id())
+	content, err := Env.Files.Get(ctx, data.Id())
 	if err != nil {
 		return data, err
 	}
 
-	if content != "" {
+	if content == "" {
+		return data, nil
+	}
+
+	// Files written before the values were saved as raw JSON hold unquoted strings
+	if !gjson.Valid(content) {
 		updateData, err := sjson.Set(string(data), "data", content)
 		return UserData(updateData), err
 	}
-	return data, nil
+
+	updateData, err := sjson.SetRaw(string(data), "data", content)
+	return UserData(updateData), err
+}
+
+func removeDatabaseId(_ context.Context, data UserData) (UserData, error) {
+	if data == "" {
+		return data, nil
+	}
+
+	updateData, err := sjson.Delete(string(data), "_id")
+	return UserData(updateData), err
+}
+
+// DefaultSensitiveFields are the paths of the fields removed from the users that are read when Env.SensitiveFields is not set
+var DefaultSensitiveFields = []string{"password"}
+
+func sensitiveFields() []string {
+	if Env.SensitiveFields != nil {
+		return Env.SensitiveFields
+	}
+	return DefaultSensitiveFields
+}
+
+// isSensitiveField tells whether the field at "path" is one of the sensitive fields
+func isSensitiveField(path string) bool {
+	for _, field := range sensitiveFields() {
+		if path == field || strings.HasPrefix(path, field+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutSecrets appends the removal of the sensitive fields to the processors unless "includeSecrets" is set
+func withoutSecrets(processors []UserDataProcessor, includeSecrets bool) []UserDataProcessor {
+	if includeSecrets {
+		return processors
+	}
+	return append(processors[:len(processors):len(processors)], UserDataProcessorFunc(removeSensitiveFields))
+}
+
+func removeSensitiveFields(_ context.Context, data UserData) (UserData, error) {
+	if data == "" {
+		return data, nil
+	}
+
+	updateData := string(data)
+	for _, path := range sensitiveFields() {
+		var err error
+		updateData, err = sjson.Delete(updateData, path)
+		if err != nil {
+			return "", err
+		}
+	}
+	return UserData(updateData), nil
 }
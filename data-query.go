@@ -0,0 +1,488 @@
+package ditt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// FilterOperator is the comparison applied by a FilterClause
+type FilterOperator string
+
+const (
+	// FilterEquals matches the users whose value at the clause path equals the clause value
+	FilterEquals FilterOperator = "=="
+
+	// FilterPrefix matches the users whose string value at the clause path starts with the clause value
+	FilterPrefix FilterOperator = "^="
+)
+
+// FilterClause is a condition on the value found at a path of the stored user documents
+type FilterClause struct {
+	Path     string
+	Operator FilterOperator
+
+	// Value is a string, a float64, a bool or nil
+	Value interface{}
+}
+
+// SortKey is a path of the stored user documents by which the users are ordered
+type SortKey struct {
+	Path       string
+	Descending bool
+}
+
+// UserQuery restricts, orders and projects the users returned by a store listing.
+// The users matching all the Filter clauses are ordered by the Sort keys then by id.
+// Only the Fields paths and the id are kept in the returned users when Fields is not empty
+type UserQuery struct {
+	Filter []FilterClause
+	Sort   []SortKey
+	Fields []string
+}
+
+// QueryError holds info about an invalid filter, sort or fields expression
+type QueryError struct {
+	// Param is the name of the invalid ListOptions expression
+	Param string `json:"param"`
+
+	// Position is the position in bytes of the error in the expression
+	Position int `json:"position"`
+
+	// Message describes the error
+	Message string `json:"message"`
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%s, position %d: %s", e.Param, e.Position, e.Message)
+}
+
+// Is makes a QueryError match BadInput
+func (e *QueryError) Is(target error) bool {
+	return errors.Is(target, BadInput)
+}
+
+// ErrorDetails tells the expression and the position of the error
+func (e *QueryError) ErrorDetails() *ErrorDetails {
+	position := int64(e.Position)
+	return &ErrorDetails{Field: e.Param, Position: &position}
+}
+
+var queryPathRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*`)
+
+// queryForbiddenFields are the fields no expression can refer to
+var queryForbiddenFields = map[string]bool{
+	"_id":      true,
+	"password": true,
+}
+
+// parseQueryPath reads the document path at the beginning of "expression".
+// The path is rejected if it is, contains or is contained by one of the "hidden" paths
+func parseQueryPath(param string, expression string, position int, hidden []string) (string, error) {
+	path := queryPathRegexp.FindString(expression)
+	if path == "" {
+		return "", &QueryError{Param: param, Position: position, Message: "expected a field path"}
+	}
+
+	if queryForbiddenFields[strings.Split(path, ".")[0]] {
+		return "", &QueryError{Param: param, Position: position, Message: fmt.Sprintf("field '%s' cannot be queried", path)}
+	}
+
+	// The data field is saved in the files, not in the store the users are matched and ordered by
+	if strings.Split(path, ".")[0] == "data" {
+		return "", &QueryError{Param: param, Position: position, Message: fmt.Sprintf("field '%s' is not stored with the users and cannot be queried", path)}
+	}
+
+	for _, hiddenPath := range hidden {
+		if path == hiddenPath || strings.HasPrefix(path, hiddenPath+".") || strings.HasPrefix(hiddenPath, path+".") {
+			return "", &QueryError{Param: param, Position: position, Message: fmt.Sprintf("field '%s' cannot be queried without the '%s' permission", path, PermissionReadSecrets)}
+		}
+	}
+	return path, nil
+}
+
+// ParseFilter parses a filter expression. It is a comma separated list of clauses that must all match.
+// A clause is made of a field path, an operator ("==" for equality or "^=" for string prefix) and a value.
+// The value is a JSON literal or a raw string which ends at the next comma. The "data" field cannot be filtered. For example:
+//
+//	id^=user-,profile.city=="Paris, France",profile.age==30
+func ParseFilter(expression string) ([]FilterClause, error) {
+	return parseFilter(expression, nil)
+}
+
+func parseFilter(expression string, hidden []string) ([]FilterClause, error) {
+	var clauses []FilterClause
+
+	position := 0
+	for position < len(expression) {
+		path, err := parseQueryPath("filter", expression[position:], position, hidden)
+		if err != nil {
+			return nil, err
+		}
+		position += len(path)
+
+		operator := FilterOperator("")
+		for _, op := range []FilterOperator{FilterEquals, FilterPrefix} {
+			if strings.HasPrefix(expression[position:], string(op)) {
+				operator = op
+			}
+		}
+		if operator == "" {
+			return nil, &QueryError{Param: "filter", Position: position, Message: "expected '==' or '^='"}
+		}
+		position += len(operator)
+
+		value, length, err := parseFilterValue(expression[position:], operator)
+		if err != nil {
+			return nil, &QueryError{Param: "filter", Position: position, Message: err.Error()}
+		}
+		position += length
+
+		clauses = append(clauses, FilterClause{Path: path, Operator: operator, Value: value})
+
+		if position < len(expression) {
+			if expression[position] != ',' {
+				return nil, &QueryError{Param: "filter", Position: position, Message: "expected ','"}
+			}
+			position++
+			if position == len(expression) {
+				return nil, &QueryError{Param: "filter", Position: position, Message: "expected a clause after ','"}
+			}
+		}
+	}
+	return clauses, nil
+}
+
+// parseFilterValue reads the value at the beginning of "expression" and returns it with the number of bytes it spans
+func parseFilterValue(expression string, operator FilterOperator) (interface{}, int, error) {
+	if strings.HasPrefix(expression, `"`) {
+		end := 1
+		for ; end < len(expression); end++ {
+			if expression[end] == '\\' {
+				end++
+			} else if expression[end] == '"' {
+				break
+			}
+		}
+		if end >= len(expression) {
+			return nil, 0, fmt.Errorf("unterminated string")
+		}
+
+		var value string
+		err := json.Unmarshal([]byte(expression[:end+1]), &value)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid string")
+		}
+		return value, end + 1, nil
+	}
+
+	raw := expression
+	if comma := strings.IndexByte(expression, ','); comma >= 0 {
+		raw = expression[:comma]
+	}
+
+	if operator == FilterPrefix {
+		if raw == "" {
+			return nil, 0, fmt.Errorf("expected a prefix")
+		}
+		return raw, len(raw), nil
+	}
+
+	switch raw {
+	case "null":
+		return nil, len(raw), nil
+	case "true":
+		return true, len(raw), nil
+	case "false":
+		return false, len(raw), nil
+	}
+
+	if number, err := strconv.ParseFloat(raw, 64); err == nil && json.Valid([]byte(raw)) {
+		return number, len(raw), nil
+	}
+	return raw, len(raw), nil
+}
+
+// ParseSort parses a sort expression. It is a comma separated list of field paths. A path prefixed with '-' sorts in decreasing order.
+// The "data" field cannot be sorted by
+func ParseSort(expression string) ([]SortKey, error) {
+	return parseSort(expression, nil)
+}
+
+func parseSort(expression string, hidden []string) ([]SortKey, error) {
+	var keys []SortKey
+
+	position := 0
+	for position < len(expression) {
+		key := SortKey{}
+		if expression[position] == '-' {
+			key.Descending = true
+			position++
+		}
+
+		path, err := parseQueryPath("sort", expression[position:], position, hidden)
+		if err != nil {
+			return nil, err
+		}
+		key.Path = path
+		position += len(path)
+		keys = append(keys, key)
+
+		if position < len(expression) {
+			if expression[position] != ',' {
+				return nil, &QueryError{Param: "sort", Position: position, Message: "expected ','"}
+			}
+			position++
+			if position == len(expression) {
+				return nil, &QueryError{Param: "sort", Position: position, Message: "expected a field path after ','"}
+			}
+		}
+	}
+	return keys, nil
+}
+
+// ParseFields parses a fields expression. It is a comma separated list of field paths. The "data" field can only be selected as a whole
+func ParseFields(expression string) ([]string, error) {
+	var fields []string
+
+	position := 0
+	for position < len(expression) {
+		path := queryPathRegexp.FindString(expression[position:])
+		if path == "" || path == "_id" {
+			return nil, &QueryError{Param: "fields", Position: position, Message: "expected a field path"}
+		}
+
+		// The data field is read from the files as a whole
+		if strings.HasPrefix(path, "data.") {
+			return nil, &QueryError{Param: "fields", Position: position, Message: fmt.Sprintf("field '%s' cannot be selected, only the whole 'data' field can", path)}
+		}
+		fields = append(fields, path)
+		position += len(path)
+
+		if position < len(expression) {
+			if expression[position] != ',' {
+				return nil, &QueryError{Param: "fields", Position: position, Message: "expected ','"}
+			}
+			position++
+			if position == len(expression) {
+				return nil, &QueryError{Param: "fields", Position: position, Message: "expected a field path after ','"}
+			}
+		}
+	}
+	return fields, nil
+}
+
+func parseUserQuery(opts ListOptions) (*UserQuery, error) {
+	var (
+		query = &UserQuery{}
+		err   error
+	)
+
+	query.Filter, err = ParseFilter(opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	query.Sort, err = ParseSort(opts.Sort)
+	if err != nil {
+		return nil, err
+	}
+
+	query.Fields, err = ParseFields(opts.Fields)
+	if err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
+// assertQueryHidesSecrets checks that neither the filter nor the sort expression refers to a sensitive field.
+// Matching or ordering the users by such a field would reveal its value to the callers who cannot read it
+func assertQueryHidesSecrets(opts ListOptions) error {
+	_, err := parseFilter(opts.Filter, sensitiveFields())
+	if err != nil {
+		return err
+	}
+
+	_, err = parseSort(opts.Sort, sensitiveFields())
+	return err
+}
+
+func (q *UserQuery) filter() []FilterClause {
+	if q == nil {
+		return nil
+	}
+	return q.Filter
+}
+
+// hasField tells whether the users returned for this query hold the field "name"
+func (q *UserQuery) hasField(name string) bool {
+	if q == nil || len(q.Fields) == 0 {
+		return true
+	}
+
+	for _, field := range q.Fields {
+		if field == name || strings.HasPrefix(field, name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// match evaluates the filter clauses on the user document
+func (q *UserQuery) match(data UserData) bool {
+	if q == nil {
+		return true
+	}
+
+	for _, clause := range q.Filter {
+		if !clause.match(filterValue(data, clause.Path)) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterValue gets the value found at "path" in the user document unless it is or lies in an array.
+// Mongo would compare a clause with each array element, which the memory store does not do
+func filterValue(data UserData, path string) gjson.Result {
+	segments := strings.Split(path, ".")
+	for i := range segments {
+		if gjson.Get(string(data), strings.Join(segments[:i+1], ".")).IsArray() {
+			return gjson.Result{}
+		}
+	}
+	return gjson.Get(string(data), path)
+}
+
+func (c *FilterClause) match(result gjson.Result) bool {
+	if c.Operator == FilterPrefix {
+		prefix, _ := c.Value.(string)
+		return result.Type == gjson.String && strings.HasPrefix(result.Str, prefix)
+	}
+
+	switch value := c.Value.(type) {
+	case nil:
+		return result.Exists() && result.Type == gjson.Null
+	case string:
+		return result.Type == gjson.String && result.Str == value
+	case float64:
+		return result.Type == gjson.Number && result.Num == value
+	case bool:
+		return (result.Type == gjson.True || result.Type == gjson.False) && result.Bool() == value
+	default:
+		return false
+	}
+}
+
+// sortIds orders the ids of the users by the query sort keys then by id
+func (q *UserQuery) sortIds(ids []string, records map[string]UserData) {
+	sort.Strings(ids)
+	if q == nil || len(q.Sort) == 0 {
+		return
+	}
+
+	sort.SliceStable(ids, func(i, j int) bool {
+		for _, key := range q.Sort {
+			a := gjson.Get(string(records[ids[i]]), key.Path)
+			b := gjson.Get(string(records[ids[j]]), key.Path)
+			if key.Descending {
+				a, b = b, a
+			}
+
+			if a.Less(b, true) {
+				return true
+			}
+			if b.Less(a, true) {
+				return false
+			}
+		}
+		return false
+	})
+}
+
+// project keeps only the id and the query fields of the user document
+func (q *UserQuery) project(data UserData) (UserData, error) {
+	if q == nil || len(q.Fields) == 0 || data == "" {
+		return data, nil
+	}
+
+	projected, err := sjson.Set("{}", "id", data.Id())
+	if err != nil {
+		return "", err
+	}
+
+	for _, field := range q.Fields {
+		result := gjson.Get(string(data), field)
+		if !result.Exists() {
+			continue
+		}
+		projected, err = sjson.SetRaw(projected, field, result.Raw)
+		if err != nil {
+			return "", err
+		}
+	}
+	return UserData(projected), nil
+}
+
+// selector translates the filter clauses into a mongo query selector. It matches the same users as match does:
+// a null value does not match a missing field and no clause matches a value that is or lies in an array
+func (q *UserQuery) selector() bson.M {
+	if q == nil || len(q.Filter) == 0 {
+		return bson.M{}
+	}
+
+	var conditions []bson.M
+	for _, clause := range q.Filter {
+		switch {
+		case clause.Operator == FilterPrefix:
+			prefix, _ := clause.Value.(string)
+			conditions = append(conditions, bson.M{clause.Path: bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}})
+		case clause.Value == nil:
+			conditions = append(conditions, bson.M{clause.Path: bson.M{"$type": "null"}})
+		default:
+			conditions = append(conditions, bson.M{clause.Path: bson.M{"$eq": clause.Value}})
+		}
+
+		segments := strings.Split(clause.Path, ".")
+		for i := range segments {
+			conditions = append(conditions, bson.M{strings.Join(segments[:i+1], "."): bson.M{"$not": bson.M{"$type": "array"}}})
+		}
+	}
+	return bson.M{"$and": conditions}
+}
+
+// sortFields translates the sort keys into mongo sort fields. The id is always the last key
+func (q *UserQuery) sortFields() []string {
+	var fields []string
+	if q != nil {
+		for _, key := range q.Sort {
+			if key.Descending {
+				fields = append(fields, "-"+key.Path)
+			} else {
+				fields = append(fields, key.Path)
+			}
+		}
+	}
+	return append(fields, "id")
+}
+
+// projection translates the query fields into a mongo projection. It returns nil if all the fields are selected
+func (q *UserQuery) projection() bson.M {
+	if q == nil || len(q.Fields) == 0 {
+		return nil
+	}
+
+	projection := bson.M{"id": 1}
+	for _, field := range q.Fields {
+		projection[field] = 1
+	}
+	return projection
+}
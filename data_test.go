@@ -2,10 +2,20 @@ package ditt
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/globalsign/mgo/bson"
 	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestParsing(t *testing.T) {
@@ -22,7 +32,7 @@ func TestParsing(t *testing.T) {
 		parser := newJsonObjectStreamParser(reader)
 
 		var parsed []UserData
-		err := parser.parseUsers(func(data UserData) error {
+		err := parser.parseUsers(context.Background(), func(data UserData) error {
 			parsed = append(parsed, data)
 			return nil
 		})
@@ -39,10 +49,775 @@ func TestParsing(t *testing.T) {
 		parser = newJsonObjectStreamParser(reader)
 		parsed = nil
 
-		err = parser.parseUsers(func(data UserData) error {
+		err = parser.parseUsers(context.Background(), func(data UserData) error {
 			parsed = append(parsed, data)
 			return nil
 		})
+		So(errors.Is(err, BadInput), ShouldBeTrue)
+
+		var parseErr *ParseError
+		So(errors.As(err, &parseErr), ShouldBeTrue)
+		So(parseErr.Index, ShouldEqual, 0)
+		So(parseErr.Offset, ShouldEqual, len(dataset))
+
+		// parsing must stop once the context is done
+		ctx, cancel := context.WithCancel(context.Background())
+		dataset = fmt.Sprintf("[%s, %s, %s]", user0, user1, user2)
+		reader = bytes.NewBufferString(dataset)
+		parser = newJsonObjectStreamParser(reader)
+		parsed = nil
+
+		err = parser.parseUsers(ctx, func(data UserData) error {
+			parsed = append(parsed, data)
+			cancel()
+			return nil
+		})
+		So(err, ShouldEqual, context.Canceled)
+		So(parsed, ShouldHaveLength, 1)
+	})
+}
+
+func TestParsingEdgeCases(t *testing.T) {
+	Convey("Test parsing of strings, nested values and surrounding data", t, func() {
+		parse := func(dataset string) ([]UserData, error) {
+			var parsed []UserData
+			parser := newJsonObjectStreamParser(bytes.NewBufferString(dataset))
+			err := parser.parseUsers(context.Background(), func(data UserData) error {
+				parsed = append(parsed, data)
+				return nil
+			})
+			return parsed, err
+		}
+
+		// braces, brackets and escaped quotes inside strings must not split objects
+		user0 := `{"id": "loki", "data": "a}b{c]\"}"}`
+		user1 := `{"id": "hulk", "data": {"friends": [["thor"], {"}": "{"}]}}`
+		parsed, err := parse(fmt.Sprintf("\n\t [ %s ,\n %s ] \n", user0, user1))
+		So(err, ShouldBeNil)
+		So(parsed, ShouldHaveLength, 2)
+		So(parsed[0], ShouldEqual, user0)
+		So(parsed[0].Data(), ShouldEqual, `a}b{c]"}`)
+		So(parsed[1], ShouldEqual, user1)
+
+		parsed, err = parse("[]")
+		So(err, ShouldBeNil)
+		So(parsed, ShouldBeEmpty)
+
+		var parseErr *ParseError
+
+		// data after the closing bracket must be rejected
+		_, err = parse(fmt.Sprintf("[%s] garbage", user0))
+		So(errors.As(err, &parseErr), ShouldBeTrue)
+		So(parseErr.Index, ShouldEqual, 1)
+
+		// array items must be objects
+		_, err = parse(fmt.Sprintf(`[%s, "hulk"]`, user0))
+		So(errors.As(err, &parseErr), ShouldBeTrue)
+		So(parseErr.Index, ShouldEqual, 1)
+		So(parseErr.Offset, ShouldEqual, len(user0)+3)
+
+		// the stream must be an array
+		_, err = parse(user0)
+		So(errors.Is(err, BadInput), ShouldBeTrue)
+
+		_, err = parse("")
+		So(errors.Is(err, BadInput), ShouldBeTrue)
+
+		_, err = parse("[" + user0)
+		So(errors.Is(err, BadInput), ShouldBeTrue)
+	})
+}
+
+func collectProvidedUsers(provider UserDataProvider) ([]UserData, error) {
+	var provided []UserData
+	err := provider(context.Background(), func(data UserData) error {
+		provided = append(provided, data)
+		return nil
+	})
+	return provided, err
+}
+
+func TestNDJsonUserDataProvider(t *testing.T) {
+	Convey("Test NDJSON user data provider", t, func() {
+		dataset := "{\"id\": \"hulk\", \"data\": \"smash\\n\"}\r\n\n{\"id\": \"loki\"}"
+		users, err := collectProvidedUsers(newNDJsonUserDataProvider(bytes.NewBufferString(dataset), AddUsersOptions{}))
+		So(err, ShouldBeNil)
+		So(users, ShouldHaveLength, 2)
+		So(users[0].Data(), ShouldEqual, "smash\n")
+		So(users[1].Id(), ShouldEqual, "loki")
+
+		// each line must hold a JSON object
+		dataset = "{\"id\": \"hulk\"}\n{\"id\": \"loki\"\n"
+		_, err = collectProvidedUsers(newNDJsonUserDataProvider(bytes.NewBufferString(dataset), AddUsersOptions{}))
+		So(errors.Is(err, BadInput), ShouldBeTrue)
+
+		var parseErr *ParseError
+		So(errors.As(err, &parseErr), ShouldBeTrue)
+		So(parseErr.Index, ShouldEqual, 1)
+		So(parseErr.Line, ShouldEqual, 2)
+		So(parseErr.Offset, ShouldEqual, 15)
+	})
+}
+
+func TestCsvUserDataProvider(t *testing.T) {
+	Convey("Test CSV user data provider", t, func() {
+		dataset := "login,secret,bio,age\nhulk,hulk-pass,\"green, angry\",48\nloki,loki-pass,trickster,1054\n"
+		opts := AddUsersOptions{CSVColumns: CSVColumns{Id: "login", Password: "secret", Data: "bio"}}
+		users, err := collectProvidedUsers(newCsvUserDataProvider(bytes.NewBufferString(dataset), opts))
+		So(err, ShouldBeNil)
+		So(users, ShouldHaveLength, 2)
+		So(users[0], ShouldEqual, `{"id":"hulk","password":"hulk-pass","data":"green, angry"}`)
+		So(users[1].Id(), ShouldEqual, "loki")
+
+		// default column names are the user data field names
+		dataset = "id,password\nthor,thor-pass\n"
+		users, err = collectProvidedUsers(newCsvUserDataProvider(bytes.NewBufferString(dataset), AddUsersOptions{}))
+		So(err, ShouldBeNil)
+		So(users, ShouldResemble, []UserData{`{"id":"thor","password":"thor-pass"}`})
+
+		// the id column is required
+		_, err = collectProvidedUsers(newCsvUserDataProvider(bytes.NewBufferString(dataset), opts))
+		So(errors.Is(err, BadInput), ShouldBeTrue)
+
+		// records must have as many fields as the header
+		dataset = "id,password\nthor,thor-pass\nodin\n"
+		_, err = collectProvidedUsers(newCsvUserDataProvider(bytes.NewBufferString(dataset), AddUsersOptions{}))
+		var parseErr *ParseError
+		So(errors.As(err, &parseErr), ShouldBeTrue)
+		So(parseErr.Index, ShouldEqual, 1)
+		So(parseErr.Line, ShouldEqual, 3)
+	})
+}
+
+func TestMergePatch(t *testing.T) {
+	Convey("Test JSON merge patch", t, func() {
+		doc := `{"id": "loki", "password": "hash", "data": {"title": "god", "weapon": "scepter"}}`
+
+		patched, err := applyMergePatch([]byte(doc), []byte(`{"data": {"weapon": null, "brother": "thor"}}`))
+		So(err, ShouldBeNil)
+
+		user := UserData(patched)
+		So(user.Id(), ShouldEqual, "loki")
+		So(user.Password(), ShouldEqual, "hash")
+		So(user.Data(), ShouldEqual, `{"brother":"thor","title":"god"}`)
+
+		// a patch must be a valid JSON document
+		_, err = applyMergePatch([]byte(doc), []byte(`{"data": }`))
+		So(err, ShouldEqual, BadInput)
+
+		// creating a patch from two documents and applying it should give the modified document back
+		modified := `{"id": "loki", "data": {"title": "king"}}`
+		patch, err := createMergePatch([]byte(doc), []byte(modified))
+		So(err, ShouldBeNil)
+
+		patched, err = applyMergePatch([]byte(doc), patch)
+		So(err, ShouldBeNil)
+		So(string(patched), ShouldEqual, `{"data":{"title":"king"},"id":"loki"}`)
+	})
+}
+
+func TestJSONPatch(t *testing.T) {
+	Convey("Test JSON patch", t, func() {
+		doc := `{"id": "loki", "data": {"titles": ["god", "king"]}}`
+
+		patch := `[
+			{"op": "test", "path": "/id", "value": "loki"},
+			{"op": "add", "path": "/data/titles/-", "value": "trickster"},
+			{"op": "remove", "path": "/data/titles/0"},
+			{"op": "replace", "path": "/id", "value": "loki-2"},
+			{"op": "copy", "from": "/data/titles", "path": "/data/aliases"},
+			{"op": "move", "from": "/data/aliases", "path": "/aliases"}
+		]`
+		patched, err := applyJSONPatch([]byte(doc), []byte(patch))
+		So(err, ShouldBeNil)
+		So(string(patched), ShouldEqual, `{"aliases":["king","trickster"],"data":{"titles":["king","trickster"]},"id":"loki-2"}`)
+
+		// a failing test operation must cancel the patch
+		_, err = applyJSONPatch([]byte(doc), []byte(`[{"op": "test", "path": "/id", "value": "thor"}]`))
+		So(err, ShouldEqual, BadInput)
+
+		// removing a value that does not exist must fail
+		_, err = applyJSONPatch([]byte(doc), []byte(`[{"op": "remove", "path": "/password"}]`))
 		So(err, ShouldEqual, BadInput)
 	})
 }
+
+func runTestProcessing(ctx context.Context, runner ConcurrentUserDataProcessingRunner) ([]UserDataProcessingResult, error) {
+	tasksResultsChannelSignal := make(chan chan UserDataProcessingResult)
+	defer close(tasksResultsChannelSignal)
+
+	runResultChannelSignal := make(chan chan error)
+	defer close(runResultChannelSignal)
+
+	runner.TasksResultsSignals = tasksResultsChannelSignal
+	runner.ResultSignal = runResultChannelSignal
+	runner.Run(ctx)
+
+	var results []UserDataProcessingResult
+	for result := range <-tasksResultsChannelSignal {
+		results = append(results, result)
+	}
+	return results, <-<-runResultChannelSignal
+}
+
+func TestConcurrentUserDataProcessingRunner(t *testing.T) {
+	Convey("Test processing runner", t, func() {
+		var (
+			running, maxRunning int32
+			provided            int32
+		)
+
+		provider := func(ctx context.Context, callback UserDataCallback) error {
+			for i := 0; i < 100; i++ {
+				atomic.AddInt32(&provided, 1)
+				err := callback(UserData(fmt.Sprintf(`{"id": "user-%d"}`, i)))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		processor := func(_ context.Context, data UserData) (UserData, error) {
+			current := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if current <= max || atomic.CompareAndSwapInt32(&maxRunning, max, current) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			return data, nil
+		}
+
+		// the number of routines processing user data must not exceed the number of workers
+		results, err := runTestProcessing(context.Background(), ConcurrentUserDataProcessingRunner{
+			Provider:  provider,
+			Processor: UserDataProcessorFunc(processor),
+			Workers:   3,
+			QueueSize: 5,
+		})
+		So(err, ShouldBeNil)
+		So(results, ShouldHaveLength, 100)
+		So(atomic.LoadInt32(&maxRunning), ShouldBeLessThanOrEqualTo, 3)
+
+		// canceling the context must stop the provider
+		ctx, cancel := context.WithCancel(context.Background())
+		atomic.StoreInt32(&provided, 0)
+		blockingProcessor := func(_ context.Context, data UserData) (UserData, error) {
+			cancel()
+			<-ctx.Done()
+			return data, nil
+		}
+		results, err = runTestProcessing(ctx, ConcurrentUserDataProcessingRunner{
+			Provider:  provider,
+			Processor: UserDataProcessorFunc(blockingProcessor),
+			Workers:   1,
+			QueueSize: 1,
+		})
+		So(err, ShouldEqual, context.Canceled)
+		So(atomic.LoadInt32(&provided), ShouldBeLessThan, 100)
+		So(len(results), ShouldBeLessThan, 100)
+	})
+}
+
+func TestParseUserQuery(t *testing.T) {
+	Convey("Test parsing of filter, sort and fields expressions", t, func() {
+		clauses, err := ParseFilter(`id^=user-,profile.city=="Paris, France",profile.age==30,active==true,nick==bob`)
+		So(err, ShouldBeNil)
+		So(clauses, ShouldResemble, []FilterClause{
+			{Path: "id", Operator: FilterPrefix, Value: "user-"},
+			{Path: "profile.city", Operator: FilterEquals, Value: "Paris, France"},
+			{Path: "profile.age", Operator: FilterEquals, Value: float64(30)},
+			{Path: "active", Operator: FilterEquals, Value: true},
+			{Path: "nick", Operator: FilterEquals, Value: "bob"},
+		})
+
+		for _, expression := range []string{"id", "id=user", "id==a,", `id=="a`, "password^=$2a", "$where==1"} {
+			_, err = ParseFilter(expression)
+			So(errors.Is(err, BadInput), ShouldBeTrue)
+		}
+
+		_, err = ParseFilter("id==a,b=c")
+		var queryErr *QueryError
+		So(errors.As(err, &queryErr), ShouldBeTrue)
+		So(queryErr.Param, ShouldEqual, "filter")
+		So(queryErr.Position, ShouldEqual, 7)
+
+		keys, err := ParseSort("-profile.age,id")
+		So(err, ShouldBeNil)
+		So(keys, ShouldResemble, []SortKey{{Path: "profile.age", Descending: true}, {Path: "id"}})
+
+		_, err = ParseSort("age desc")
+		So(errors.Is(err, BadInput), ShouldBeTrue)
+
+		fields, err := ParseFields("data,profile.city")
+		So(err, ShouldBeNil)
+		So(fields, ShouldResemble, []string{"data", "profile.city"})
+
+		for _, expression := range []string{"data,", "data.city"} {
+			_, err = ParseFields(expression)
+			So(errors.Is(err, BadInput), ShouldBeTrue)
+		}
+
+		for _, expression := range []string{"id,", "data", "-data.city"} {
+			_, err = ParseSort(expression)
+			So(errors.Is(err, BadInput), ShouldBeTrue)
+		}
+
+		_, err = ParseFilter("data.city==Paris")
+		So(errors.Is(err, BadInput), ShouldBeTrue)
+
+		_, err = ParseFields("_id")
+		So(errors.Is(err, BadInput), ShouldBeTrue)
+	})
+}
+
+func TestMemoryStoreQuery(t *testing.T) {
+	Convey("Test filtering, sorting and projection in the memory store", t, func() {
+		ctx := context.Background()
+		store := NewUserDataMemoryStore()
+		for _, user := range []string{
+			`{"id": "user-1", "profile": {"city": "Paris", "age": 30}}`,
+			`{"id": "user-2", "profile": {"city": "Lyon", "age": 25}}`,
+			`{"id": "user-3", "profile": {"city": "Paris", "age": 40}}`,
+			`{"id": "admin-1", "profile": {"city": "Paris", "age": 50}}`,
+		} {
+			So(store.Create(ctx, UserData(user)), ShouldBeNil)
+		}
+
+		list := func(query *UserQuery) []UserData {
+			var users []UserData
+			err := store.List(ctx, query, 0, 0, func(data UserData) error {
+				users = append(users, data)
+				return nil
+			})
+			So(err, ShouldBeNil)
+			return users
+		}
+
+		ids := func(users []UserData) []string {
+			var ids []string
+			for _, user := range users {
+				ids = append(ids, user.Id())
+			}
+			return ids
+		}
+
+		So(ids(list(nil)), ShouldResemble, []string{"admin-1", "user-1", "user-2", "user-3"})
+
+		filter, err := ParseFilter("id^=user-,profile.city==Paris")
+		So(err, ShouldBeNil)
+		So(ids(list(&UserQuery{Filter: filter})), ShouldResemble, []string{"user-1", "user-3"})
+
+		filter, err = ParseFilter("profile.age==25")
+		So(err, ShouldBeNil)
+		So(ids(list(&UserQuery{Filter: filter})), ShouldResemble, []string{"user-2"})
+
+		keys, err := ParseSort("profile.city,-profile.age")
+		So(err, ShouldBeNil)
+		So(ids(list(&UserQuery{Sort: keys})), ShouldResemble, []string{"user-2", "admin-1", "user-3", "user-1"})
+
+		users := list(&UserQuery{Fields: []string{"profile.city"}})
+		So(string(users[0]), ShouldEqual, `{"id":"admin-1","profile":{"city":"Paris"}}`)
+
+		var seekIds []string
+		filter, err = ParseFilter("profile.city==Paris")
+		So(err, ShouldBeNil)
+		err = store.Seek(ctx, &UserQuery{Filter: filter}, "user-3", SeekBackward, 5, func(data UserData) error {
+			seekIds = append(seekIds, data.Id())
+			return nil
+		})
+		So(err, ShouldBeNil)
+		So(seekIds, ShouldResemble, []string{"user-1", "admin-1"})
+
+		count, err := store.Count(ctx, &UserQuery{Filter: filter})
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, 3)
+
+		count, err = store.Count(ctx, nil)
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, 4)
+	})
+}
+
+func TestQueryArraysAndMissingFields(t *testing.T) {
+	Convey("The memory store and the mongo selector must neither match null on missing fields nor match array elements", t, func() {
+		ctx := context.Background()
+		store := NewUserDataMemoryStore()
+		for _, user := range []string{
+			`{"id": "user-1", "tags": ["x", "y"], "profile": {"nick": null}}`,
+			`{"id": "user-2", "tags": "x"}`,
+			`{"id": "user-3", "groups": [{"name": "x"}]}`,
+			`{"id": "user-4"}`,
+		} {
+			So(store.Create(ctx, UserData(user)), ShouldBeNil)
+		}
+
+		matched := func(expression string) []string {
+			filter, err := ParseFilter(expression)
+			So(err, ShouldBeNil)
+
+			var ids []string
+			err = store.List(ctx, &UserQuery{Filter: filter}, 0, 0, func(data UserData) error {
+				ids = append(ids, data.Id())
+				return nil
+			})
+			So(err, ShouldBeNil)
+			return ids
+		}
+
+		So(matched("tags==x"), ShouldResemble, []string{"user-2"})
+		So(matched("tags^=x"), ShouldResemble, []string{"user-2"})
+		So(matched("profile.nick==null"), ShouldResemble, []string{"user-1"})
+		So(matched("groups.name==x"), ShouldBeEmpty)
+		So(matched("groups.0.name==x"), ShouldBeEmpty)
+
+		filter, err := ParseFilter("profile.nick==null")
+		So(err, ShouldBeNil)
+		So((&UserQuery{Filter: filter}).selector(), ShouldResemble, bson.M{"$and": []bson.M{
+			{"profile.nick": bson.M{"$type": "null"}},
+			{"profile": bson.M{"$not": bson.M{"$type": "array"}}},
+			{"profile.nick": bson.M{"$not": bson.M{"$type": "array"}}},
+		}})
+
+		filter, err = ParseFilter("tags==x")
+		So(err, ShouldBeNil)
+		So((&UserQuery{Filter: filter}).selector(), ShouldResemble, bson.M{"$and": []bson.M{
+			{"tags": bson.M{"$eq": "x"}},
+			{"tags": bson.M{"$not": bson.M{"$type": "array"}}},
+		}})
+	})
+}
+
+func TestTokens(t *testing.T) {
+	Convey("Tokens must be signed, expire and be bound to their use", t, func() {
+		signingKey := Env.TokenSigningKey
+		defer func() {
+			Env.TokenSigningKey = signingKey
+		}()
+
+		Env.TokenSigningKey = nil
+		_, err := issueTokens(&Session{Id: "session", User: "user"})
+		So(err, ShouldEqual, Internal)
+
+		Env.TokenSigningKey = []byte("signing-key")
+		tokens, err := issueTokens(&Session{Id: "session", User: "user"})
+		So(err, ShouldBeNil)
+		So(tokens.TokenType, ShouldEqual, "Bearer")
+		So(tokens.ExpiresIn, ShouldEqual, int(DefaultAccessTokenTTL.Seconds()))
+
+		claims, err := parseToken(tokens.AccessToken, tokenUseAccess)
+		So(err, ShouldBeNil)
+		So(claims.Subject, ShouldEqual, "user")
+		So(claims.SessionId, ShouldEqual, "session")
+
+		_, err = parseToken(tokens.AccessToken, tokenUseRefresh)
+		So(err, ShouldEqual, NotAuthorized)
+
+		_, err = parseToken(tokens.RefreshToken, tokenUseRefresh)
+		So(err, ShouldBeNil)
+
+		_, err = parseToken(tokens.AccessToken+"x", tokenUseAccess)
+		So(err, ShouldEqual, NotAuthorized)
+
+		_, err = parseToken("a.b", tokenUseAccess)
+		So(err, ShouldEqual, NotAuthorized)
+
+		expired, err := signToken(&tokenClaims{Subject: "user", SessionId: "session", Use: tokenUseAccess, ExpiresAt: time.Now().Add(-time.Second).Unix()})
+		So(err, ShouldBeNil)
+		_, err = parseToken(expired, tokenUseAccess)
+		So(err, ShouldEqual, NotAuthorized)
+
+		Env.TokenSigningKey = []byte("other-key")
+		_, err = parseToken(tokens.AccessToken, tokenUseAccess)
+		So(err, ShouldEqual, NotAuthorized)
+	})
+}
+
+func TestLoginThrottle(t *testing.T) {
+	Convey("Lockouts must grow exponentially and failures must be forgotten after the window", t, func() {
+		policy := &LoginThrottlePolicy{BaseLockout: time.Second, MaxLockout: 10 * time.Second}
+		So(policy.lockoutDuration(2, 3), ShouldEqual, 0)
+		So(policy.lockoutDuration(3, 3), ShouldEqual, time.Second)
+		So(policy.lockoutDuration(4, 3), ShouldEqual, 2*time.Second)
+		So(policy.lockoutDuration(6, 3), ShouldEqual, 8*time.Second)
+		So(policy.lockoutDuration(100, 3), ShouldEqual, 10*time.Second)
+		So(policy.lockoutDuration(100, 0), ShouldEqual, 0)
+
+		uncapped := &LoginThrottlePolicy{BaseLockout: time.Second}
+		So(uncapped.lockoutDuration(3, 3), ShouldEqual, time.Second)
+		So(uncapped.lockoutDuration(6, 3), ShouldEqual, 8*time.Second)
+		So(uncapped.lockoutDuration(1000, 3), ShouldBeGreaterThan, 100*365*24*time.Hour)
+
+		ctx := context.Background()
+		store := NewLoginThrottleMemoryStore()
+		_, err := store.Get(ctx, "key")
+		So(err, ShouldEqual, NotFound)
+
+		now := time.Now()
+		failures, err := store.AddFailure(ctx, "key", now, time.Minute)
+		So(err, ShouldBeNil)
+		So(failures.Count, ShouldEqual, 1)
+
+		failures, err = store.AddFailure(ctx, "key", now.Add(time.Second), time.Minute)
+		So(err, ShouldBeNil)
+		So(failures.Count, ShouldEqual, 2)
+
+		failures, err = store.AddFailure(ctx, "key", now.Add(2*time.Minute), time.Minute)
+		So(err, ShouldBeNil)
+		So(failures.Count, ShouldEqual, 1)
+
+		So(store.Lock(ctx, "key", now.Add(time.Hour)), ShouldBeNil)
+		failures, err = store.Get(ctx, "key")
+		So(err, ShouldBeNil)
+		So(failures.LockedUntil, ShouldEqual, now.Add(time.Hour))
+
+		So(store.Reset(ctx, "key"), ShouldBeNil)
+		_, err = store.Get(ctx, "key")
+		So(err, ShouldEqual, NotFound)
+	})
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	Convey("Passwords must be checked against the length, the character classes and the breached list", t, func() {
+		policy := &PasswordPolicy{MinLength: 8, MinCharacterClasses: 3, Breached: map[string]bool{"Passw0rd!": true}}
+		So(policy.Check("Ab1!"), ShouldHaveSameTypeAs, &PasswordPolicyError{})
+		So(errors.Is(policy.Check("abcdefgh1"), BadInput), ShouldBeTrue)
+		So(policy.Check("abcdefGH1"), ShouldBeNil)
+		So(policy.Check("àbcdéfgh-1"), ShouldBeNil)
+		So(policy.Check("Passw0rd!"), ShouldNotBeNil)
+
+		So(DefaultPasswordPolicy.Check(""), ShouldNotBeNil)
+		So(DefaultPasswordPolicy.Check("a"), ShouldBeNil)
+
+		filename := filepath.Join(t.TempDir(), "breached.txt")
+		So(ioutil.WriteFile(filename, []byte("123456\r\nqwerty\n\nletmein\n"), 0600), ShouldBeNil)
+		breached, err := LoadBreachedPasswords(filename)
+		So(err, ShouldBeNil)
+		So(breached, ShouldResemble, map[string]bool{"123456": true, "qwerty": true, "letmein": true})
+	})
+}
+
+func TestPasswordHashing(t *testing.T) {
+	Convey("Hashes of any known algorithm must be verified and flagged for upgrade when the configuration changed", t, func() {
+		bcryptHashing := &PasswordHashing{Algorithm: PasswordHashBcrypt, BcryptCost: 4}
+		argon2Hashing := &PasswordHashing{Algorithm: PasswordHashArgon2id, Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1}
+
+		bcryptHash, err := bcryptHashing.Hash("secret")
+		So(err, ShouldBeNil)
+		argon2Hash, err := argon2Hashing.Hash("secret")
+		So(err, ShouldBeNil)
+		So(argon2Hash, ShouldStartWith, "$argon2id$v=19$m=1024,t=1,p=1$")
+
+		ok, upgrade, err := bcryptHashing.Verify(bcryptHash, "secret")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+		So(upgrade, ShouldBeFalse)
+
+		ok, upgrade, err = argon2Hashing.Verify(argon2Hash, "secret")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+		So(upgrade, ShouldBeFalse)
+
+		ok, upgrade, err = argon2Hashing.Verify(bcryptHash, "secret")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+		So(upgrade, ShouldBeTrue)
+
+		ok, upgrade, err = bcryptHashing.Verify(argon2Hash, "secret")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+		So(upgrade, ShouldBeTrue)
+
+		stronger := *argon2Hashing
+		stronger.Argon2Time = 2
+		_, upgrade, _ = stronger.Verify(argon2Hash, "secret")
+		So(upgrade, ShouldBeTrue)
+
+		ok, _, err = argon2Hashing.Verify(argon2Hash, "other")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+
+		ok, _, err = argon2Hashing.Verify(bcryptHash, "other")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+
+		_, _, err = argon2Hashing.Verify("$argon2id$malformed", "secret")
+		So(err, ShouldNotBeNil)
+
+		_, err = (&PasswordHashing{Algorithm: "md5"}).Hash("secret")
+		So(err, ShouldNotBeNil)
+		So(PasswordHashAlgorithm("md5").Valid(), ShouldBeFalse)
+	})
+}
+
+func TestDummyPasswordHash(t *testing.T) {
+	Convey("The hash verified for the unknown logins must be computed once with the configured hashing", t, func() {
+		hashing := Env.PasswordHashing
+		defer func() {
+			Env.PasswordHashing = hashing
+		}()
+
+		Env.PasswordHashing = &PasswordHashing{Algorithm: PasswordHashArgon2id, Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1}
+		argon2Hash, err := dummyPasswordHash()
+		So(err, ShouldBeNil)
+		So(argon2Hash, ShouldStartWith, "$argon2id$v=19$m=1024,t=1,p=1$")
+
+		hash, err := dummyPasswordHash()
+		So(err, ShouldBeNil)
+		So(hash, ShouldEqual, argon2Hash)
+
+		Env.PasswordHashing = &PasswordHashing{Algorithm: PasswordHashBcrypt, BcryptCost: 5}
+		bcryptHash, err := dummyPasswordHash()
+		So(err, ShouldBeNil)
+		cost, err := bcrypt.Cost([]byte(bcryptHash))
+		So(err, ShouldBeNil)
+		So(cost, ShouldEqual, 5)
+	})
+}
+
+func TestPasswordHashingValidate(t *testing.T) {
+	Convey("The password hashing parameters that cannot compute hashes must be rejected", t, func() {
+		So(DefaultPasswordHashing.Validate(), ShouldBeNil)
+
+		argon2Hashing := DefaultPasswordHashing
+		argon2Hashing.Algorithm = PasswordHashArgon2id
+		So(argon2Hashing.Validate(), ShouldBeNil)
+
+		for _, update := range []func(h *PasswordHashing){
+			func(h *PasswordHashing) { h.Argon2Time = 0 },
+			func(h *PasswordHashing) { h.Argon2Memory = 0 },
+			func(h *PasswordHashing) { h.Argon2Threads = 0 },
+		} {
+			hashing := argon2Hashing
+			update(&hashing)
+			So(hashing.Validate(), ShouldNotBeNil)
+
+			err := Serve(context.Background(), &Config{PasswordHashing: &hashing})
+			So(err, ShouldNotBeNil)
+		}
+
+		for _, cost := range []int{0, 3, 32} {
+			hashing := DefaultPasswordHashing
+			hashing.BcryptCost = cost
+			So(hashing.Validate(), ShouldNotBeNil)
+		}
+
+		So((&PasswordHashing{Algorithm: "md5"}).Validate(), ShouldNotBeNil)
+	})
+}
+
+func TestErrors(t *testing.T) {
+	Convey("Errors must map to the status of their kind even when wrapped and carry their details", t, func() {
+		So(BadInput.Error(), ShouldEqual, "bad input")
+		So(statusFromError(BadInput), ShouldEqual, http.StatusBadRequest)
+		So(statusFromError(fmt.Errorf("loading: %w", NotFound)), ShouldEqual, http.StatusNotFound)
+		So(statusFromError(errors.New("disk failure")), ShouldEqual, http.StatusInternalServerError)
+
+		err := newError(Conflict, "user 'loki' already exists", &ErrorDetails{Field: "id"})
+		So(errors.Is(err, Conflict), ShouldBeTrue)
+		So(errors.Is(err, NotFound), ShouldBeFalse)
+		So(errors.Is(fmt.Errorf("adding: %w", err), Conflict), ShouldBeTrue)
+		So(statusFromError(fmt.Errorf("adding: %w", err)), ShouldEqual, http.StatusConflict)
+		So(errorDetails(fmt.Errorf("adding: %w", err)).Field, ShouldEqual, "id")
+		So(errors.Is(newError(err, "derived", nil), Conflict), ShouldBeTrue)
+
+		var apiErr *Error
+		So(errors.As(fmt.Errorf("adding: %w", err), &apiErr), ShouldBeTrue)
+		So(apiErr.Code, ShouldEqual, ErrorCode("conflict"))
+
+		parseErr := &ParseError{Index: 3, Line: 4, Message: "unexpected end"}
+		So(statusFromError(parseErr), ShouldEqual, http.StatusBadRequest)
+		So(*errorDetails(parseErr).Index, ShouldEqual, 3)
+		So(errorDetails(parseErr).Line, ShouldEqual, 4)
+
+		So(errorDetails(&QueryError{Param: "filter", Position: 2}).Field, ShouldEqual, "filter")
+		So(errorDetails(&PasswordPolicyError{}).Field, ShouldEqual, "password")
+		So(statusFromError(&LockoutError{Until: time.Now()}), ShouldEqual, http.StatusTooManyRequests)
+		So(errorDetails(NotFound), ShouldBeNil)
+	})
+}
+
+func TestLogger(t *testing.T) {
+	Convey("Loggers must filter the records by level and encode them with their fields", t, func() {
+		level, err := ParseLogLevel("WARN")
+		So(err, ShouldBeNil)
+		So(level, ShouldEqual, LogLevelWarn)
+		_, err = ParseLogLevel("verbose")
+		So(err, ShouldNotBeNil)
+
+		buf := &bytes.Buffer{}
+		logger := NewLogger(buf, LogLevelInfo, LogFormatLogfmt).With("component", "test")
+		logger.Debug("hidden")
+		So(buf.Len(), ShouldEqual, 0)
+
+		ctx := ContextWithRequestId(context.Background(), "request-1")
+		logger.WithContext(ctx).Info("user added", "user", "loki", "error", errors.New("bad input: id taken"), "duration", time.Second)
+		line := buf.String()
+		So(line, ShouldStartWith, "time=")
+		So(line, ShouldContainSubstring, ` level=info msg="user added" component=test request_id=request-1 user=loki error="bad input: id taken" duration=1s`)
+		So(line, ShouldEndWith, "\n")
+
+		buf.Reset()
+		logger = NewLogger(buf, LogLevelDebug, LogFormatJSON)
+		logger.With("job", "42").Error("import failed", "count", 3, "odd")
+		var record map[string]interface{}
+		So(json.Unmarshal(buf.Bytes(), &record), ShouldBeNil)
+		So(record["level"], ShouldEqual, "error")
+		So(record["msg"], ShouldEqual, "import failed")
+		So(record["job"], ShouldEqual, "42")
+		So(record["count"], ShouldEqual, 3)
+		So(record["odd"], ShouldEqual, "")
+
+		var discarding *Logger
+		So(func() { discarding.With("a", 1).WithContext(ctx).Error("nothing") }, ShouldNotPanic)
+	})
+}
+
+func TestMetricsRegistry(t *testing.T) {
+	Convey("Metrics registries must write their families in the Prometheus text format", t, func() {
+		registry := NewMetricsRegistry()
+		requests := registry.NewCounter("test_requests_total", "Number of requests.", "route", "code")
+		depth := registry.NewGauge("test_queue_depth", "Queue depth.")
+		durations := registry.NewHistogram("test_duration_seconds", "Durations.", []float64{0.1, 1}, "op")
+
+		requests.Inc("Login", "200")
+		requests.Add(2, "Login", "200")
+		requests.Add(-1, "Login", "200")
+		requests.Inc(`a"b\c`, "500")
+		So(requests.Value("Login", "200"), ShouldEqual, 3)
+		So(func() { requests.Inc("Login") }, ShouldPanic)
+
+		durations.Observe(0.05, "Get")
+		durations.Observe(0.5, "Get")
+		durations.Observe(3, "Get")
+		So(durations.Count("Get"), ShouldEqual, 3)
+		So(durations.Count("Save"), ShouldEqual, 0)
+
+		buf := &bytes.Buffer{}
+		So(registry.WriteText(buf), ShouldBeNil)
+		So(buf.String(), ShouldEqual, `# HELP test_requests_total Number of requests.
+# TYPE test_requests_total counter
+test_requests_total{route="Login",code="200"} 3
+test_requests_total{route="a\"b\\c",code="500"} 1
+# HELP test_queue_depth Queue depth.
+# TYPE test_queue_depth gauge
+test_queue_depth 0
+# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{op="Get",le="0.1"} 1
+test_duration_seconds_bucket{op="Get",le="1"} 2
+test_duration_seconds_bucket{op="Get",le="+Inf"} 3
+test_duration_seconds_sum{op="Get"} 3.55
+test_duration_seconds_count{op="Get"} 3
+`)
+
+		depth.Add(2)
+		depth.Add(-1)
+		So(depth.Value(), ShouldEqual, 1)
+		depth.Set(5)
+		So(depth.Value(), ShouldEqual, 5)
+	})
+}
@@ -1,16 +1,59 @@
 package ditt
 
 import (
+	"os"
+	"time"
+
 	"github.com/gorilla/sessions"
 )
 
 var Env = struct {
-	DataStore     UserDataStore
-	Files         Files
-	AdminPassword string
-	CookiesStore  sessions.Store
+	DataStore       UserDataStore
+	Files           Files
+	CookiesStore    sessions.Store
+	SpoolDir        string
+	RunnerWorkers   int
+	RunnerQueueSize int
+
+	// SelfRegistration allows unauthenticated callers to add a single user
+	SelfRegistration bool
+
+	// SessionIdleTimeout is the inactivity duration after which a session is revoked. Zero disables it
+	SessionIdleTimeout time.Duration
+
+	// SessionMaxAge is the duration after which a session is revoked whatever its activity. Zero disables it
+	SessionMaxAge time.Duration
+
+	// TokenSigningKey is the HMAC key of the access and refresh tokens
+	TokenSigningKey []byte
+
+	// AccessTokenTTL is the lifetime of the access tokens. DefaultAccessTokenTTL applies if it is not set
+	AccessTokenTTL time.Duration
+
+	// RefreshTokenTTL is the lifetime of the refresh tokens. DefaultRefreshTokenTTL applies if it is not set
+	RefreshTokenTTL time.Duration
+
+	// LoginThrottle holds the login failure counters
+	LoginThrottle LoginThrottleStore
+
+	// LoginThrottlePolicy tells when logins get locked. DefaultLoginThrottlePolicy applies if it is not set
+	LoginThrottlePolicy *LoginThrottlePolicy
+
+	// PasswordPolicy tells which user passwords are accepted. DefaultPasswordPolicy applies if it is not set
+	PasswordPolicy *PasswordPolicy
+
+	// PasswordHashing tells how the passwords are hashed. DefaultPasswordHashing applies if it is not set
+	PasswordHashing *PasswordHashing
+
+	// SensitiveFields are the paths of the fields removed from the users that are read. DefaultSensitiveFields applies if it is not set
+	SensitiveFields []string
+
+	// Logger writes the logs of the HTTP layer and of the functions that are not given a logger
+	Logger *Logger
 }{
-	DataStore:    NewUserDataMemoryStore(),
-	Files:        NewMemoryFiles(),
-	CookiesStore: sessions.NewCookieStore(),
+	DataStore:     NewUserDataMemoryStore(),
+	Files:         NewMemoryFiles(),
+	CookiesStore:  sessions.NewCookieStore(),
+	LoginThrottle: NewLoginThrottleMemoryStore(),
+	Logger:        NewLogger(os.Stderr, LogLevelInfo, LogFormatLogfmt),
 }
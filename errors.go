@@ -4,30 +4,150 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strconv"
+	"time"
 )
 
+// ErrorCode identifies a kind of error in the HTTP error responses
+type ErrorCode string
+
+// Error is an API error. The exported values below are the kinds of errors. The errors created from a kind hold their own
+// message and details and match their kind with errors.Is
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Details *ErrorDetails
+
+	status int
+	kind   *Error
+}
+
+// ErrorDetails tells which part of the input an error is about
+type ErrorDetails struct {
+	// Field is the path of the field or the name of the parameter the error is about
+	Field string `json:"field,omitempty"`
+
+	// Index is the index of the record the error is about
+	Index *int `json:"index,omitempty"`
+
+	// Line is the line of the error for line based formats
+	Line int `json:"line,omitempty"`
+
+	// Position is the position in bytes of the error in the stream or in the expression
+	Position *int64 `json:"position,omitempty"`
+}
+
+func newErrorKind(code ErrorCode, message string, status int) *Error {
+	return &Error{Code: code, Message: message, status: status}
+}
+
 var (
-	BadInput               = errors.New("bad input")
-	AuthenticationRequired = errors.New("authentication required")
-	Forbidden              = errors.New("forbidden")
-	NotAuthorized          = errors.New("not authorized")
-	NotFound               = errors.New("not found")
-	Internal               = errors.New("internal")
+	BadInput               = newErrorKind("bad_input", "bad input", http.StatusBadRequest)
+	AuthenticationRequired = newErrorKind("authentication_required", "authentication required", http.StatusForbidden)
+	Forbidden              = newErrorKind("forbidden", "forbidden", http.StatusForbidden)
+	NotAuthorized          = newErrorKind("not_authorized", "not authorized", http.StatusUnauthorized)
+	NotFound               = newErrorKind("not_found", "not found", http.StatusNotFound)
+	MethodNotAllowed       = newErrorKind("method_not_allowed", "method not allowed", http.StatusMethodNotAllowed)
+	Conflict               = newErrorKind("conflict", "conflict", http.StatusConflict)
+	UnsupportedFormat      = newErrorKind("unsupported_format", "unsupported format", http.StatusUnsupportedMediaType)
+	TooManyAttempts        = newErrorKind("too_many_attempts", "too many attempts", http.StatusTooManyRequests)
+	Internal               = newErrorKind("internal", "internal", http.StatusInternalServerError)
 )
 
+// errorKinds are matched in order against the errors to find their kind
+var errorKinds = []*Error{
+	BadInput,
+	AuthenticationRequired,
+	Forbidden,
+	NotAuthorized,
+	NotFound,
+	MethodNotAllowed,
+	Conflict,
+	UnsupportedFormat,
+	TooManyAttempts,
+	Internal,
+}
+
+// newError creates an error of the same kind as "kind" with its own message and details
+func newError(kind *Error, message string, details *ErrorDetails) *Error {
+	return &Error{
+		Code:    kind.Code,
+		Message: message,
+		Details: details,
+		status:  kind.status,
+		kind:    kind.root(),
+	}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) root() *Error {
+	if e.kind != nil {
+		return e.kind
+	}
+	return e
+}
+
+// Is makes an Error match its kind
+func (e *Error) Is(target error) bool {
+	kind, ok := target.(*Error)
+	return ok && e.root() == kind
+}
+
+// ErrorDetails returns the details of the error. It is nil if there are none
+func (e *Error) ErrorDetails() *ErrorDetails {
+	return e.Details
+}
+
+// errorKind returns the kind "err" matches, Internal if it matches none
+func errorKind(err error) *Error {
+	for _, kind := range errorKinds {
+		if errors.Is(err, kind) {
+			return kind
+		}
+	}
+	return Internal
+}
+
+// errorDetails returns the details held by "err" or by the first error it wraps that can hold some
+func errorDetails(err error) *ErrorDetails {
+	var detailed interface {
+		ErrorDetails() *ErrorDetails
+	}
+	if errors.As(err, &detailed) {
+		return detailed.ErrorDetails()
+	}
+	return nil
+}
+
 func statusFromError(err error) int {
-	switch err {
-	case BadInput:
-		return http.StatusBadRequest
-	case AuthenticationRequired, Forbidden:
-		return http.StatusForbidden
-	case NotAuthorized:
-		return http.StatusUnauthorized
-	case NotFound:
-		return http.StatusNotFound
-	default:
-		return http.StatusInternalServerError
+	return errorKind(err).status
+}
+
+// ErrorResponse is the body of the HTTP error responses
+type ErrorResponse struct {
+	Code      ErrorCode     `json:"code"`
+	Message   string        `json:"message"`
+	RequestId string        `json:"request_id,omitempty"`
+	Details   *ErrorDetails `json:"details,omitempty"`
+}
+
+// newErrorResponse describes the error. The messages of the internal errors are not exposed
+func newErrorResponse(r *http.Request, err error) *ErrorResponse {
+	kind := errorKind(err)
+	response := &ErrorResponse{
+		Code:      kind.Code,
+		Message:   err.Error(),
+		RequestId: GetRequestId(r.Context()),
+		Details:   errorDetails(err),
+	}
+	if kind == Internal {
+		response.Message = Internal.Message
+		response.Details = nil
 	}
+	return response
 }
 
 /*func writeHttpDataResponse(w http.ResponseWriter, reader io.Reader) {
@@ -45,10 +165,19 @@ func writeHttpObjectResponse(w http.ResponseWriter, data interface{}) {
 	_ = json.NewEncoder(w).Encode(data)
 } */
 
-func writeHttpErrorResponseWithMessage(w http.ResponseWriter, err error, message string) {
-	w.WriteHeader(statusFromError(err))
-	w.Header().Add("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string]interface{}{
-		"message": message,
-	})
+// writeHttpError writes the ErrorResponse of the error with the status of its kind. The "Retry-After" header is set for a LockoutError
+func writeHttpError(w http.ResponseWriter, r *http.Request, err error) {
+	status := statusFromError(err)
+	if status == http.StatusInternalServerError {
+		Env.Logger.WithContext(r.Context()).Error("request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+	}
+
+	var lockout *LockoutError
+	if errors.As(err, &lockout) {
+		w.Header().Set("Retry-After", strconv.Itoa(lockout.RetryAfter(time.Now())))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(newErrorResponse(r, err))
 }
@@ -2,6 +2,8 @@ package ditt
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"github.com/spf13/afero"
 	"io"
 	"io/ioutil"
@@ -11,24 +13,27 @@ import (
 
 // Files is a convenience for UserData file persistence
 type Files interface {
-	Save(userId string, data string) error
-	Delete(userId string) error
-	Get(userId string) (string, error)
+	Save(ctx context.Context, userId string, data string) error
+	Delete(ctx context.Context, userId string) error
+	Get(ctx context.Context, userId string) (string, error)
+
+	// HealthCheck fails if the files cannot be reached
+	HealthCheck(ctx context.Context) error
 }
 
 type memoryFiles struct {
 	fs afero.Fs
 }
 
-func (m *memoryFiles) Save(userId string, data string) error {
+func (m *memoryFiles) Save(_ context.Context, userId string, data string) error {
 	return afero.WriteFile(m.fs, userId, []byte(data), os.ModePerm)
 }
 
-func (m *memoryFiles) Delete(id string) error {
+func (m *memoryFiles) Delete(_ context.Context, id string) error {
 	return m.fs.Remove(id)
 }
 
-func (m *memoryFiles) Get(userId string) (string, error) {
+func (m *memoryFiles) Get(_ context.Context, userId string) (string, error) {
 	file, err := m.fs.Open(userId)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -45,6 +50,10 @@ func (m *memoryFiles) Get(userId string) (string, error) {
 	return string(data), err
 }
 
+func (m *memoryFiles) HealthCheck(ctx context.Context) error {
+	return ctx.Err()
+}
+
 func NewMemoryFiles() Files {
 	return &memoryFiles{
 		fs: afero.NewMemMapFs(),
@@ -55,7 +64,11 @@ type dirFiles struct {
 	rootDir string
 }
 
-func (d *dirFiles) Save(userId string, data string) error {
+func (d *dirFiles) Save(ctx context.Context, userId string, data string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	filename := filepath.Join(d.rootDir, userId)
 
 	file, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.ModePerm)
@@ -70,12 +83,20 @@ func (d *dirFiles) Save(userId string, data string) error {
 	return err
 }
 
-func (d *dirFiles) Delete(userId string) error {
+func (d *dirFiles) Delete(ctx context.Context, userId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	filename := filepath.Join(d.rootDir, userId)
 	return os.Remove(filename)
 }
 
-func (d *dirFiles) Get(userId string) (string, error) {
+func (d *dirFiles) Get(ctx context.Context, userId string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
 	filename := filepath.Join(d.rootDir, userId)
 	file, err := os.Open(filename)
 	if err != nil {
@@ -98,6 +119,22 @@ func (d *dirFiles) Get(userId string) (string, error) {
 	return string(data), err
 }
 
+// HealthCheck fails if the root directory does not exist or is not a directory
+func (d *dirFiles) HealthCheck(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stats, err := os.Stat(d.rootDir)
+	if err != nil {
+		return err
+	}
+	if !stats.IsDir() {
+		return fmt.Errorf("%s is not a directory", d.rootDir)
+	}
+	return nil
+}
+
 func NewDirFiles(rootDir string) Files {
 	return &dirFiles{rootDir: rootDir}
 }
@@ -1,7 +1,11 @@
 package ditt
 
 import (
+	"context"
 	"github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -18,3 +22,23 @@ func TestFiles_Delete(t *testing.T) {
 func TestFiles_Get(t *testing.T) {
 	convey.Convey("", t, func() {})
 }
+
+func TestFiles_HealthCheck(t *testing.T) {
+	convey.Convey("Files health checks must fail when the root directory is missing", t, func() {
+		ctx := context.Background()
+		convey.So(NewMemoryFiles().HealthCheck(ctx), convey.ShouldBeNil)
+
+		dir, err := ioutil.TempDir("", "ditt-files")
+		convey.So(err, convey.ShouldBeNil)
+		defer func() {
+			_ = os.RemoveAll(dir)
+		}()
+
+		convey.So(NewDirFiles(dir).HealthCheck(ctx), convey.ShouldBeNil)
+		convey.So(NewDirFiles(filepath.Join(dir, "missing")).HealthCheck(ctx), convey.ShouldNotBeNil)
+
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		convey.So(NewDirFiles(dir).HealthCheck(canceled), convey.ShouldNotBeNil)
+	})
+}
@@ -13,5 +13,6 @@ require (
 	github.com/tidwall/gjson v1.8.1
 	github.com/tidwall/sjson v1.1.7
 	golang.org/x/crypto v0.0.0-20210616213533-5ff15b29337e
+	golang.org/x/sys v0.10.0 // indirect
 	golang.org/x/text v0.3.6 // indirect
 )
@@ -2,38 +2,57 @@ package ditt
 
 import (
 	"context"
+	"io"
 )
 
 type handlerACL struct {
 	BaseHandler
 }
 
-func (h *handlerACL) assertIsAdmin(ctx context.Context) error {
-	loggedUser := GetLoggedUser(ctx)
-	if loggedUser != "admin" {
+func (h *handlerACL) assertIsAuthenticated(ctx context.Context) error {
+	if GetLoggedUser(ctx) == "" {
 		return Forbidden
 	}
 	return nil
 }
 
-func (h *handlerACL) assertIsAuthenticated(ctx context.Context) error {
-	if GetLoggedUser(ctx) == "" {
+// assertHasPermission checks that the logged user roles grant the permission
+func (h *handlerACL) assertHasPermission(ctx context.Context, permission Permission) error {
+	err := h.assertIsAuthenticated(ctx)
+	if err != nil {
+		return err
+	}
+
+	granted, err := loggedUserHasPermission(ctx, permission)
+	if err != nil {
+		return err
+	}
+
+	if !granted {
 		return Forbidden
 	}
 	return nil
 }
 
-func (h *handlerACL) assertHasAccess(ctx context.Context, userId string) error {
+// assertHasAccess checks that the logged user is granted "allPermission", or "selfPermission" if userId is the logged user
+func (h *handlerACL) assertHasAccess(ctx context.Context, userId string, selfPermission Permission, allPermission Permission) error {
 	loggedUser := GetLoggedUser(ctx)
 	if loggedUser == "" {
 		return Forbidden
 	}
 
-	if loggedUser != userId && loggedUser != "admin" {
-		return NotAuthorized
+	granted, err := loggedUserHasPermission(ctx, allPermission)
+	if err != nil || granted {
+		return err
 	}
 
-	return nil
+	if loggedUser == userId {
+		granted, err = loggedUserHasPermission(ctx, selfPermission)
+		if err != nil || granted {
+			return err
+		}
+	}
+	return NotAuthorized
 }
 
 func (h *handlerACL) Login(ctx context.Context, login string, password string) (bool, error) {
@@ -43,16 +62,30 @@ func (h *handlerACL) Login(ctx context.Context, login string, password string) (
 	return h.BaseHandler.Login(ctx, login, password)
 }
 
-/* func (h *handlerACL) AddUsers(ctx context.Context, reader io.Reader) error {
-	err := h.assertIsAdmin(ctx)
+func (h *handlerACL) Logout(ctx context.Context) error {
+	err := h.assertIsAuthenticated(ctx)
 	if err != nil {
 		return err
 	}
-	return h.BaseHandler.AddUsers(ctx, reader)
-} */
+	return h.BaseHandler.Logout(ctx)
+}
+
+func (h *handlerACL) AddUsers(ctx context.Context, reader io.Reader, opts AddUsersOptions) (*AddUsersReport, error) {
+	err := h.assertHasPermission(ctx, PermissionCreateUsers)
+	if err != nil {
+		// Self registration lets anonymous callers create their own user only
+		if !Env.SelfRegistration || GetLoggedUser(ctx) != "" {
+			return nil, err
+		}
+		opts.OnConflict = ConflictPolicyFail
+		opts.MaxUsers = 1
+	}
+
+	return h.BaseHandler.AddUsers(ctx, reader, opts)
+}
 
 func (h *handlerACL) DeleteUser(ctx context.Context, userId string) error {
-	err := h.assertHasAccess(ctx, userId)
+	err := h.assertHasAccess(ctx, userId, PermissionDeleteSelf, PermissionDeleteAll)
 	if err != nil {
 		return err
 	}
@@ -60,13 +93,20 @@ func (h *handlerACL) DeleteUser(ctx context.Context, userId string) error {
 	return h.BaseHandler.DeleteUser(ctx, userId)
 }
 
-func (h *handlerACL) GetUser(ctx context.Context, userId string) (UserData, error) {
-	err := h.assertHasAccess(ctx, userId)
+func (h *handlerACL) GetUser(ctx context.Context, userId string, opts GetUserOptions) (UserData, error) {
+	err := h.assertHasAccess(ctx, userId, PermissionReadSelf, PermissionReadAll)
 	if err != nil {
 		return "", err
 	}
 
-	return h.BaseHandler.GetUser(ctx, userId)
+	if opts.IncludeSecrets {
+		err = h.assertHasPermission(ctx, PermissionReadSecrets)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return h.BaseHandler.GetUser(ctx, userId, opts)
 }
 
 func (h *handlerACL) GetUserList(ctx context.Context, opts ListOptions) (*UserDataList, error) {
@@ -75,14 +115,174 @@ func (h *handlerACL) GetUserList(ctx context.Context, opts ListOptions) (*UserDa
 		return nil, err
 	}
 
+	// Reading all the users implies reading one's own
+	granted, err := loggedUserHasPermission(ctx, PermissionReadSelf)
+	if err != nil {
+		return nil, err
+	}
+
+	if !granted {
+		return nil, Forbidden
+	}
+
+	if opts.IncludeSecrets {
+		err = h.assertHasPermission(ctx, PermissionReadSecrets)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	granted, err = loggedUserHasPermission(ctx, PermissionReadSecrets)
+	if err != nil {
+		return nil, err
+	}
+
+	if !granted {
+		err = assertQueryHidesSecrets(opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return h.BaseHandler.GetUserList(ctx, opts)
 }
 
-func (h *handlerACL) UpdateUser(ctx context.Context, userId string, userData UserData) error {
-	err := h.assertHasAccess(ctx, userId)
+func (h *handlerACL) UpdateUser(ctx context.Context, userId string, userData UserData, opts UpdateUserOptions) error {
+	err := h.assertHasAccess(ctx, userId, PermissionUpdateSelf, PermissionUpdateAll)
+	if err != nil {
+		return err
+	}
+
+	return h.BaseHandler.UpdateUser(ctx, userId, userData, opts)
+}
+
+func (h *handlerACL) StartImportJob(ctx context.Context, reader io.Reader, opts AddUsersOptions) (*ImportJob, error) {
+	err := h.assertHasPermission(ctx, PermissionCreateUsers)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.BaseHandler.StartImportJob(ctx, reader, opts)
+}
+
+func (h *handlerACL) assertHasJobAccess(ctx context.Context, jobId string, selfPermission Permission, allPermission Permission) error {
+	err := h.assertIsAuthenticated(ctx)
+	if err != nil {
+		return err
+	}
+
+	job, err := Env.DataStore.GetImportJob(ctx, jobId)
+	if err != nil {
+		return err
+	}
+
+	return h.assertHasAccess(ctx, job.Owner, selfPermission, allPermission)
+}
+
+func (h *handlerACL) GetImportJob(ctx context.Context, jobId string) (*ImportJob, error) {
+	err := h.assertHasJobAccess(ctx, jobId, PermissionReadSelf, PermissionReadAll)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.BaseHandler.GetImportJob(ctx, jobId)
+}
+
+func (h *handlerACL) CancelImportJob(ctx context.Context, jobId string) error {
+	err := h.assertHasJobAccess(ctx, jobId, PermissionUpdateSelf, PermissionUpdateAll)
+	if err != nil {
+		return err
+	}
+
+	return h.BaseHandler.CancelImportJob(ctx, jobId)
+}
+
+func (h *handlerACL) ExportUsers(ctx context.Context, opts ExportOptions, callback UserDataCallback) error {
+	err := h.assertHasPermission(ctx, PermissionExport)
+	if err != nil {
+		return err
+	}
+
+	if opts.IncludeSecrets {
+		err = h.assertHasPermission(ctx, PermissionReadSecrets)
+		if err != nil {
+			return err
+		}
+	}
+
+	return h.BaseHandler.ExportUsers(ctx, opts, callback)
+}
+
+func (h *handlerACL) GetUserRoles(ctx context.Context, userId string) ([]Role, error) {
+	err := h.assertHasPermission(ctx, PermissionManageRoles)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.BaseHandler.GetUserRoles(ctx, userId)
+}
+
+func (h *handlerACL) SetUserRoles(ctx context.Context, userId string, roles []Role) error {
+	err := h.assertHasPermission(ctx, PermissionManageRoles)
+	if err != nil {
+		return err
+	}
+
+	return h.BaseHandler.SetUserRoles(ctx, userId, roles)
+}
+
+func (h *handlerACL) ListUserSessions(ctx context.Context, userId string) ([]Session, error) {
+	err := h.assertHasPermission(ctx, PermissionManageSessions)
+	if err != nil {
+		return nil, err
+	}
+	return h.BaseHandler.ListUserSessions(ctx, userId)
+}
+
+func (h *handlerACL) RevokeUserSessions(ctx context.Context, userId string) error {
+	err := h.assertHasPermission(ctx, PermissionManageSessions)
+	if err != nil {
+		return err
+	}
+	return h.BaseHandler.RevokeUserSessions(ctx, userId)
+}
+
+func (h *handlerACL) RevokeSession(ctx context.Context, userId string, sessionId string) error {
+	err := h.assertHasPermission(ctx, PermissionManageSessions)
 	if err != nil {
 		return err
 	}
+	return h.BaseHandler.RevokeSession(ctx, userId, sessionId)
+}
 
-	return h.BaseHandler.UpdateUser(ctx, userId, userData)
+func (h *handlerACL) CreateAPIKey(ctx context.Context, userId string, name string, scopes []Permission) (*APIKey, error) {
+	err := h.assertHasAccess(ctx, userId, PermissionManageSelfAPIKeys, PermissionManageAPIKeys)
+	if err != nil {
+		return nil, err
+	}
+	return h.BaseHandler.CreateAPIKey(ctx, userId, name, scopes)
+}
+
+func (h *handlerACL) ListAPIKeys(ctx context.Context, userId string) ([]APIKey, error) {
+	err := h.assertHasAccess(ctx, userId, PermissionManageSelfAPIKeys, PermissionManageAPIKeys)
+	if err != nil {
+		return nil, err
+	}
+	return h.BaseHandler.ListAPIKeys(ctx, userId)
+}
+
+func (h *handlerACL) DeleteAPIKey(ctx context.Context, userId string, keyId string) error {
+	err := h.assertHasAccess(ctx, userId, PermissionManageSelfAPIKeys, PermissionManageAPIKeys)
+	if err != nil {
+		return err
+	}
+	return h.BaseHandler.DeleteAPIKey(ctx, userId, keyId)
+}
+
+func (h *handlerACL) UnlockUser(ctx context.Context, login string) error {
+	err := h.assertHasPermission(ctx, PermissionUnlockUsers)
+	if err != nil {
+		return err
+	}
+	return h.BaseHandler.UnlockUser(ctx, login)
 }
@@ -2,34 +2,104 @@ package ditt
 
 import (
 	"context"
-	"golang.org/x/crypto/bcrypt"
+	"errors"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 	"io"
-	"log"
+	"io/ioutil"
+	"os"
+	"sort"
 	"sync"
+	"time"
 )
 
 type handlerExecution struct {
 	BaseHandler
+	logger *Logger
 }
 
 func (e *handlerExecution) Login(ctx context.Context, login string, password string) (bool, error) {
-	if login == "admin" {
-		return password == Env.AdminPassword, nil
+	err := checkLoginAllowed(ctx, login)
+	if err != nil {
+		if errors.Is(err, TooManyAttempts) {
+			metrics.logins.Inc("locked")
+		}
+		return false, err
 	}
 
-	userData, err := e.GetUser(ctx, login)
+	ok, err := e.checkCredentials(ctx, login, password)
 	if err != nil {
-		if err == NotFound {
+		return false, err
+	}
+
+	if ok {
+		metrics.logins.Inc("success")
+		err = resetLoginFailures(ctx, login)
+	} else {
+		metrics.logins.Inc("failure")
+		err = recordLoginFailure(ctx, login)
+	}
+	return ok, err
+}
+
+// checkCredentials verifies the password of the admin account or else of the user matching the login.
+// The stored hash is upgraded if it was not computed with the configured hashing
+func (e *handlerExecution) checkCredentials(ctx context.Context, login string, password string) (bool, error) {
+	ok, err := checkAdminCredentials(ctx, login, password)
+	if !errors.Is(err, NotFound) {
+		return ok, err
+	}
+
+	userData, err := Env.DataStore.Get(ctx, login)
+	if err != nil {
+		if errors.Is(err, NotFound) {
+			verifyDummyPassword(password)
 			return false, nil
 		}
 		return false, err
 	}
 
-	hashedPassword := userData.Password()
-	return err == bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)), nil
+	ok, upgrade, err := verifyPasswordValue(userData.Password(), password)
+	if err != nil {
+		e.logger.WithContext(ctx).Warn("password verification failed", "user", login, "error", err)
+		return false, nil
+	}
+
+	if ok && upgrade {
+		err = upgradeUserPasswordHash(ctx, userData, password)
+		if err != nil {
+			e.logger.WithContext(ctx).Error("password hash upgrade failed", "user", login, "error", err)
+		}
+	}
+	return ok, nil
+}
+
+func (e *handlerExecution) Logout(ctx context.Context) error {
+	sessionId := GetSessionId(ctx)
+	if sessionId == "" {
+		return nil
+	}
+
+	err := Env.DataStore.DeleteSession(ctx, sessionId)
+	if errors.Is(err, NotFound) {
+		return nil
+	}
+	return err
+}
+
+func (e *handlerExecution) AddUsers(ctx context.Context, reader io.Reader, opts AddUsersOptions) (*AddUsersReport, error) {
+	return e.addUsers(ctx, reader, opts, nil)
 }
 
-func (e *handlerExecution) AddUsers(_ context.Context, reader io.Reader) error {
+// addUsers runs the users import. If set, "progress" is called with the report after each processed user
+func (e *handlerExecution) addUsers(ctx context.Context, reader io.Reader, opts AddUsersOptions, progress func(report *AddUsersReport)) (*AddUsersReport, error) {
+	runningAddUsers.begin()
+	defer runningAddUsers.end()
+
+	providerFactory, err := getUserDataProviderFactory(opts.Format)
+	if err != nil {
+		return nil, err
+	}
 
 	tasksResultsChannelSignal := make(chan chan UserDataProcessingResult)
 	defer close(tasksResultsChannelSignal)
@@ -37,22 +107,96 @@ func (e *handlerExecution) AddUsers(_ context.Context, reader io.Reader) error {
 	runResultChannelSignal := make(chan chan error)
 	defer close(runResultChannelSignal)
 
-	processor := func(data UserData) (UserData, error) {
-		processedData, err := processData(writeProcessors, data)
+	provider := providerFactory(reader, opts)
+	if opts.MaxUsers > 0 {
+		provider = newLimitedUserDataProvider(provider, opts.MaxUsers)
+	}
+
+	// With the fail policy, the import stops at the first conflict. The run is stopped by the worker that meets it,
+	// so that no user queued after the conflict is processed by that worker
+	runCtx, stopRun := context.WithCancel(ctx)
+	defer stopRun()
+
+	processor := func(ctx context.Context, data UserData) (UserData, error) {
+		// Admin accounts cannot be shadowed by a user
+		admin, err := isAdmin(ctx, data.Id())
 		if err != nil {
 			return "", err
 		}
-		return "", Env.DataStore.Save(processedData)
+		if admin {
+			return "", BadInput
+		}
+
+		// Existing users are detected before any processing in order to leave their data file untouched
+		if opts.OnConflict != ConflictPolicyOverwrite {
+			_, err := Env.DataStore.Get(ctx, data.Id())
+			if err == nil {
+				if opts.OnConflict == ConflictPolicyFail {
+					stopRun()
+				}
+				return "", Conflict
+			}
+			if !errors.Is(err, NotFound) {
+				return "", err
+			}
+		}
+
+		if opts.OnConflict == ConflictPolicyOverwrite {
+			processedData, err := processData(ctx, writeProcessors, data)
+			if err != nil {
+				return "", err
+			}
+
+			err = Env.DataStore.Upsert(ctx, processedData)
+			if err != nil {
+				return "", err
+			}
+			// The overwritten user may have got a new password
+			return "", Env.DataStore.DeleteUserSessions(ctx, data.Id())
+		}
+
+		processedData, err := processData(ctx, createProcessors, data)
+		if err != nil {
+			return "", err
+		}
+
+		record, err := sjson.Delete(string(processedData), "data")
+		if err != nil {
+			return "", err
+		}
+
+		// A concurrent creation of the same user makes this one fail before the data file of the other is overwritten
+		err = Env.DataStore.Create(ctx, UserData(record))
+		if err != nil {
+			if errors.Is(err, Conflict) && opts.OnConflict == ConflictPolicyFail {
+				stopRun()
+			}
+			return "", err
+		}
+
+		_, err = saveDataIntoFile(ctx, processedData)
+		if err != nil {
+			if deleteErr := Env.DataStore.Delete(ctx, data.Id()); deleteErr != nil {
+				e.logger.WithContext(ctx).Error("user creation rollback failed", "user", data.Id(), "error", deleteErr)
+			}
+			return "", err
+		}
+		return "", nil
 	}
 
 	runner := ConcurrentUserDataProcessingRunner{
-		Provider:            newJsonObjectStreamParser(reader).parseUsers,
+		Provider:            provider,
 		Processor:           UserDataProcessorFunc(processor),
 		TasksResultsSignals: tasksResultsChannelSignal,
 		ResultSignal:        runResultChannelSignal,
+		Workers:             Env.RunnerWorkers,
+		QueueSize:           Env.RunnerQueueSize,
+		Logger:              e.logger,
 	}
-	runner.Run()
+	runner.Run(runCtx)
 
+	report := &AddUsersReport{}
+	metConflict := false
 	tasksResults := <-tasksResultsChannelSignal
 	for {
 		result, hasMore := <-tasksResults
@@ -60,55 +204,142 @@ func (e *handlerExecution) AddUsers(_ context.Context, reader io.Reader) error {
 			break
 		}
 
-		if result.Err != nil {
-			log.Println("data", result.UserId, ":", result.Err)
+		metrics.importRecordsProcessed.Inc()
+		if errors.Is(result.Err, Conflict) && opts.OnConflict == ConflictPolicySkip {
+			report.Skipped++
+		} else if result.Err != nil {
+			metrics.importRecordsFailed.Inc()
+			if errors.Is(result.Err, Conflict) {
+				metConflict = true
+			}
+			report.Rejected++
+			report.Failures = append(report.Failures, UserFailure{
+				Index:  result.Index,
+				UserId: result.UserId,
+				Error:  result.Err.Error(),
+			})
 		} else {
-			log.Println("data", result.UserId, ": saved")
+			report.Accepted++
+		}
+
+		if progress != nil {
+			progress(report)
 		}
 	}
 
+	// Results are published in completion order
+	sort.Slice(report.Failures, func(i, j int) bool {
+		return report.Failures[i].Index < report.Failures[j].Index
+	})
+
 	runResult := <-runResultChannelSignal
-	return <-runResult
+	err = <-runResult
+	if metConflict && (err == nil || (errors.Is(err, context.Canceled) && ctx.Err() == nil)) {
+		err = Conflict
+	}
+	return report, err
 }
 
-func (e *handlerExecution) DeleteUser(_ context.Context, userId string) error {
-	err := Env.Files.Delete(userId)
+func (e *handlerExecution) DeleteUser(ctx context.Context, userId string) error {
+	err := Env.Files.Delete(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	err = Env.DataStore.Delete(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	err = Env.DataStore.SaveRoles(ctx, userId, nil)
+	if err != nil {
+		return err
+	}
+
+	err = Env.DataStore.DeleteUserAPIKeys(ctx, userId)
 	if err != nil {
 		return err
 	}
-	return Env.DataStore.Delete(userId)
+	return Env.DataStore.DeleteUserSessions(ctx, userId)
 }
 
-func (e *handlerExecution) GetUser(_ context.Context, userId string) (UserData, error) {
-	userData, err := Env.DataStore.Get(userId)
+func (e *handlerExecution) GetUser(ctx context.Context, userId string, opts GetUserOptions) (UserData, error) {
+	userData, err := Env.DataStore.Get(ctx, userId)
 	if err != nil {
 		return "", err
 	}
 
-	return processData(readProcessors, userData)
+	return processData(ctx, withoutSecrets(readProcessors, opts.IncludeSecrets), userData)
 }
 
 func (e *handlerExecution) GetUserList(ctx context.Context, opts ListOptions) (*UserDataList, error) {
+	query, err := parseUserQuery(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor *listCursor
+	if opts.Cursor != "" {
+		cursor, err = decodeListCursor(opts.Cursor)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Users who cannot read all the users only list their own
+	readAll, err := loggedUserHasPermission(ctx, PermissionReadAll)
+	if err != nil {
+		return nil, err
+	}
+	if !readAll {
+		query.Filter = append(query.Filter, FilterClause{Path: "id", Operator: FilterEquals, Value: GetLoggedUser(ctx)})
+	}
+
 	tasksResultsChannelSignal := make(chan chan UserDataProcessingResult)
 	defer close(tasksResultsChannelSignal)
 
 	runResultChannelSignal := make(chan chan error)
 	defer close(runResultChannelSignal)
 
-	processor := func(data UserData) (UserData, error) {
-		return processData(readProcessors, data)
+	// One more user than requested is fetched to know whether a following range exists.
+	// It is not passed to the processors
+	var (
+		ids          []string
+		hasFollowing bool
+	)
+	listProvider := e.getUserDataListProviderFunc(query, opts, cursor)
+	provider := func(ctx context.Context, callback UserDataCallback) error {
+		return listProvider(ctx, func(data UserData) error {
+			if len(ids) == opts.Count {
+				hasFollowing = true
+				return nil
+			}
+			ids = append(ids, data.Id())
+			return callback(data)
+		})
+	}
+
+	// The data files are read only if the data field is part of the projection
+	processors := readProcessors
+	if !query.hasField("data") {
+		processors = nil
+	}
+	processors = withoutSecrets(processors, opts.IncludeSecrets)
+	processor := func(ctx context.Context, data UserData) (UserData, error) {
+		return processData(ctx, processors, data)
 	}
 	runner := ConcurrentUserDataProcessingRunner{
-		Provider:            e.getUserDataListProviderFunc(GetLoggedUser(ctx), opts),
+		Provider:            provider,
 		Processor:           UserDataProcessorFunc(processor),
 		TasksResultsSignals: tasksResultsChannelSignal,
 		ResultSignal:        runResultChannelSignal,
+		Workers:             Env.RunnerWorkers,
+		QueueSize:           Env.RunnerQueueSize,
+		Logger:              e.logger,
 	}
-	runner.Run()
+	runner.Run(ctx)
 
-	userDataList := &UserDataList{
-		Offset: opts.Offset,
-	}
+	var results []UserDataProcessingResult
 	tasksResults := <-tasksResultsChannelSignal
 	for {
 		result, hasMore := <-tasksResults
@@ -117,32 +348,81 @@ func (e *handlerExecution) GetUserList(ctx context.Context, opts ListOptions) (*
 		}
 
 		if result.Err != nil {
-			log.Println("data", result.UserId, ":", result.Err)
+			e.logger.WithContext(ctx).Warn("user data reading failed", "user", result.UserId, "error", result.Err)
 		} else {
-			userDataList.UserDataList = append(userDataList.UserDataList, result.Data)
+			results = append(results, result)
 		}
 	}
 
 	runResult := <-runResultChannelSignal
-	err := <-runResult
-	return userDataList, err
+	err = <-runResult
+	if err != nil {
+		return nil, err
+	}
+
+	// The workers complete in any order
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Index < results[j].Index
+	})
+
+	backward := cursor != nil && cursor.Direction == SeekBackward
+	if backward {
+		for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+			results[i], results[j] = results[j], results[i]
+		}
+		for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+			ids[i], ids[j] = ids[j], ids[i]
+		}
+	}
+
+	total, err := Env.DataStore.Count(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	userDataList := &UserDataList{
+		Offset: opts.Offset,
+		Total:  total,
+	}
+	for _, result := range results {
+		userDataList.UserDataList = append(userDataList.UserDataList, result.Data)
+	}
+	userDataList.Count = len(userDataList.UserDataList)
+
+	hasNext := hasFollowing
+	hasPrev := opts.Offset > 0 || cursor != nil
+	if backward {
+		hasNext, hasPrev = len(ids) > 0, hasFollowing
+	}
+	userDataList.HasMore = hasNext
+
+	// Cursors only reference positions in id order
+	if len(ids) > 0 && len(query.Sort) == 0 {
+		if hasNext {
+			userDataList.Next = (&listCursor{Id: ids[len(ids)-1], Direction: SeekForward}).encode()
+		}
+		if hasPrev {
+			userDataList.Prev = (&listCursor{Id: ids[0], Direction: SeekBackward}).encode()
+		}
+	}
+	return userDataList, nil
 }
 
-func (e *handlerExecution) getUserDataListProviderFunc(userId string, opts ListOptions) UserDataProvider {
-	return func(callback UserDataCallback) error {
-		var err error
-		if userId == "admin" {
-			err = Env.DataStore.List(opts.Offset, opts.Count, callback)
-		} else {
-			err = Env.DataStore.ListForUser(userId, opts.Offset, opts.Count, callback)
+func (e *handlerExecution) getUserDataListProviderFunc(query *UserQuery, opts ListOptions, cursor *listCursor) UserDataProvider {
+	return func(ctx context.Context, callback UserDataCallback) error {
+		// The extra user tells whether there is a following range
+		count := opts.Count + 1
+
+		if cursor != nil {
+			return Env.DataStore.Seek(ctx, query, cursor.Id, cursor.Direction, count, callback)
 		}
-		return err
+		return Env.DataStore.List(ctx, query, opts.Offset, count, callback)
 	}
 }
 
-func (e *handlerExecution) loadFileContent(data UserData, wg *sync.WaitGroup, processed chan<- UserData, failures chan<- error) {
+func (e *handlerExecution) loadFileContent(ctx context.Context, data UserData, wg *sync.WaitGroup, processed chan<- UserData, failures chan<- error) {
 	defer wg.Done()
-	processedData, pErr := processData(readProcessors, data)
+	processedData, pErr := processData(ctx, readProcessors, data)
 	if pErr != nil {
 		failures <- pErr
 	} else {
@@ -150,16 +430,420 @@ func (e *handlerExecution) loadFileContent(data UserData, wg *sync.WaitGroup, pr
 	}
 }
 
-func (e *handlerExecution) UpdateUser(_ context.Context, _ string, userData UserData) error {
-	processedData, err := processData(writeProcessors, userData)
+func (e *handlerExecution) UpdateUser(ctx context.Context, userId string, userData UserData, opts UpdateUserOptions) error {
+	// A JSON Patch is applied on the stored user with its data and turned into the merge patch of its changes
+	var storedData UserData
+	if opts.Format == FormatJSONPatch {
+		var err error
+		storedData, err = Env.DataStore.Get(ctx, userId)
+		if err != nil {
+			return err
+		}
+
+		storedData, err = mergeWithDataFromFile(ctx, storedData)
+		if err != nil {
+			return err
+		}
+
+		err = assertJSONPatchHidesSecrets([]byte(userData), sensitiveFields())
+		if err != nil {
+			return err
+		}
+
+		patchedData, err := applyJSONPatch([]byte(storedData), []byte(userData))
+		if err != nil {
+			return newError(errorKind(err), "could not apply JSON patch: "+err.Error(), errorDetails(err))
+		}
+
+		mergePatch, err := createMergePatch([]byte(storedData), patchedData)
+		if err != nil {
+			return err
+		}
+		userData = UserData(mergePatch)
+	}
+
+	if !gjson.Valid(string(userData)) || !gjson.Parse(string(userData)).IsObject() {
+		return BadInput
+	}
+
+	id := gjson.Get(string(userData), "id")
+	if id.Exists() && id.String() != userId {
+		return BadInput
+	}
+
+	password := gjson.Get(string(userData), "password")
+	if password.Exists() && password.Type == gjson.Null {
+		return BadInput
+	}
+
+	if storedData == "" {
+		var err error
+		storedData, err = Env.DataStore.Get(ctx, userId)
+		if err != nil {
+			return err
+		}
+
+		// The stored data is merged with the patched one rather than replaced by it
+		if gjson.Get(string(userData), "data").Exists() {
+			storedData, err = mergeWithDataFromFile(ctx, storedData)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	mergedData, err := applyMergePatch([]byte(storedData), []byte(userData))
+	if err != nil {
+		return err
+	}
+
+	// Only the fields that are part of the update are processed. This prevents an already
+	// hashed password from being hashed again
+	var processors []UserDataProcessor
+	if password.Exists() {
+		processors = append(processors, UserDataProcessorFunc(checkPasswordPolicy))
+	}
+	if password.Exists() {
+		processors = append(processors, UserDataProcessorFunc(hashPassword))
+	}
+
+	processedData, err := processData(ctx, processors, UserData(mergedData))
 	if err != nil {
 		return err
 	}
 
-	err = Env.DataStore.Save(processedData)
+	// The data file is written once the record is replaced, so that a failed update
+	// does not leave the new data next to the former record
+	dataPatched := gjson.Get(string(userData), "data").Exists()
+	record := processedData
+	if dataPatched {
+		stripped, err := sjson.Delete(string(processedData), "data")
+		if err != nil {
+			return BadInput
+		}
+		record = UserData(stripped)
+	}
+
+	err = Env.DataStore.Replace(ctx, record)
 	if err != nil {
 		return err
 	}
 
+	if dataPatched {
+		_, err = saveDataIntoFile(ctx, processedData)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A password change revokes the sessions opened with the former one
+	if password.Exists() {
+		return Env.DataStore.DeleteUserSessions(ctx, userId)
+	}
 	return nil
 }
+
+func (e *handlerExecution) StartImportJob(ctx context.Context, reader io.Reader, opts AddUsersOptions) (*ImportJob, error) {
+	jobId, err := newImportJobId()
+	if err != nil {
+		e.logger.WithContext(ctx).Error("import job id generation failed", "error", err)
+		return nil, Internal
+	}
+
+	spool, err := ioutil.TempFile(Env.SpoolDir, "import-"+jobId+"-")
+	if err != nil {
+		e.logger.WithContext(ctx).Error("import job spool creation failed", "error", err)
+		return nil, Internal
+	}
+
+	discardSpool := func() {
+		_ = spool.Close()
+		_ = os.Remove(spool.Name())
+	}
+
+	size, err := io.Copy(spool, reader)
+	if err != nil {
+		discardSpool()
+		e.logger.WithContext(ctx).Warn("import job spooling failed", "job", jobId, "error", err)
+		return nil, BadInput
+	}
+
+	_, err = spool.Seek(0, io.SeekStart)
+	if err != nil {
+		discardSpool()
+		e.logger.WithContext(ctx).Error("import job spool rewinding failed", "job", jobId, "error", err)
+		return nil, Internal
+	}
+
+	now := time.Now()
+	job := &ImportJob{
+		Id:         jobId,
+		Owner:      GetLoggedUser(ctx),
+		State:      ImportJobRunning,
+		OnConflict: opts.OnConflict,
+		TotalBytes: size,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	err = Env.DataStore.SaveImportJob(ctx, job)
+	if err != nil {
+		discardSpool()
+		return nil, err
+	}
+
+	// The job outlives the request. It keeps the request id so that its logs can be correlated
+	jobCtx, cancel := context.WithCancel(ContextWithRequestId(context.Background(), GetRequestId(ctx)))
+	runningImportJobs.add(job.Id, cancel)
+
+	// The shutdown waits for the job until its final state is saved
+	runningAddUsers.begin()
+	go func() {
+		defer runningAddUsers.end()
+		defer discardSpool()
+		defer runningImportJobs.remove(job.Id)
+		defer cancel()
+		e.runImportJob(jobCtx, *job, spool, opts)
+	}()
+
+	return job, nil
+}
+
+// runImportJob imports the spooled users. The job state is saved with a background context
+// in order to be persisted even if the job is canceled
+func (e *handlerExecution) runImportJob(ctx context.Context, job ImportJob, spool io.Reader, opts AddUsersOptions) {
+	logger := e.logger.WithContext(ctx).With("job", job.Id)
+	reader := &importJobReader{ctx: ctx, reader: spool}
+
+	updateJob := func(report *AddUsersReport) {
+		job.Processed = report.Accepted + report.Rejected + report.Skipped
+		job.Failed = report.Rejected
+		failures := report.Failures
+		if len(failures) > importJobMaxFailures {
+			failures = failures[:importJobMaxFailures]
+		}
+		job.Failures = append([]UserFailure(nil), failures...)
+		job.BytesRead = reader.BytesRead()
+		job.UpdatedAt = time.Now()
+	}
+
+	lastSaving := time.Now()
+	report, err := e.addUsers(ctx, reader, opts, func(report *AddUsersReport) {
+		if time.Since(lastSaving) < importJobProgressSavingInterval {
+			return
+		}
+		lastSaving = time.Now()
+
+		updateJob(report)
+		if saveErr := Env.DataStore.SaveImportJob(context.Background(), &job); saveErr != nil {
+			logger.Error("import job saving failed", "error", saveErr)
+		}
+	})
+	if report != nil {
+		updateJob(report)
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		job.State = ImportJobCanceled
+	case err != nil:
+		job.State = ImportJobFailed
+		job.Error = err.Error()
+	default:
+		job.State = ImportJobDone
+	}
+
+	err = Env.DataStore.SaveImportJob(context.Background(), &job)
+	if err != nil {
+		logger.Error("import job saving failed", "error", err)
+	}
+	logger.Info("import job ended", "state", job.State, "processed", job.Processed, "failed", job.Failed)
+}
+
+func (e *handlerExecution) GetImportJob(ctx context.Context, jobId string) (*ImportJob, error) {
+	// The registry is checked before loading the job as a job is removed from it only after its final state is saved
+	running := runningImportJobs.running(jobId)
+
+	job, err := Env.DataStore.GetImportJob(ctx, jobId)
+	if err != nil {
+		return nil, err
+	}
+
+	if job.State == ImportJobRunning && !running {
+		job.State = ImportJobInterrupted
+		job.UpdatedAt = time.Now()
+		err = Env.DataStore.SaveImportJob(ctx, job)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return job, nil
+}
+
+func (e *handlerExecution) CancelImportJob(ctx context.Context, jobId string) error {
+	job, err := e.GetImportJob(ctx, jobId)
+	if err != nil {
+		return err
+	}
+
+	if job.Finished() || !runningImportJobs.cancel(jobId) {
+		return Conflict
+	}
+	return nil
+}
+
+func (e *handlerExecution) ExportUsers(ctx context.Context, opts ExportOptions, callback UserDataCallback) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	processors := withoutSecrets(exportProcessors, opts.IncludeSecrets)
+
+	tasksResultsChannelSignal := make(chan chan UserDataProcessingResult)
+	defer close(tasksResultsChannelSignal)
+
+	runResultChannelSignal := make(chan chan error)
+	defer close(runResultChannelSignal)
+
+	processor := func(ctx context.Context, data UserData) (UserData, error) {
+		return processData(ctx, processors, data)
+	}
+	provider := func(ctx context.Context, callback UserDataCallback) error {
+		return Env.DataStore.List(ctx, nil, 0, 0, callback)
+	}
+
+	runner := ConcurrentUserDataProcessingRunner{
+		Provider:            provider,
+		Processor:           UserDataProcessorFunc(processor),
+		TasksResultsSignals: tasksResultsChannelSignal,
+		ResultSignal:        runResultChannelSignal,
+		Workers:             Env.RunnerWorkers,
+		QueueSize:           Env.RunnerQueueSize,
+		Logger:              e.logger,
+	}
+	runner.Run(ctx)
+
+	// The first error stops the export. Remaining results are drained
+	var exportErr error
+	tasksResults := <-tasksResultsChannelSignal
+	for {
+		result, hasMore := <-tasksResults
+		if !hasMore {
+			break
+		}
+
+		if exportErr != nil {
+			continue
+		}
+
+		exportErr = result.Err
+		if exportErr == nil {
+			exportErr = callback(result.Data)
+		}
+
+		if exportErr != nil {
+			e.logger.WithContext(ctx).Warn("export stopped", "user", result.UserId, "error", exportErr)
+			cancel()
+		}
+	}
+
+	runResult := <-runResultChannelSignal
+	err := <-runResult
+	if exportErr != nil {
+		return exportErr
+	}
+	return err
+}
+
+func (e *handlerExecution) GetUserRoles(ctx context.Context, userId string) ([]Role, error) {
+	_, err := Env.DataStore.Get(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	return getUserRoles(ctx, userId)
+}
+
+func (e *handlerExecution) SetUserRoles(ctx context.Context, userId string, roles []Role) error {
+	_, err := Env.DataStore.Get(ctx, userId)
+	if err != nil {
+		return err
+	}
+	return Env.DataStore.SaveRoles(ctx, userId, roles)
+}
+
+func (e *handlerExecution) ListUserSessions(ctx context.Context, userId string) ([]Session, error) {
+	sessions, err := Env.DataStore.ListSessions(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	active := []Session{}
+	for _, session := range sessions {
+		if !session.Expired(now, Env.SessionIdleTimeout, Env.SessionMaxAge) {
+			active = append(active, session)
+		}
+	}
+	return active, nil
+}
+
+func (e *handlerExecution) RevokeUserSessions(ctx context.Context, userId string) error {
+	return Env.DataStore.DeleteUserSessions(ctx, userId)
+}
+
+func (e *handlerExecution) RevokeSession(ctx context.Context, userId string, sessionId string) error {
+	session, err := Env.DataStore.GetSession(ctx, sessionId)
+	if err != nil {
+		return err
+	}
+
+	if session.User != userId {
+		return NotFound
+	}
+	return Env.DataStore.DeleteSession(ctx, sessionId)
+}
+
+func (e *handlerExecution) CreateAPIKey(ctx context.Context, userId string, name string, scopes []Permission) (*APIKey, error) {
+	// Admin accounts are not stored as users but may own keys as well
+	admin, err := isAdmin(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !admin {
+		_, err = Env.DataStore.Get(ctx, userId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := newAPIKey(userId, name, scopes)
+	if err != nil {
+		e.logger.WithContext(ctx).Error("api key generation failed", "error", err)
+		return nil, Internal
+	}
+
+	err = Env.DataStore.SaveAPIKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (e *handlerExecution) ListAPIKeys(ctx context.Context, userId string) ([]APIKey, error) {
+	return Env.DataStore.ListAPIKeys(ctx, userId)
+}
+
+func (e *handlerExecution) DeleteAPIKey(ctx context.Context, userId string, keyId string) error {
+	key, err := Env.DataStore.GetAPIKey(ctx, keyId)
+	if err != nil {
+		return err
+	}
+
+	if key.User != userId {
+		return NotFound
+	}
+	return Env.DataStore.DeleteAPIKey(ctx, keyId)
+}
+
+func (e *handlerExecution) UnlockUser(ctx context.Context, login string) error {
+	return resetLoginFailures(ctx, login)
+}
@@ -21,11 +21,37 @@ func (h handlerParamsValidator) Login(ctx context.Context, login string, passwor
 	return h.BaseHandler.Login(ctx, login, password)
 }
 
-func (h handlerParamsValidator) AddUsers(ctx context.Context, reader io.Reader) error {
+func (h handlerParamsValidator) AddUsers(ctx context.Context, reader io.Reader, opts AddUsersOptions) (*AddUsersReport, error) {
 	if reader == nil {
+		return nil, BadInput
+	}
+
+	err := h.validateAddUsersOptions(&opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.BaseHandler.AddUsers(ctx, reader, opts)
+}
+
+func (h handlerParamsValidator) validateAddUsersOptions(opts *AddUsersOptions) error {
+	switch opts.OnConflict {
+	case "":
+		opts.OnConflict = ConflictPolicyFail
+	case ConflictPolicyFail, ConflictPolicySkip, ConflictPolicyOverwrite:
+	default:
 		return BadInput
 	}
-	return h.BaseHandler.AddUsers(ctx, reader)
+
+	if opts.MaxUsers < 0 {
+		return BadInput
+	}
+
+	if opts.Format == "" {
+		opts.Format = FormatJSON
+	}
+	_, err := getUserDataProviderFactory(opts.Format)
+	return err
 }
 
 func (h handlerParamsValidator) DeleteUser(ctx context.Context, userId string) error {
@@ -35,11 +61,11 @@ func (h handlerParamsValidator) DeleteUser(ctx context.Context, userId string) e
 	return h.BaseHandler.DeleteUser(ctx, userId)
 }
 
-func (h handlerParamsValidator) GetUser(ctx context.Context, userId string) (UserData, error) {
+func (h handlerParamsValidator) GetUser(ctx context.Context, userId string, opts GetUserOptions) (UserData, error) {
 	if userId == "" {
 		return "", BadInput
 	}
-	return h.BaseHandler.GetUser(ctx, userId)
+	return h.BaseHandler.GetUser(ctx, userId, opts)
 }
 
 func (h handlerParamsValidator) GetUserList(ctx context.Context, opts ListOptions) (*UserDataList, error) {
@@ -51,14 +77,28 @@ func (h handlerParamsValidator) GetUserList(ctx context.Context, opts ListOption
 		return nil, BadInput
 	}
 
-	if opts.Count == 0 || opts.Count > DefaultUserListCount {
-		opts.Count = DefaultUserListCount
+	opts.Count = listRangeCount(opts.Count)
+
+	query, err := parseUserQuery(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Cursor != "" {
+		if opts.Offset > 0 || len(query.Sort) > 0 {
+			return nil, BadInput
+		}
+
+		_, err = decodeListCursor(opts.Cursor)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return h.BaseHandler.GetUserList(ctx, opts)
 }
 
-func (h handlerParamsValidator) UpdateUser(ctx context.Context, userId string, userData UserData) error {
+func (h handlerParamsValidator) UpdateUser(ctx context.Context, userId string, userData UserData, opts UpdateUserOptions) error {
 	if userId == "" {
 		return BadInput
 	}
@@ -67,5 +107,128 @@ func (h handlerParamsValidator) UpdateUser(ctx context.Context, userId string, u
 		return BadInput
 	}
 
-	return h.BaseHandler.UpdateUser(ctx, userId, userData)
+	switch opts.Format {
+	case "", FormatJSON, FormatMergePatch, FormatJSONPatch:
+	default:
+		return UnsupportedFormat
+	}
+
+	return h.BaseHandler.UpdateUser(ctx, userId, userData, opts)
+}
+
+func (h handlerParamsValidator) StartImportJob(ctx context.Context, reader io.Reader, opts AddUsersOptions) (*ImportJob, error) {
+	if reader == nil {
+		return nil, BadInput
+	}
+
+	err := h.validateAddUsersOptions(&opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.BaseHandler.StartImportJob(ctx, reader, opts)
+}
+
+func (h handlerParamsValidator) GetImportJob(ctx context.Context, jobId string) (*ImportJob, error) {
+	if jobId == "" {
+		return nil, BadInput
+	}
+	return h.BaseHandler.GetImportJob(ctx, jobId)
+}
+
+func (h handlerParamsValidator) CancelImportJob(ctx context.Context, jobId string) error {
+	if jobId == "" {
+		return BadInput
+	}
+	return h.BaseHandler.CancelImportJob(ctx, jobId)
+}
+
+func (h handlerParamsValidator) ExportUsers(ctx context.Context, opts ExportOptions, callback UserDataCallback) error {
+	if callback == nil {
+		return BadInput
+	}
+	return h.BaseHandler.ExportUsers(ctx, opts, callback)
+}
+
+func (h handlerParamsValidator) GetUserRoles(ctx context.Context, userId string) ([]Role, error) {
+	if userId == "" {
+		return nil, BadInput
+	}
+	return h.BaseHandler.GetUserRoles(ctx, userId)
+}
+
+func (h handlerParamsValidator) SetUserRoles(ctx context.Context, userId string, roles []Role) error {
+	if userId == "" {
+		return BadInput
+	}
+
+	for _, role := range roles {
+		if !role.Valid() {
+			return BadInput
+		}
+	}
+	return h.BaseHandler.SetUserRoles(ctx, userId, roles)
+}
+
+func (h handlerParamsValidator) ListUserSessions(ctx context.Context, userId string) ([]Session, error) {
+	if userId == "" {
+		return nil, BadInput
+	}
+	return h.BaseHandler.ListUserSessions(ctx, userId)
+}
+
+func (h handlerParamsValidator) RevokeUserSessions(ctx context.Context, userId string) error {
+	if userId == "" {
+		return BadInput
+	}
+	return h.BaseHandler.RevokeUserSessions(ctx, userId)
+}
+
+func (h handlerParamsValidator) RevokeSession(ctx context.Context, userId string, sessionId string) error {
+	if userId == "" || sessionId == "" {
+		return BadInput
+	}
+	return h.BaseHandler.RevokeSession(ctx, userId, sessionId)
+}
+
+func (h handlerParamsValidator) CreateAPIKey(ctx context.Context, userId string, name string, scopes []Permission) (*APIKey, error) {
+	if userId == "" || len(scopes) == 0 {
+		return nil, BadInput
+	}
+
+	for _, scope := range scopes {
+		if !scope.Valid() {
+			return nil, BadInput
+		}
+	}
+	return h.BaseHandler.CreateAPIKey(ctx, userId, name, scopes)
+}
+
+func (h handlerParamsValidator) ListAPIKeys(ctx context.Context, userId string) ([]APIKey, error) {
+	if userId == "" {
+		return nil, BadInput
+	}
+	return h.BaseHandler.ListAPIKeys(ctx, userId)
+}
+
+func (h handlerParamsValidator) DeleteAPIKey(ctx context.Context, userId string, keyId string) error {
+	if userId == "" || keyId == "" {
+		return BadInput
+	}
+	return h.BaseHandler.DeleteAPIKey(ctx, userId, keyId)
+}
+
+func (h handlerParamsValidator) UnlockUser(ctx context.Context, login string) error {
+	if login == "" {
+		return BadInput
+	}
+	return h.BaseHandler.UnlockUser(ctx, login)
+}
+
+// listRangeCount returns the number of users actually fetched for the requested count
+func listRangeCount(count int) int {
+	if count == 0 || count > DefaultUserListCount {
+		return DefaultUserListCount
+	}
+	return count
 }
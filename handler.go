@@ -14,30 +14,86 @@ func (b *BaseHandler) Login(ctx context.Context, user string, password string) (
 	return b.Next.Login(ctx, user, password)
 }
 
-func (b *BaseHandler) AddUsers(ctx context.Context, reader io.Reader) error {
-	return b.Next.AddUsers(ctx, reader)
+func (b *BaseHandler) Logout(ctx context.Context) error {
+	return b.Next.Logout(ctx)
+}
+
+func (b *BaseHandler) AddUsers(ctx context.Context, reader io.Reader, opts AddUsersOptions) (*AddUsersReport, error) {
+	return b.Next.AddUsers(ctx, reader, opts)
 }
 
 func (b *BaseHandler) DeleteUser(ctx context.Context, userId string) error {
 	return b.Next.DeleteUser(ctx, userId)
 }
 
-func (b *BaseHandler) GetUser(ctx context.Context, userId string) (UserData, error) {
-	return b.Next.GetUser(ctx, userId)
+func (b *BaseHandler) GetUser(ctx context.Context, userId string, opts GetUserOptions) (UserData, error) {
+	return b.Next.GetUser(ctx, userId, opts)
 }
 
 func (b *BaseHandler) GetUserList(ctx context.Context, opts ListOptions) (*UserDataList, error) {
 	return b.Next.GetUserList(ctx, opts)
 }
 
-func (b *BaseHandler) UpdateUser(ctx context.Context, userId string, userData UserData) error {
-	return b.Next.UpdateUser(ctx, userId, userData)
+func (b *BaseHandler) UpdateUser(ctx context.Context, userId string, userData UserData, opts UpdateUserOptions) error {
+	return b.Next.UpdateUser(ctx, userId, userData, opts)
+}
+
+func (b *BaseHandler) StartImportJob(ctx context.Context, reader io.Reader, opts AddUsersOptions) (*ImportJob, error) {
+	return b.Next.StartImportJob(ctx, reader, opts)
+}
+
+func (b *BaseHandler) GetImportJob(ctx context.Context, jobId string) (*ImportJob, error) {
+	return b.Next.GetImportJob(ctx, jobId)
+}
+
+func (b *BaseHandler) CancelImportJob(ctx context.Context, jobId string) error {
+	return b.Next.CancelImportJob(ctx, jobId)
+}
+
+func (b *BaseHandler) ExportUsers(ctx context.Context, opts ExportOptions, callback UserDataCallback) error {
+	return b.Next.ExportUsers(ctx, opts, callback)
+}
+
+func (b *BaseHandler) GetUserRoles(ctx context.Context, userId string) ([]Role, error) {
+	return b.Next.GetUserRoles(ctx, userId)
+}
+
+func (b *BaseHandler) SetUserRoles(ctx context.Context, userId string, roles []Role) error {
+	return b.Next.SetUserRoles(ctx, userId, roles)
+}
+
+func (b *BaseHandler) ListUserSessions(ctx context.Context, userId string) ([]Session, error) {
+	return b.Next.ListUserSessions(ctx, userId)
+}
+
+func (b *BaseHandler) RevokeUserSessions(ctx context.Context, userId string) error {
+	return b.Next.RevokeUserSessions(ctx, userId)
+}
+
+func (b *BaseHandler) RevokeSession(ctx context.Context, userId string, sessionId string) error {
+	return b.Next.RevokeSession(ctx, userId, sessionId)
+}
+
+func (b *BaseHandler) CreateAPIKey(ctx context.Context, userId string, name string, scopes []Permission) (*APIKey, error) {
+	return b.Next.CreateAPIKey(ctx, userId, name, scopes)
+}
+
+func (b *BaseHandler) ListAPIKeys(ctx context.Context, userId string) ([]APIKey, error) {
+	return b.Next.ListAPIKeys(ctx, userId)
+}
+
+func (b *BaseHandler) DeleteAPIKey(ctx context.Context, userId string, keyId string) error {
+	return b.Next.DeleteAPIKey(ctx, userId, keyId)
+}
+
+func (b *BaseHandler) UnlockUser(ctx context.Context, login string) error {
+	return b.Next.UnlockUser(ctx, login)
 }
 
 // NewAPIHandler constructs an API handler pipe
 func NewAPIHandler() (handler APIHandler) {
 
-	handler = &handlerExecution{}
+	handler = &handlerExecution{logger: Env.Logger}
 
 	handler = &handlerACL{BaseHandler: BaseHandler{
 		Next: handler,
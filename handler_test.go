@@ -3,23 +3,119 @@ package ditt
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/tidwall/gjson"
 )
 
+func init() {
+	err := AddAdmin(context.Background(), "admin", "password")
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestAdminAccounts(t *testing.T) {
+	Convey("Admin accounts must be created with hashed credentials and the last one must not be removable", t, func() {
+		ctx := context.Background()
+		handler := NewAPIHandler()
+
+		err := AddAdmin(ctx, "admin", "other")
+		So(err, ShouldEqual, Conflict)
+
+		err = AddAdmin(ctx, "frigg", "frigg-pass")
+		So(err, ShouldBeNil)
+
+		admin, err := Env.DataStore.GetAdmin(ctx, "frigg")
+		So(err, ShouldBeNil)
+		So(admin.PasswordHash, ShouldNotBeEmpty)
+		So(admin.PasswordHash, ShouldNotEqual, "frigg-pass")
+
+		ok, err := handler.Login(ctx, "frigg", "frigg-pass")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		ok, err = handler.Login(ctx, "admin", "password")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		roles, err := getUserRoles(ctx, "frigg")
+		So(err, ShouldBeNil)
+		So(roles, ShouldResemble, []Role{RoleAdmin})
+
+		err = SetAdminPassword(ctx, "frigg", "new-pass")
+		So(err, ShouldBeNil)
+
+		ok, err = handler.Login(ctx, "frigg", "frigg-pass")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+
+		ok, err = handler.Login(ctx, "frigg", "new-pass")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		err = SetAdminPassword(ctx, "nobody", "pass")
+		So(err, ShouldEqual, NotFound)
+
+		err = RemoveAdmin(ctx, "frigg")
+		So(err, ShouldBeNil)
+
+		ok, err = handler.Login(ctx, "frigg", "new-pass")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+
+		err = RemoveAdmin(ctx, "admin")
+		So(err, ShouldEqual, Conflict)
+
+		password, err := BootstrapAdmin(ctx)
+		So(err, ShouldBeNil)
+		So(password, ShouldBeEmpty)
+	})
+}
+
+func TestBootstrapAdmin(t *testing.T) {
+	Convey("Bootstrapping an empty store must create the default admin with a one-time password", t, func() {
+		ctx := context.Background()
+
+		store := Env.DataStore
+		Env.DataStore = NewUserDataMemoryStore()
+		defer func() {
+			Env.DataStore = store
+		}()
+
+		password, err := BootstrapAdmin(ctx)
+		So(err, ShouldBeNil)
+		So(len(password), ShouldEqual, 16)
+
+		ok, err := checkAdminCredentials(ctx, DefaultAdminLogin, password)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		password, err = BootstrapAdmin(ctx)
+		So(err, ShouldBeNil)
+		So(password, ShouldBeEmpty)
+	})
+}
+
 func TestBaseHandler_AddUsers1(t *testing.T) {
 	Convey("Calling AddUsers with a nil stream must fail", t, func() {
 		handler := NewAPIHandler()
-		err := handler.AddUsers(context.Background(), nil)
+		_, err := handler.AddUsers(context.Background(), nil, AddUsersOptions{})
 		So(err, ShouldEqual, BadInput)
 	})
 }
 
-/* func TestBaseHandler_AddUsers2(t *testing.T) {
+func TestBaseHandler_AddUsers2(t *testing.T) {
 	Convey("Calling AddUsers with an unauthenticated context must fail", t, func() {
 		handler := NewAPIHandler()
-		err := handler.AddUsers(context.Background(), bytes.NewBufferString(""))
+		_, err := handler.AddUsers(context.Background(), bytes.NewBufferString(""), AddUsersOptions{})
 		So(err, ShouldEqual, Forbidden)
 	})
 }
@@ -28,10 +124,10 @@ func TestBaseHandler_AddUsers3(t *testing.T) {
 	Convey("Calling AddUsers with a non admin context must fail", t, func() {
 		handler := NewAPIHandler()
 		authenticatedContext := ContextWithLoggedUser(context.Background(), "user1")
-		err := handler.AddUsers(authenticatedContext, bytes.NewBufferString(""))
+		_, err := handler.AddUsers(authenticatedContext, bytes.NewBufferString(""), AddUsersOptions{})
 		So(err, ShouldEqual, Forbidden)
 	})
-} */
+}
 
 func TestBaseHandler_AddUsers4(t *testing.T) {
 	Convey("Calling AddUsers with an admin context and with malformed JSON must fail", t, func() {
@@ -44,8 +140,8 @@ func TestBaseHandler_AddUsers4(t *testing.T) {
 				{"id": "hulk", "data": lorem ipsum"
 			]
 		`
-		err := handler.AddUsers(authenticatedContext, bytes.NewBufferString(userDataStream))
-		So(err, ShouldEqual, BadInput)
+		_, err := handler.AddUsers(authenticatedContext, bytes.NewBufferString(userDataStream), AddUsersOptions{})
+		So(errors.Is(err, BadInput), ShouldBeTrue)
 	})
 }
 
@@ -59,8 +155,324 @@ func TestBaseHandler_AddUsers5(t *testing.T) {
 				{"id": "hulk", "password": "hulk-pass", "data": "lorem ipsum"}
 			]
 		`
-		err := handler.AddUsers(authenticatedContext, bytes.NewBufferString(userDataStream))
+		// "loki" may have been registered by the malformed stream of the previous test
+		opts := AddUsersOptions{OnConflict: ConflictPolicyOverwrite}
+		_, err := handler.AddUsers(authenticatedContext, bytes.NewBufferString(userDataStream), opts)
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestBaseHandler_AddUsers6(t *testing.T) {
+	Convey("Calling AddUsers with an unknown conflict policy must fail", t, func() {
+		handler := NewAPIHandler()
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "admin")
+		_, err := handler.AddUsers(authenticatedContext, bytes.NewBufferString("[]"), AddUsersOptions{OnConflict: "merge"})
+		So(err, ShouldEqual, BadInput)
+	})
+}
+
+func TestBaseHandler_AddUsers7(t *testing.T) {
+	Convey("Calling AddUsers with already registered users must apply the conflict policy", t, func() {
+		handler := NewAPIHandler()
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "admin")
+
+		userDataStream := `[{"id": "thor", "password": "thor-pass", "data": "hammer"}]`
+		_, err := handler.AddUsers(authenticatedContext, bytes.NewBufferString(userDataStream), AddUsersOptions{})
+		So(err, ShouldBeNil)
+
+		userDataStream = `[{"id": "thor", "password": "thor-pass", "data": "axe"}]`
+		report, err := handler.AddUsers(authenticatedContext, bytes.NewBufferString(userDataStream), AddUsersOptions{OnConflict: ConflictPolicyFail})
+		So(err, ShouldEqual, Conflict)
+		So(report.Rejected, ShouldEqual, 1)
+		So(report.Failures, ShouldResemble, []UserFailure{{Index: 0, UserId: "thor", Error: Conflict.Error()}})
+
+		report, err = handler.AddUsers(authenticatedContext, bytes.NewBufferString(userDataStream), AddUsersOptions{OnConflict: ConflictPolicySkip})
+		So(err, ShouldBeNil)
+		So(report.Skipped, ShouldEqual, 1)
+		So(report.Failures, ShouldBeEmpty)
+
+		userData, err := handler.GetUser(authenticatedContext, "thor", GetUserOptions{})
+		So(err, ShouldBeNil)
+		So(userData.Data(), ShouldEqual, "hammer")
+
+		_, err = handler.AddUsers(authenticatedContext, bytes.NewBufferString(userDataStream), AddUsersOptions{OnConflict: ConflictPolicyOverwrite})
+		So(err, ShouldBeNil)
+
+		userData, err = handler.GetUser(authenticatedContext, "thor", GetUserOptions{})
+		So(err, ShouldBeNil)
+		So(userData.Data(), ShouldEqual, "axe")
+	})
+}
+
+func TestBaseHandler_AddUsers8(t *testing.T) {
+	Convey("Calling AddUsers must report the index and the id of the conflicting user and stop there", t, func() {
+		handler := NewAPIHandler()
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "admin")
+		workers, queueSize := Env.RunnerWorkers, Env.RunnerQueueSize
+		Env.RunnerWorkers, Env.RunnerQueueSize = 1, 1
+		defer func() {
+			Env.RunnerWorkers, Env.RunnerQueueSize = workers, queueSize
+		}()
+
+		userDataStream := `[
+			{"id": "odin", "password": "odin-pass", "data": "spear"},
+			{"id": "thor", "password": "thor-pass", "data": "hammer"},
+			{"id": "frigga", "password": "frigga-pass", "data": "loom"},
+			{"id": "thor", "password": "thor-pass", "data": "hammer"}
+		]`
+		report, err := handler.AddUsers(authenticatedContext, bytes.NewBufferString(userDataStream), AddUsersOptions{})
+		So(err, ShouldEqual, Conflict)
+		So(report.Accepted, ShouldEqual, 1)
+		So(report.Rejected, ShouldEqual, 1)
+		So(report.Failures, ShouldResemble, []UserFailure{
+			{Index: 1, UserId: "thor", Error: Conflict.Error()},
+		})
+
+		_, err = Env.DataStore.Get(context.Background(), "frigga")
+		So(err, ShouldEqual, NotFound)
+	})
+}
+
+// cancelingReader cancels a context once "limit" bytes have been read
+type cancelingReader struct {
+	reader io.Reader
+	limit  int
+	read   int
+	cancel context.CancelFunc
+}
+
+func (r *cancelingReader) Read(p []byte) (int, error) {
+	if len(p) > r.limit {
+		p = p[:r.limit]
+	}
+
+	n, err := r.reader.Read(p)
+	r.read += n
+	if r.read >= r.limit {
+		r.cancel()
+	}
+	return n, err
+}
+
+func TestBaseHandler_AddUsers9(t *testing.T) {
+	Convey("Canceling the context in the middle of AddUsers must stop the import", t, func() {
+		handler := NewAPIHandler()
+		ctx, cancel := context.WithCancel(ContextWithLoggedUser(context.Background(), "admin"))
+		defer cancel()
+
+		firstUser := `{"id": "valkyrie-0", "password": "valkyrie-pass", "data": "pegasus"}`
+		userDataStream := "[" + firstUser
+		for i := 1; i < 50; i++ {
+			userDataStream += fmt.Sprintf(`, {"id": "valkyrie-%d", "password": "valkyrie-pass", "data": "pegasus"}`, i)
+		}
+		userDataStream += "]"
+
+		reader := &cancelingReader{
+			reader: bytes.NewBufferString(userDataStream),
+			limit:  len(firstUser) + 2,
+			cancel: cancel,
+		}
+		report, err := handler.AddUsers(ctx, reader, AddUsersOptions{})
+		So(err, ShouldEqual, context.Canceled)
+		So(report.Accepted+report.Rejected, ShouldBeLessThan, 50)
+
+		_, err = Env.DataStore.Get(context.Background(), "valkyrie-49")
+		So(err, ShouldEqual, NotFound)
+	})
+}
+
+func TestBaseHandler_AddUsers10(t *testing.T) {
+	Convey("With self registration, an unauthenticated caller must only be able to add a single new user", t, func() {
+		Env.SelfRegistration = true
+		defer func() {
+			Env.SelfRegistration = false
+		}()
+
+		handler := NewAPIHandler()
+		report, err := handler.AddUsers(context.Background(), bytes.NewBufferString(`[{"id": "sif", "password": "sword", "data": "warrior"}]`), AddUsersOptions{})
+		So(err, ShouldBeNil)
+		So(report.Accepted, ShouldEqual, 1)
+
+		ok, err := handler.Login(context.Background(), "sif", "sword")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		_, err = handler.AddUsers(context.Background(), bytes.NewBufferString(`[{"id": "sif", "password": "stolen"}]`), AddUsersOptions{OnConflict: ConflictPolicyOverwrite})
+		So(err, ShouldEqual, Conflict)
+
+		_, err = handler.AddUsers(context.Background(), bytes.NewBufferString(`[{"id": "baldr", "password": "p1"}, {"id": "hodr", "password": "p2"}]`), AddUsersOptions{})
+		So(errors.Is(err, BadInput), ShouldBeTrue)
+
+		_, err = Env.DataStore.Get(context.Background(), "baldr")
+		So(err, ShouldEqual, NotFound)
+
+		report, err = handler.AddUsers(context.Background(), bytes.NewBufferString(`[{"id": "admin", "password": "p1"}]`), AddUsersOptions{})
+		So(err, ShouldBeNil)
+		So(report.Rejected, ShouldEqual, 1)
+
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "sif")
+		_, err = handler.AddUsers(authenticatedContext, bytes.NewBufferString(`[{"id": "loki-2", "password": "p1"}]`), AddUsersOptions{})
+		So(err, ShouldEqual, Forbidden)
+	})
+}
+
+func TestBaseHandler_AddUsers11(t *testing.T) {
+	Convey("Calling AddUsers with the fail policy must stop at the first conflict", t, func() {
+		handler := NewAPIHandler()
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "admin")
+		workers, queueSize := Env.RunnerWorkers, Env.RunnerQueueSize
+		Env.RunnerWorkers, Env.RunnerQueueSize = 1, 1
+		defer func() {
+			Env.RunnerWorkers, Env.RunnerQueueSize = workers, queueSize
+		}()
+
+		records := []string{`{"id": "thor", "password": "thor-pass"}`}
+		for i := 0; i < 20; i++ {
+			records = append(records, fmt.Sprintf(`{"id": "einherjar-%d", "password": "einherjar-pass"}`, i))
+		}
+
+		report, err := handler.AddUsers(authenticatedContext, bytes.NewBufferString("["+strings.Join(records, ",")+"]"), AddUsersOptions{OnConflict: ConflictPolicyFail})
+		So(err, ShouldEqual, Conflict)
+		So(report.Rejected, ShouldEqual, 1)
+		So(report.Failures, ShouldResemble, []UserFailure{{Index: 0, UserId: "thor", Error: Conflict.Error()}})
+		So(report.Accepted, ShouldEqual, 0)
+	})
+}
+
+// _testRacingDataStore hides the registered users from Get as if they were created by a concurrent request
+type _testRacingDataStore struct {
+	UserDataStore
+}
+
+func (s *_testRacingDataStore) Get(context.Context, string) (UserData, error) {
+	return "", NotFound
+}
+
+func TestBaseHandler_AddUsers12(t *testing.T) {
+	Convey("A user creation that loses a race must leave the data file of the registered user untouched", t, func() {
+		handler := NewAPIHandler()
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "admin")
+
+		_, err := handler.AddUsers(authenticatedContext, bytes.NewBufferString(`[{"id": "bragi", "password": "bragi-pass", "data": "poetry"}]`), AddUsersOptions{})
 		So(err, ShouldBeNil)
+
+		store := Env.DataStore
+		Env.DataStore = &_testRacingDataStore{UserDataStore: store}
+		report, err := handler.AddUsers(authenticatedContext, bytes.NewBufferString(`[{"id": "bragi", "password": "bragi-pass", "data": "harp"}]`), AddUsersOptions{})
+		Env.DataStore = store
+		So(err, ShouldEqual, Conflict)
+		So(report.Rejected, ShouldEqual, 1)
+
+		userData, err := handler.GetUser(authenticatedContext, "bragi", GetUserOptions{})
+		So(err, ShouldBeNil)
+		So(userData.Data(), ShouldEqual, "poetry")
+	})
+}
+
+func TestBaseHandler_AddUsers13(t *testing.T) {
+	Convey("Calling AddUsers must report the index of each user that would shadow an admin", t, func() {
+		handler := NewAPIHandler()
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "admin")
+
+		userDataStream := `[
+			{"id": "kvasir", "password": "kvasir-pass", "data": "mead"},
+			{"id": "admin", "password": "admin-pass", "data": "hammer"},
+			{"id": "gullveig", "password": "gullveig-pass", "data": "gold"},
+			{"id": "admin", "password": "admin-pass", "data": "hammer"}
+		]`
+		report, err := handler.AddUsers(authenticatedContext, bytes.NewBufferString(userDataStream), AddUsersOptions{})
+		So(err, ShouldBeNil)
+		So(report.Accepted, ShouldEqual, 2)
+		So(report.Rejected, ShouldEqual, 2)
+		So(report.Failures, ShouldResemble, []UserFailure{
+			{Index: 1, UserId: "admin", Error: BadInput.Error()},
+			{Index: 3, UserId: "admin", Error: BadInput.Error()},
+		})
+	})
+}
+
+func TestBaseHandler_ImportJob1(t *testing.T) {
+	Convey("Starting an import job with an unauthenticated context must fail", t, func() {
+		handler := NewAPIHandler()
+		_, err := handler.StartImportJob(context.Background(), bytes.NewBufferString("[]"), AddUsersOptions{})
+		So(err, ShouldEqual, Forbidden)
+	})
+}
+
+func TestBaseHandler_ImportJob2(t *testing.T) {
+	Convey("Starting an import job with an admin context must import users in background", t, func() {
+		handler := NewAPIHandler()
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "admin")
+
+		userDataStream := `[
+			{"id": "heimdall", "password": "heimdall-pass", "data": "bifrost"},
+			{"id": "odin", "password": "odin-pass", "data": "spear"}
+		]`
+		job, err := handler.StartImportJob(authenticatedContext, bytes.NewBufferString(userDataStream), AddUsersOptions{})
+		So(err, ShouldBeNil)
+		So(job.Id, ShouldNotBeEmpty)
+		So(job.TotalBytes, ShouldEqual, len(userDataStream))
+
+		for !job.Finished() {
+			time.Sleep(100 * time.Millisecond)
+			job, err = handler.GetImportJob(authenticatedContext, job.Id)
+			So(err, ShouldBeNil)
+		}
+
+		So(job.State, ShouldEqual, ImportJobFailed)
+		So(job.Error, ShouldEqual, Conflict.Error())
+		So(job.Processed, ShouldEqual, 2)
+		So(job.Failed, ShouldEqual, 1)
+		So(job.BytesRead, ShouldEqual, job.TotalBytes)
+		So(job.Failures, ShouldResemble, []UserFailure{{Index: 1, UserId: "odin", Error: Conflict.Error()}})
+
+		// other users must not see the job
+		_, err = handler.GetImportJob(ContextWithLoggedUser(context.Background(), "loki"), job.Id)
+		So(err, ShouldEqual, NotAuthorized)
+
+		// a finished job cannot be canceled
+		err = handler.CancelImportJob(authenticatedContext, job.Id)
+		So(err, ShouldEqual, Conflict)
+	})
+}
+
+func TestBaseHandler_ImportJob4(t *testing.T) {
+	Convey("An import job must only keep its first failures while counting them all", t, func() {
+		handler := NewAPIHandler()
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "admin")
+
+		records := make([]string, importJobMaxFailures+5)
+		for i := range records {
+			records[i] = `{"id": "admin", "password": "admin-pass"}`
+		}
+		userDataStream := "[" + strings.Join(records, ",") + "]"
+
+		job, err := handler.StartImportJob(authenticatedContext, bytes.NewBufferString(userDataStream), AddUsersOptions{})
+		So(err, ShouldBeNil)
+
+		for !job.Finished() {
+			time.Sleep(100 * time.Millisecond)
+			job, err = handler.GetImportJob(authenticatedContext, job.Id)
+			So(err, ShouldBeNil)
+		}
+
+		So(job.State, ShouldEqual, ImportJobDone)
+		So(job.Failed, ShouldEqual, len(records))
+		So(job.Failures, ShouldHaveLength, importJobMaxFailures)
+	})
+}
+
+func TestBaseHandler_ImportJob3(t *testing.T) {
+	Convey("A job that was running when the server stopped must be reported as interrupted", t, func() {
+		handler := NewAPIHandler()
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "admin")
+
+		err := Env.DataStore.SaveImportJob(context.Background(), &ImportJob{Id: "stale-job", Owner: "admin", State: ImportJobRunning})
+		So(err, ShouldBeNil)
+
+		job, err := handler.GetImportJob(authenticatedContext, "stale-job")
+		So(err, ShouldBeNil)
+		So(job.State, ShouldEqual, ImportJobInterrupted)
 	})
 }
 
@@ -109,7 +521,7 @@ func TestBaseHandler_Login4(t *testing.T) {
 func TestBaseHandler_GetUser1(t *testing.T) {
 	Convey("Calling GetUser with an empty userId must fail", t, func() {
 		handler := NewAPIHandler()
-		_, err := handler.GetUser(context.Background(), "")
+		_, err := handler.GetUser(context.Background(), "", GetUserOptions{})
 		So(err, ShouldEqual, BadInput)
 	})
 }
@@ -117,7 +529,7 @@ func TestBaseHandler_GetUser1(t *testing.T) {
 func TestBaseHandler_GetUser2(t *testing.T) {
 	Convey("Calling GetUser with an unauthenticated context must fail", t, func() {
 		handler := NewAPIHandler()
-		_, err := handler.GetUser(context.Background(), "user1")
+		_, err := handler.GetUser(context.Background(), "user1", GetUserOptions{})
 		So(err, ShouldEqual, Forbidden)
 	})
 }
@@ -126,7 +538,7 @@ func TestBaseHandler_GetUser3(t *testing.T) {
 	Convey("Calling GetUser with an authenticated context on another user data must fail", t, func() {
 		handler := NewAPIHandler()
 		authenticatedContext := ContextWithLoggedUser(context.Background(), "loki")
-		_, err := handler.GetUser(authenticatedContext, "hulk")
+		_, err := handler.GetUser(authenticatedContext, "hulk", GetUserOptions{})
 		So(err, ShouldEqual, NotAuthorized)
 	})
 }
@@ -142,8 +554,8 @@ func TestBaseHandler_GetUser4(t *testing.T) {
 				{"id": "hulk", "data": lorem ipsum"
 			]
 		`
-		err := handler.AddUsers(authenticatedContext, bytes.NewBufferString(userDataStream))
-		So(err, ShouldEqual, BadInput)
+		_, err := handler.AddUsers(authenticatedContext, bytes.NewBufferString(userDataStream), AddUsersOptions{})
+		So(errors.Is(err, BadInput), ShouldBeTrue)
 	})
 }
 
@@ -151,7 +563,7 @@ func TestBaseHandler_GetUser5(t *testing.T) {
 	Convey("Calling AddUsers with an admin context and with a well formed JSON should succeed", t, func() {
 		handler := NewAPIHandler()
 		authenticatedContext := ContextWithLoggedUser(context.Background(), "loki")
-		userData, err := handler.GetUser(authenticatedContext, "loki")
+		userData, err := handler.GetUser(authenticatedContext, "loki", GetUserOptions{})
 		So(err, ShouldBeNil)
 		So(userData, ShouldNotEqual, "")
 		So(userData.Id(), ShouldEqual, "loki")
@@ -205,13 +617,79 @@ func TestBaseHandler_GetUserList4(t *testing.T) {
 	})
 }
 
+func TestBaseHandler_GetUserList5(t *testing.T) {
+	Convey("Calling GetUserList with an invalid cursor or with both a cursor and an offset must fail", t, func() {
+		handler := NewAPIHandler()
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "admin")
+		_, err := handler.GetUserList(authenticatedContext, ListOptions{Cursor: "not a cursor"})
+		So(err, ShouldEqual, BadInput)
+
+		cursor := (&listCursor{Id: "loki"}).encode()
+		_, err = handler.GetUserList(authenticatedContext, ListOptions{Offset: 1, Cursor: cursor})
+		So(err, ShouldEqual, BadInput)
+	})
+}
+
+func TestBaseHandler_GetUserList6(t *testing.T) {
+	Convey("Following the cursors of GetUserList must walk through all the users in id order", t, func() {
+		handler := NewAPIHandler()
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "admin")
+
+		var storedIds []string
+		err := Env.DataStore.List(context.Background(), nil, 0, 0, func(data UserData) error {
+			storedIds = append(storedIds, data.Id())
+			return nil
+		})
+		So(err, ShouldBeNil)
+		So(len(storedIds), ShouldBeGreaterThan, 2)
+
+		var (
+			pages [][]string
+			ids   []string
+			list  *UserDataList
+		)
+		opts := ListOptions{Count: 2}
+		for {
+			list, err = handler.GetUserList(authenticatedContext, opts)
+			So(err, ShouldBeNil)
+
+			var pageIds []string
+			for _, userData := range list.UserDataList {
+				pageIds = append(pageIds, userData.Id())
+			}
+			pages = append(pages, pageIds)
+			ids = append(ids, pageIds...)
+
+			if list.Next == "" {
+				break
+			}
+			opts.Cursor = list.Next
+		}
+		So(ids, ShouldResemble, storedIds)
+		So(pages[0], ShouldHaveLength, 2)
+		So(list.Total, ShouldEqual, len(storedIds))
+		So(list.Count, ShouldEqual, len(pages[len(pages)-1]))
+		So(list.HasMore, ShouldBeFalse)
+
+		list, err = handler.GetUserList(authenticatedContext, ListOptions{Count: 2, Cursor: list.Prev})
+		So(err, ShouldBeNil)
+
+		var pageIds []string
+		for _, userData := range list.UserDataList {
+			pageIds = append(pageIds, userData.Id())
+		}
+		So(pageIds, ShouldResemble, pages[len(pages)-2])
+		So(list.Next, ShouldNotBeEmpty)
+	})
+}
+
 func TestBaseHandler_UpdateUser1(t *testing.T) {
 	Convey("Calling UpdateUser with an empty userId or userData must fail", t, func() {
 		handler := NewAPIHandler()
-		err := handler.UpdateUser(context.Background(), "", "whatever")
+		err := handler.UpdateUser(context.Background(), "", "whatever", UpdateUserOptions{})
 		So(err, ShouldEqual, BadInput)
 
-		err = handler.UpdateUser(context.Background(), "user1", "")
+		err = handler.UpdateUser(context.Background(), "user1", "", UpdateUserOptions{})
 		So(err, ShouldEqual, BadInput)
 	})
 }
@@ -219,7 +697,7 @@ func TestBaseHandler_UpdateUser1(t *testing.T) {
 func TestBaseHandler_UpdateUser2(t *testing.T) {
 	Convey("Calling UpdateUser with an unauthenticated context must fail", t, func() {
 		handler := NewAPIHandler()
-		err := handler.UpdateUser(context.Background(), "loki", "whatever")
+		err := handler.UpdateUser(context.Background(), "loki", "whatever", UpdateUserOptions{})
 		So(err, ShouldEqual, Forbidden)
 	})
 }
@@ -228,7 +706,7 @@ func TestBaseHandler_UpdateUser3(t *testing.T) {
 	Convey("Calling UpdateUser with an authenticated context on another user data must fail", t, func() {
 		handler := NewAPIHandler()
 		authenticatedContext := ContextWithLoggedUser(context.Background(), "loki")
-		err := handler.UpdateUser(authenticatedContext, "hulk", "whatever")
+		err := handler.UpdateUser(authenticatedContext, "hulk", "whatever", UpdateUserOptions{})
 		So(err, ShouldEqual, NotAuthorized)
 	})
 }
@@ -236,62 +714,909 @@ func TestBaseHandler_UpdateUser3(t *testing.T) {
 func TestBaseHandler_UpdateUser4(t *testing.T) {
 	Convey("Calling UpdateUser with an authenticated context on owned data must succeed", t, func() {
 		handler := NewAPIHandler()
-		userData := UserData(`{"id": "loki", "data": I am a god you dummy creatures"}`)
+		storedData, err := Env.DataStore.Get(context.Background(), "loki")
+		So(err, ShouldBeNil)
+
+		userData := UserData(`{"id": "loki", "data": "I am a god you dummy creatures"}`)
 		authenticatedContext := ContextWithLoggedUser(context.Background(), "loki")
-		err := handler.UpdateUser(authenticatedContext, "loki", userData)
+		err = handler.UpdateUser(authenticatedContext, "loki", userData, UpdateUserOptions{})
+		So(err, ShouldBeNil)
+
+		updatedData, err := handler.GetUser(authenticatedContext, "loki", GetUserOptions{})
 		So(err, ShouldBeNil)
+		So(updatedData.Data(), ShouldEqual, "I am a god you dummy creatures")
+
+		// the stored password must not be affected by an update of the "data" field
+		So(updatedData.Password(), ShouldBeEmpty)
+		updatedStoredData, err := Env.DataStore.Get(context.Background(), "loki")
+		So(err, ShouldBeNil)
+		So(updatedStoredData.Password(), ShouldEqual, storedData.Password())
 	})
 }
 
 func TestBaseHandler_UpdateUser5(t *testing.T) {
 	Convey("Calling UpdateUser with an admin context must succeed", t, func() {
 		handler := NewAPIHandler()
-		userData := UserData(`{"id": "hulk", "data": I don't have time to think, all i want to destroy you"}`)
+		userData := UserData(`{"id": "hulk", "data": "I don't have time to think, all i want to destroy you"}`)
 		authenticatedContext := ContextWithLoggedUser(context.Background(), "admin")
-		err := handler.UpdateUser(authenticatedContext, "hulk", userData)
+		err := handler.UpdateUser(authenticatedContext, "hulk", userData, UpdateUserOptions{})
 		So(err, ShouldBeNil)
 	})
 }
 
-func TestBaseHandler_DeleteUser1(t *testing.T) {
-	Convey("Calling DeleteUser with an empty userId must fail", t, func() {
+func TestBaseHandler_UpdateUser6(t *testing.T) {
+	Convey("Calling UpdateUser with an id in the data that does not match the userId must fail", t, func() {
 		handler := NewAPIHandler()
-		err := handler.DeleteUser(context.Background(), "")
+		userData := UserData(`{"id": "hulk", "data": "I am loki now"}`)
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "loki")
+		err := handler.UpdateUser(authenticatedContext, "loki", userData, UpdateUserOptions{})
 		So(err, ShouldEqual, BadInput)
 	})
 }
 
-func TestBaseHandler_DeleteUser2(t *testing.T) {
-	Convey("Calling DeleteUser with an unauthenticated context must fail", t, func() {
+func TestBaseHandler_UpdateUser7(t *testing.T) {
+	Convey("Calling UpdateUser with a new password must replace the stored one", t, func() {
 		handler := NewAPIHandler()
-		err := handler.DeleteUser(context.Background(), "loki")
-		So(err, ShouldEqual, Forbidden)
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "hulk")
+		err := handler.UpdateUser(authenticatedContext, "hulk", `{"password": "hulk-new-pass"}`, UpdateUserOptions{})
+		So(err, ShouldBeNil)
+
+		ok, err := handler.Login(context.Background(), "hulk", "hulk-new-pass")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		userData, err := handler.GetUser(authenticatedContext, "hulk", GetUserOptions{})
+		So(err, ShouldBeNil)
+		So(userData.Data(), ShouldEqual, "I don't have time to think, all i want to destroy you")
 	})
 }
 
-func TestBaseHandler_DeleteUser3(t *testing.T) {
-	Convey("Calling DeleteUser with an authenticated context on another user data must fail", t, func() {
+func TestBaseHandler_UpdateUser8(t *testing.T) {
+	Convey("A merge patch of some of the data keys must keep the other ones", t, func() {
 		handler := NewAPIHandler()
 		authenticatedContext := ContextWithLoggedUser(context.Background(), "loki")
-		err := handler.DeleteUser(authenticatedContext, "hulk")
-		So(err, ShouldEqual, NotAuthorized)
+
+		err := handler.UpdateUser(authenticatedContext, "loki", `{"data": {"city": "Asgard", "title": "god", "brother": "thor"}}`, UpdateUserOptions{})
+		So(err, ShouldBeNil)
+
+		err = handler.UpdateUser(authenticatedContext, "loki", `{"data": {"city": "Jotunheim", "brother": null}}`, UpdateUserOptions{})
+		So(err, ShouldBeNil)
+
+		userData, err := handler.GetUser(authenticatedContext, "loki", GetUserOptions{})
+		So(err, ShouldBeNil)
+		So(userData.Data(), ShouldEqual, `{"city":"Jotunheim","title":"god"}`)
+
+		storedData, err := Env.DataStore.Get(context.Background(), "loki")
+		So(err, ShouldBeNil)
+		So(gjson.Get(string(storedData), "data").Exists(), ShouldBeFalse)
 	})
 }
 
-func TestBaseHandler_DeleteUser4(t *testing.T) {
-	Convey("Calling DeleteUser with an authenticated context on owned data must succeed", t, func() {
+// _testFailingReplaceDataStore fails every replacement of a user record
+type _testFailingReplaceDataStore struct {
+	UserDataStore
+}
+
+func (s *_testFailingReplaceDataStore) Replace(ctx context.Context, data UserData) error {
+	return Internal
+}
+
+func TestBaseHandler_UpdateUser9(t *testing.T) {
+	Convey("A failed update must keep the former data", t, func() {
 		handler := NewAPIHandler()
 		authenticatedContext := ContextWithLoggedUser(context.Background(), "loki")
-		err := handler.DeleteUser(authenticatedContext, "loki")
+
+		store := Env.DataStore
+		Env.DataStore = &_testFailingReplaceDataStore{UserDataStore: store}
+		err := handler.UpdateUser(authenticatedContext, "loki", `{"data": {"city": "Niflheim"}}`, UpdateUserOptions{})
+		Env.DataStore = store
+		So(err, ShouldEqual, Internal)
+
+		userData, err := handler.GetUser(authenticatedContext, "loki", GetUserOptions{})
 		So(err, ShouldBeNil)
+		So(userData.Data(), ShouldEqual, `{"city":"Jotunheim","title":"god"}`)
 	})
 }
 
-func TestBaseHandler_DeleteUser5(t *testing.T) {
-	Convey("Calling DeleteUser with an admin context must succeed", t, func() {
+func TestBaseHandler_UpdateUser10(t *testing.T) {
+	Convey("A JSON patch must be applied on the stored user and must not read its sensitive fields", t, func() {
 		handler := NewAPIHandler()
-		authenticatedContext := ContextWithLoggedUser(context.Background(), "admin")
-		err := handler.DeleteUser(authenticatedContext, "hulk")
+		adminContext := ContextWithLoggedUser(context.Background(), "admin")
+		jsonPatch := UpdateUserOptions{Format: FormatJSONPatch}
+
+		_, err := handler.AddUsers(adminContext, bytes.NewBufferString(`[{"id": "vali", "password": "vali-pass", "data": {"father": "odin"}}]`), AddUsersOptions{})
+		So(err, ShouldBeNil)
+
+		err = handler.UpdateUser(adminContext, "vali", `[{"op": "add", "path": "/data/brother", "value": "baldr"}]`, jsonPatch)
+		So(err, ShouldBeNil)
+
+		userData, err := handler.GetUser(adminContext, "vali", GetUserOptions{})
+		So(err, ShouldBeNil)
+		So(userData.Data(), ShouldEqual, `{"brother":"baldr","father":"odin"}`)
+
+		storedData, err := Env.DataStore.Get(context.Background(), "vali")
+		So(err, ShouldBeNil)
+		hashedPassword := storedData.Password()
+
+		for _, patch := range []string{
+			`[{"op": "test", "path": "/password", "value": "vali-pass"}]`,
+			`[{"op": "copy", "from": "/password", "path": "/data/password"}]`,
+			`[{"op": "move", "from": "", "path": "/data/copy"}]`,
+			`[{"op": "remove", "path": "/password"}]`,
+		} {
+			err = handler.UpdateUser(adminContext, "vali", UserData(patch), jsonPatch)
+			So(errors.Is(err, BadInput), ShouldBeTrue)
+		}
+
+		err = handler.UpdateUser(adminContext, "vali", `[{"op": "replace", "path": "/password", "value": "vali-new-pass"}]`, jsonPatch)
+		So(err, ShouldBeNil)
+
+		storedData, err = Env.DataStore.Get(context.Background(), "vali")
+		So(err, ShouldBeNil)
+		So(storedData.Password(), ShouldNotEqual, hashedPassword)
+		So(storedData.Password(), ShouldNotEqual, "vali-new-pass")
+
+		ok, err := handler.Login(context.Background(), "vali", "vali-new-pass")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		err = handler.UpdateUser(adminContext, "vali", `{}`, UpdateUserOptions{Format: FormatCSV})
+		So(err, ShouldEqual, UnsupportedFormat)
+
+		So(handler.DeleteUser(adminContext, "vali"), ShouldBeNil)
+	})
+}
+
+func TestBaseHandler_DataTypes(t *testing.T) {
+	Convey("The data must be read back with the type it was saved with", t, func() {
+		handler := NewAPIHandler()
+		adminContext := ContextWithLoggedUser(context.Background(), "admin")
+
+		userDataStream := `[
+			{"id": "mani", "password": "mani-pass", "data": "{}"},
+			{"id": "sol", "password": "sol-pass", "data": "[1,2]"},
+			{"id": "dagr", "password": "dagr-pass", "data": {"horse": "Skinfaxi"}}
+		]`
+		_, err := handler.AddUsers(adminContext, bytes.NewBufferString(userDataStream), AddUsersOptions{})
+		So(err, ShouldBeNil)
+
+		for id, raw := range map[string]string{"mani": `"{}"`, "sol": `"[1,2]"`, "dagr": `{"horse": "Skinfaxi"}`} {
+			userData, err := handler.GetUser(adminContext, id, GetUserOptions{})
+			So(err, ShouldBeNil)
+			So(gjson.Get(string(userData), "data").Raw, ShouldEqual, raw)
+		}
+
+		// files saved before the raw values were are read as strings
+		err = Env.Files.Save(context.Background(), "mani", "full moon")
+		So(err, ShouldBeNil)
+		userData, err := handler.GetUser(adminContext, "mani", GetUserOptions{})
+		So(err, ShouldBeNil)
+		So(gjson.Get(string(userData), "data").Raw, ShouldEqual, `"full moon"`)
+
+		for _, id := range []string{"mani", "sol", "dagr"} {
+			So(handler.DeleteUser(adminContext, id), ShouldBeNil)
+		}
+	})
+}
+
+func TestBaseHandler_ExportUsers1(t *testing.T) {
+	Convey("Calling ExportUsers with a non admin context must fail", t, func() {
+		handler := NewAPIHandler()
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "loki")
+		err := handler.ExportUsers(authenticatedContext, ExportOptions{}, func(UserData) error {
+			return nil
+		})
+		So(err, ShouldEqual, Forbidden)
+	})
+}
+
+func TestBaseHandler_ExportUsers2(t *testing.T) {
+	Convey("Calling ExportUsers with an admin context must pass every user with its data and without its password", t, func() {
+		handler := NewAPIHandler()
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "admin")
+
+		exported := map[string]UserData{}
+		err := handler.ExportUsers(authenticatedContext, ExportOptions{}, func(user UserData) error {
+			exported[user.Id()] = user
+			return nil
+		})
+		So(err, ShouldBeNil)
+		So(exported, ShouldContainKey, "hulk")
+		So(exported["hulk"].Data(), ShouldEqual, "I don't have time to think, all i want to destroy you")
+		for _, user := range exported {
+			So(user.Password(), ShouldBeEmpty)
+		}
+
+		exported = map[string]UserData{}
+		err = handler.ExportUsers(authenticatedContext, ExportOptions{IncludeSecrets: true}, func(user UserData) error {
+			exported[user.Id()] = user
+			return nil
+		})
+		So(err, ShouldBeNil)
+		So(exported["hulk"].Password(), ShouldStartWith, "$2a$")
+	})
+}
+
+func TestBaseHandler_ExportUsers3(t *testing.T) {
+	Convey("ExportUsers must stop at the first error returned by the callback", t, func() {
+		handler := NewAPIHandler()
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "admin")
+
+		callbackErr := errors.New("write failed")
+		calls := 0
+		err := handler.ExportUsers(authenticatedContext, ExportOptions{}, func(UserData) error {
+			calls++
+			return callbackErr
+		})
+		So(err, ShouldEqual, callbackErr)
+		So(calls, ShouldEqual, 1)
+	})
+}
+
+func TestBaseHandler_ExportUsers4(t *testing.T) {
+	Convey("ExportUsers must not hold the store while the callback runs", t, func() {
+		handler := NewAPIHandler()
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "admin")
+
+		exported := make(chan error, 1)
+		go func() {
+			exported <- handler.ExportUsers(authenticatedContext, ExportOptions{}, func(UserData) error {
+				_, err := Env.DataStore.Get(context.Background(), "loki")
+				return err
+			})
+		}()
+
+		select {
+		case err := <-exported:
+			So(err, ShouldBeNil)
+		case <-time.After(5 * time.Second):
+			So("the store calls made by the callback were blocked", ShouldBeEmpty)
+		}
+	})
+}
+
+func TestBaseHandler_UserRoles1(t *testing.T) {
+	Convey("Managing roles with a non admin context or with invalid roles must fail", t, func() {
+		handler := NewAPIHandler()
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "loki")
+		err := handler.SetUserRoles(authenticatedContext, "loki", []Role{RoleAdmin})
+		So(err, ShouldEqual, Forbidden)
+
+		_, err = handler.GetUserRoles(authenticatedContext, "loki")
+		So(err, ShouldEqual, Forbidden)
+
+		adminContext := ContextWithLoggedUser(context.Background(), "admin")
+		err = handler.SetUserRoles(adminContext, "loki", []Role{"superuser"})
+		So(err, ShouldEqual, BadInput)
+
+		err = handler.SetUserRoles(adminContext, "nobody", []Role{RoleAuditor})
+		So(err, ShouldEqual, NotFound)
+
+		roles, err := handler.GetUserRoles(adminContext, "loki")
+		So(err, ShouldBeNil)
+		So(roles, ShouldResemble, []Role{RoleSelf})
+	})
+}
+
+func TestBaseHandler_UserRoles2(t *testing.T) {
+	Convey("The roles set by an admin must restrict or extend the user permissions", t, func() {
+		handler := NewAPIHandler()
+		adminContext := ContextWithLoggedUser(context.Background(), "admin")
+		lokiContext := ContextWithLoggedUser(context.Background(), "loki")
+
+		err := handler.SetUserRoles(adminContext, "loki", []Role{RoleAuditor})
+		So(err, ShouldBeNil)
+
+		_, err = handler.GetUser(lokiContext, "hulk", GetUserOptions{})
+		So(err, ShouldBeNil)
+
+		err = handler.UpdateUser(lokiContext, "hulk", `{"data": "auditor was here"}`, UpdateUserOptions{})
+		So(err, ShouldEqual, NotAuthorized)
+
+		err = handler.UpdateUser(lokiContext, "loki", `{"data": "auditor was here"}`, UpdateUserOptions{})
+		So(err, ShouldEqual, NotAuthorized)
+
+		list, err := handler.GetUserList(lokiContext, ListOptions{Count: 2})
+		So(err, ShouldBeNil)
+		So(list.Total, ShouldBeGreaterThan, 1)
+
+		err = handler.SetUserRoles(adminContext, "loki", []Role{RoleOperator})
+		So(err, ShouldBeNil)
+
+		err = handler.UpdateUser(lokiContext, "hulk", `{"data": "I don't have time to think, all i want to destroy you"}`, UpdateUserOptions{})
+		So(err, ShouldBeNil)
+
+		err = handler.DeleteUser(lokiContext, "hulk")
+		So(err, ShouldEqual, NotAuthorized)
+
+		err = handler.ExportUsers(lokiContext, ExportOptions{}, func(UserData) error { return nil })
+		So(err, ShouldEqual, Forbidden)
+
+		roles, err := handler.GetUserRoles(adminContext, "loki")
+		So(err, ShouldBeNil)
+		So(roles, ShouldResemble, []Role{RoleOperator})
+
+		err = handler.SetUserRoles(adminContext, "loki", nil)
+		So(err, ShouldBeNil)
+
+		_, err = handler.GetUser(lokiContext, "hulk", GetUserOptions{})
+		So(err, ShouldEqual, NotAuthorized)
+	})
+}
+
+func TestBaseHandler_DeleteUser1(t *testing.T) {
+	Convey("Calling DeleteUser with an empty userId must fail", t, func() {
+		handler := NewAPIHandler()
+		err := handler.DeleteUser(context.Background(), "")
+		So(err, ShouldEqual, BadInput)
+	})
+}
+
+func TestBaseHandler_DeleteUser2(t *testing.T) {
+	Convey("Calling DeleteUser with an unauthenticated context must fail", t, func() {
+		handler := NewAPIHandler()
+		err := handler.DeleteUser(context.Background(), "loki")
+		So(err, ShouldEqual, Forbidden)
+	})
+}
+
+func TestBaseHandler_DeleteUser3(t *testing.T) {
+	Convey("Calling DeleteUser with an authenticated context on another user data must fail", t, func() {
+		handler := NewAPIHandler()
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "loki")
+		err := handler.DeleteUser(authenticatedContext, "hulk")
+		So(err, ShouldEqual, NotAuthorized)
+	})
+}
+
+func TestBaseHandler_DeleteUser4(t *testing.T) {
+	Convey("Calling DeleteUser with an authenticated context on owned data must succeed", t, func() {
+		handler := NewAPIHandler()
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "loki")
+		err := handler.DeleteUser(authenticatedContext, "loki")
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestBaseHandler_DeleteUser5(t *testing.T) {
+	Convey("Calling DeleteUser with an admin context must succeed", t, func() {
+		handler := NewAPIHandler()
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "admin")
+		err := handler.DeleteUser(authenticatedContext, "hulk")
+		So(err, ShouldBeNil)
+	})
+}
+
+// _testWrappingDataStore wraps the errors of the store it embeds
+type _testWrappingDataStore struct {
+	UserDataStore
+}
+
+func (s *_testWrappingDataStore) Get(ctx context.Context, id string) (UserData, error) {
+	data, err := s.UserDataStore.Get(ctx, id)
+	if err != nil {
+		return "", fmt.Errorf("getting user '%s': %w", id, err)
+	}
+	return data, nil
+}
+
+func (s *_testWrappingDataStore) DeleteSession(ctx context.Context, id string) error {
+	err := s.UserDataStore.DeleteSession(ctx, id)
+	if err != nil {
+		return fmt.Errorf("deleting session '%s': %w", id, err)
+	}
+	return nil
+}
+
+func TestBaseHandler_WrappedErrors(t *testing.T) {
+	Convey("The errors wrapped by the store must be handled as their kind", t, func() {
+		store := Env.DataStore
+		Env.DataStore = &_testWrappingDataStore{UserDataStore: store}
+		defer func() {
+			Env.DataStore = store
+		}()
+
+		handler := NewAPIHandler()
+		err := handler.Logout(ContextWithSessionId(ContextWithLoggedUser(context.Background(), "loki"), "unknown-session"))
+		So(err, ShouldBeNil)
+
+		ok, err := handler.Login(context.Background(), "nobody", "nobody-pass")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+
+		adminContext := ContextWithLoggedUser(context.Background(), "admin")
+		_, err = handler.AddUsers(adminContext, bytes.NewBufferString(`[{"id": "baldr", "password": "baldr-pass"}]`), AddUsersOptions{})
+		So(err, ShouldBeNil)
+
+		report, err := handler.AddUsers(adminContext, bytes.NewBufferString(`[{"id": "baldr", "password": "baldr-pass"}]`), AddUsersOptions{OnConflict: ConflictPolicySkip})
+		So(err, ShouldBeNil)
+		So(report.Skipped, ShouldEqual, 1)
+
+		So(errors.Is(&QueryError{}, newError(BadInput, "invalid expression", nil)), ShouldBeTrue)
+	})
+}
+
+func TestBaseHandler_Sessions1(t *testing.T) {
+	Convey("Listing and revoking sessions must be reserved to admins", t, func() {
+		handler := NewAPIHandler()
+		adminContext := ContextWithLoggedUser(context.Background(), "admin")
+
+		_, err := handler.AddUsers(adminContext, bytes.NewBufferString(`[{"id": "tyr", "password": "tyr-pass"}]`), AddUsersOptions{})
+		So(err, ShouldBeNil)
+
+		first, err := createSession(context.Background(), "tyr")
+		So(err, ShouldBeNil)
+		second, err := createSession(context.Background(), "tyr")
+		So(err, ShouldBeNil)
+
+		userContext := ContextWithLoggedUser(context.Background(), "tyr")
+		_, err = handler.ListUserSessions(userContext, "tyr")
+		So(err, ShouldEqual, Forbidden)
+
+		err = handler.RevokeUserSessions(userContext, "tyr")
+		So(err, ShouldEqual, Forbidden)
+
+		sessions, err := handler.ListUserSessions(adminContext, "tyr")
+		So(err, ShouldBeNil)
+		So(sessions, ShouldHaveLength, 2)
+
+		err = handler.RevokeSession(adminContext, "admin", first.Id)
+		So(err, ShouldEqual, NotFound)
+
+		err = handler.RevokeSession(adminContext, "tyr", first.Id)
+		So(err, ShouldBeNil)
+
+		sessions, err = handler.ListUserSessions(adminContext, "tyr")
+		So(err, ShouldBeNil)
+		So(sessions, ShouldHaveLength, 1)
+		So(sessions[0].Id, ShouldEqual, second.Id)
+
+		err = handler.RevokeUserSessions(adminContext, "tyr")
+		So(err, ShouldBeNil)
+
+		sessions, err = handler.ListUserSessions(adminContext, "tyr")
+		So(err, ShouldBeNil)
+		So(sessions, ShouldBeEmpty)
+	})
+}
+
+func TestBaseHandler_Sessions2(t *testing.T) {
+	Convey("Logging out, changing password and deleting the user must revoke sessions", t, func() {
+		handler := NewAPIHandler()
+		adminContext := ContextWithLoggedUser(context.Background(), "admin")
+
+		session, err := createSession(context.Background(), "tyr")
+		So(err, ShouldBeNil)
+
+		err = handler.Logout(context.Background())
+		So(err, ShouldEqual, Forbidden)
+
+		err = handler.Logout(ContextWithSessionId(ContextWithLoggedUser(context.Background(), "tyr"), session.Id))
+		So(err, ShouldBeNil)
+
+		_, err = Env.DataStore.GetSession(context.Background(), session.Id)
+		So(err, ShouldEqual, NotFound)
+
+		_, err = createSession(context.Background(), "tyr")
+		So(err, ShouldBeNil)
+
+		err = handler.UpdateUser(adminContext, "tyr", `{"data": "no password change"}`, UpdateUserOptions{})
+		So(err, ShouldBeNil)
+
+		sessions, err := handler.ListUserSessions(adminContext, "tyr")
+		So(err, ShouldBeNil)
+		So(sessions, ShouldHaveLength, 1)
+
+		err = handler.UpdateUser(adminContext, "tyr", `{"password": "tyr-new-pass"}`, UpdateUserOptions{})
+		So(err, ShouldBeNil)
+
+		sessions, err = handler.ListUserSessions(adminContext, "tyr")
+		So(err, ShouldBeNil)
+		So(sessions, ShouldBeEmpty)
+
+		_, err = createSession(context.Background(), "tyr")
+		So(err, ShouldBeNil)
+
+		err = handler.DeleteUser(adminContext, "tyr")
+		So(err, ShouldBeNil)
+
+		sessions, err = handler.ListUserSessions(adminContext, "tyr")
+		So(err, ShouldBeNil)
+		So(sessions, ShouldBeEmpty)
+	})
+}
+
+func TestBaseHandler_Sessions3(t *testing.T) {
+	Convey("Sessions must expire after the idle or the absolute timeout", t, func() {
+		ctx := context.Background()
+		idleTimeout, maxAge := Env.SessionIdleTimeout, Env.SessionMaxAge
+		defer func() {
+			Env.SessionIdleTimeout, Env.SessionMaxAge = idleTimeout, maxAge
+		}()
+		Env.SessionIdleTimeout = time.Minute
+		Env.SessionMaxAge = time.Hour
+
+		session, err := createSession(ctx, "vidar")
+		So(err, ShouldBeNil)
+
+		_, err = resumeSession(ctx, session.Id, "loki")
+		So(err, ShouldEqual, NotFound)
+
+		resumed, err := resumeSession(ctx, session.Id, "vidar")
+		So(err, ShouldBeNil)
+		So(resumed.LastSeenAt.Before(session.LastSeenAt), ShouldBeFalse)
+
+		session.LastSeenAt = time.Now().Add(-2 * time.Minute)
+		So(Env.DataStore.SaveSession(ctx, session), ShouldBeNil)
+		_, err = resumeSession(ctx, session.Id, "vidar")
+		So(err, ShouldEqual, NotFound)
+
+		_, err = Env.DataStore.GetSession(ctx, session.Id)
+		So(err, ShouldEqual, NotFound)
+
+		session, err = createSession(ctx, "vidar")
+		So(err, ShouldBeNil)
+		session.CreatedAt = time.Now().Add(-2 * time.Hour)
+		So(Env.DataStore.SaveSession(ctx, session), ShouldBeNil)
+		_, err = resumeSession(ctx, session.Id, "vidar")
+		So(err, ShouldEqual, NotFound)
+	})
+}
+
+// _testRevokingDataStore revokes the sessions right after they are loaded, as a concurrent revocation would
+type _testRevokingDataStore struct {
+	UserDataStore
+}
+
+func (s *_testRevokingDataStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	session, err := s.UserDataStore.GetSession(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return session, s.UserDataStore.DeleteSession(ctx, id)
+}
+
+func TestBaseHandler_Sessions4(t *testing.T) {
+	Convey("A session revoked while it is being resumed must stay revoked", t, func() {
+		ctx := context.Background()
+		session, err := createSession(ctx, "vidar")
+		So(err, ShouldBeNil)
+
+		store := Env.DataStore
+		Env.DataStore = &_testRevokingDataStore{UserDataStore: store}
+		_, err = resumeSession(ctx, session.Id, "vidar")
+		Env.DataStore = store
+		So(err, ShouldEqual, NotFound)
+
+		_, err = Env.DataStore.GetSession(ctx, session.Id)
+		So(err, ShouldEqual, NotFound)
+	})
+}
+
+func TestBaseHandler_APIKeys1(t *testing.T) {
+	Convey("API keys must be managed by their owner or an admin", t, func() {
+		handler := NewAPIHandler()
+		adminContext := ContextWithLoggedUser(context.Background(), "admin")
+		userContext := ContextWithLoggedUser(context.Background(), "sif")
+
+		_, err := handler.CreateAPIKey(userContext, "sif", "backup", nil)
+		So(err, ShouldEqual, BadInput)
+
+		_, err = handler.CreateAPIKey(userContext, "sif", "backup", []Permission{"users:everything"})
+		So(err, ShouldEqual, BadInput)
+
+		_, err = handler.CreateAPIKey(userContext, "odin", "backup", []Permission{PermissionReadSelf})
+		So(err, ShouldEqual, NotAuthorized)
+
+		_, err = handler.CreateAPIKey(adminContext, "nobody", "backup", []Permission{PermissionReadSelf})
+		So(err, ShouldEqual, NotFound)
+
+		key, err := handler.CreateAPIKey(userContext, "sif", "backup", []Permission{PermissionReadSelf})
+		So(err, ShouldBeNil)
+		So(key.Secret, ShouldStartWith, apiKeyPrefix)
+
+		authenticated, err := authenticateAPIKey(context.Background(), key.Secret)
+		So(err, ShouldBeNil)
+		So(authenticated.User, ShouldEqual, "sif")
+
+		_, err = authenticateAPIKey(context.Background(), key.Secret+"0")
+		So(err, ShouldEqual, NotAuthorized)
+
+		keys, err := handler.ListAPIKeys(adminContext, "sif")
+		So(err, ShouldBeNil)
+		So(keys, ShouldHaveLength, 1)
+		So(keys[0].Secret, ShouldBeEmpty)
+		So(keys[0].Scopes, ShouldResemble, []Permission{PermissionReadSelf})
+
+		err = handler.DeleteAPIKey(adminContext, "odin", key.Id)
+		So(err, ShouldEqual, NotFound)
+
+		err = handler.DeleteAPIKey(userContext, "sif", key.Id)
+		So(err, ShouldBeNil)
+
+		_, err = authenticateAPIKey(context.Background(), key.Secret)
+		So(err, ShouldEqual, NotAuthorized)
+	})
+}
+
+func TestBaseHandler_APIKeys2(t *testing.T) {
+	Convey("The permissions of an API key user must be restricted to the key scopes", t, func() {
+		handler := NewAPIHandler()
+		scopedContext := ContextWithLoggedUserScopes(ContextWithLoggedUser(context.Background(), "admin"), []Permission{PermissionReadAll})
+
+		_, err := handler.GetUser(scopedContext, "sif", GetUserOptions{})
+		So(err, ShouldBeNil)
+
+		err = handler.UpdateUser(scopedContext, "sif", `{"data": "scoped"}`, UpdateUserOptions{})
+		So(err, ShouldEqual, NotAuthorized)
+
+		_, err = handler.GetUserRoles(scopedContext, "sif")
+		So(err, ShouldEqual, Forbidden)
+
+		// A scope cannot grant what the roles do not
+		scopedContext = ContextWithLoggedUserScopes(ContextWithLoggedUser(context.Background(), "sif"), []Permission{PermissionReadAll})
+		_, err = handler.GetUser(scopedContext, "odin", GetUserOptions{})
+		So(err, ShouldEqual, NotAuthorized)
+
+		// A scope on all the users implies the same scope on one's own user
+		_, err = handler.GetUser(scopedContext, "sif", GetUserOptions{})
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestBaseHandler_LoginThrottle1(t *testing.T) {
+	Convey("An account must be locked after too many login failures until an admin unlocks it", t, func() {
+		handler := NewAPIHandler()
+
+		for i := 0; i < DefaultLoginThrottlePolicy.MaxAccountFailures; i++ {
+			ok, err := handler.Login(context.Background(), "sif", "wrong")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		}
+
+		ok, err := handler.Login(context.Background(), "sif", "sword")
+		So(ok, ShouldBeFalse)
+		So(errors.Is(err, TooManyAttempts), ShouldBeTrue)
+
+		var lockout *LockoutError
+		So(errors.As(err, &lockout), ShouldBeTrue)
+		So(lockout.RetryAfter(time.Now()), ShouldBeGreaterThan, 0)
+
+		err = handler.UnlockUser(ContextWithLoggedUser(context.Background(), "sif"), "sif")
+		So(err, ShouldEqual, Forbidden)
+
+		err = handler.UnlockUser(ContextWithLoggedUser(context.Background(), "admin"), "sif")
+		So(err, ShouldBeNil)
+
+		ok, err = handler.Login(context.Background(), "sif", "sword")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+	})
+}
+
+func TestBaseHandler_LoginThrottle2(t *testing.T) {
+	Convey("A client address must be locked after too many login failures on any account", t, func() {
+		handler := NewAPIHandler()
+		Env.LoginThrottlePolicy = &LoginThrottlePolicy{MaxAccountFailures: 5, MaxAddressFailures: 2, BaseLockout: time.Minute, MaxLockout: time.Hour, Window: time.Hour}
+		defer func() {
+			Env.LoginThrottlePolicy = nil
+		}()
+
+		ctx := ContextWithClientAddress(context.Background(), "198.51.100.7")
+		_, err := handler.Login(ctx, "bragi", "wrong")
+		So(err, ShouldBeNil)
+		_, err = handler.Login(ctx, "idun", "wrong")
+		So(err, ShouldBeNil)
+
+		_, err = handler.Login(ctx, "sif", "sword")
+		So(errors.Is(err, TooManyAttempts), ShouldBeTrue)
+
+		ok, err := handler.Login(ContextWithClientAddress(context.Background(), "198.51.100.8"), "sif", "sword")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+	})
+}
+
+func TestBaseHandler_PasswordPolicy1(t *testing.T) {
+	Convey("Calling AddUsers must reject the users whose password does not comply with the policy", t, func() {
+		handler := NewAPIHandler()
+		Env.PasswordPolicy = &PasswordPolicy{MinLength: 8, MinCharacterClasses: 2, Breached: map[string]bool{"password123": true}}
+		defer func() {
+			Env.PasswordPolicy = nil
+		}()
+
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "admin")
+		userDataStream := `
+			[
+				{"id": "hoenir", "password": "abc", "data": "lorem ipsum"},
+				{"id": "mimir", "password": "password123", "data": "lorem ipsum"},
+				{"id": "ullr", "password": "onlylowercase", "data": "lorem ipsum"},
+				{"id": "vidar", "password": "vidar-pass-1", "data": "lorem ipsum"}
+			]
+		`
+		report, err := handler.AddUsers(authenticatedContext, bytes.NewBufferString(userDataStream), AddUsersOptions{})
+		So(err, ShouldBeNil)
+		So(report.Accepted, ShouldEqual, 1)
+		So(report.Rejected, ShouldEqual, 3)
+		So(report.Failures[0].UserId, ShouldEqual, "hoenir")
+		So(report.Failures[1].UserId, ShouldEqual, "mimir")
+		So(report.Failures[2].UserId, ShouldEqual, "ullr")
+
+		_, err = handler.GetUser(authenticatedContext, "hoenir", GetUserOptions{})
+		So(err, ShouldEqual, NotFound)
+
+		ok, err := handler.Login(context.Background(), "vidar", "vidar-pass-1")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+	})
+}
+
+func TestBaseHandler_PasswordPolicy2(t *testing.T) {
+	Convey("Calling UpdateUser with a password that does not comply with the policy must fail", t, func() {
+		handler := NewAPIHandler()
+		Env.PasswordPolicy = &PasswordPolicy{MinLength: 8}
+		defer func() {
+			Env.PasswordPolicy = nil
+		}()
+
+		authenticatedContext := ContextWithLoggedUser(context.Background(), "vidar")
+		err := handler.UpdateUser(authenticatedContext, "vidar", `{"password": "short"}`, UpdateUserOptions{})
+		So(errors.Is(err, BadInput), ShouldBeTrue)
+
+		ok, err := handler.Login(context.Background(), "vidar", "vidar-pass-1")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		err = handler.UpdateUser(authenticatedContext, "vidar", `{"data": "dolor sit amet"}`, UpdateUserOptions{})
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestBaseHandler_PasswordHashUpgrade(t *testing.T) {
+	Convey("Login must transparently rehash the password when the hashing configuration changed", t, func() {
+		ctx := context.Background()
+		handler := NewAPIHandler()
+		defer func() {
+			Env.PasswordHashing = nil
+		}()
+
+		userData, err := Env.DataStore.Get(ctx, "vidar")
+		So(err, ShouldBeNil)
+		So(userData.Password(), ShouldStartWith, "$2")
+		data := userData.Data()
+
+		Env.PasswordHashing = &PasswordHashing{Algorithm: PasswordHashArgon2id, Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1}
+		ok, err := handler.Login(ctx, "vidar", "vidar-pass-1")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		userData, err = Env.DataStore.Get(ctx, "vidar")
+		So(err, ShouldBeNil)
+		So(userData.Password(), ShouldStartWith, "$argon2id$")
+		So(userData.Data(), ShouldEqual, data)
+
+		ok, err = handler.Login(ctx, "vidar", "vidar-pass-1")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		ok, err = handler.Login(ctx, "vidar", "wrong")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+
+		Env.PasswordHashing = &PasswordHashing{Algorithm: PasswordHashBcrypt, BcryptCost: 4}
+		ok, err = handler.Login(ctx, "vidar", "vidar-pass-1")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		userData, err = Env.DataStore.Get(ctx, "vidar")
+		So(err, ShouldBeNil)
+		So(userData.Password(), ShouldStartWith, "$2a$04$")
+	})
+}
+
+func TestBaseHandler_SensitiveFields1(t *testing.T) {
+	Convey("The sensitive fields must only be returned to the admins who explicitly ask for them", t, func() {
+		handler := NewAPIHandler()
+		adminContext := ContextWithLoggedUser(context.Background(), "admin")
+		userContext := ContextWithLoggedUser(context.Background(), "vidar")
+
+		userData, err := handler.GetUser(adminContext, "vidar", GetUserOptions{})
+		So(err, ShouldBeNil)
+		So(userData.Id(), ShouldEqual, "vidar")
+		So(userData.Password(), ShouldBeEmpty)
+
+		userData, err = handler.GetUser(adminContext, "vidar", GetUserOptions{IncludeSecrets: true})
+		So(err, ShouldBeNil)
+		So(userData.Password(), ShouldNotBeEmpty)
+
+		_, err = handler.GetUser(userContext, "vidar", GetUserOptions{IncludeSecrets: true})
+		So(err, ShouldEqual, Forbidden)
+
+		list, err := handler.GetUserList(adminContext, ListOptions{Count: 5})
+		So(err, ShouldBeNil)
+		So(list.UserDataList, ShouldNotBeEmpty)
+		for _, user := range list.UserDataList {
+			So(user.Password(), ShouldBeEmpty)
+		}
+
+		list, err = handler.GetUserList(adminContext, ListOptions{Count: 5, Fields: "id,password"})
+		So(err, ShouldBeNil)
+		for _, user := range list.UserDataList {
+			So(user.Password(), ShouldBeEmpty)
+		}
+
+		list, err = handler.GetUserList(adminContext, ListOptions{Count: 5, IncludeSecrets: true})
+		So(err, ShouldBeNil)
+		for _, user := range list.UserDataList {
+			So(user.Password(), ShouldNotBeEmpty)
+		}
+
+		_, err = handler.GetUserList(userContext, ListOptions{Count: 5, IncludeSecrets: true})
+		So(err, ShouldEqual, Forbidden)
+	})
+}
+
+func TestBaseHandler_SensitiveFields3(t *testing.T) {
+	Convey("The sensitive fields must not be filtered or sorted by the callers who cannot read them", t, func() {
+		handler := NewAPIHandler()
+		adminContext := ContextWithLoggedUser(context.Background(), "admin")
+		auditorContext := ContextWithLoggedUserRoles(ContextWithLoggedUser(context.Background(), "loki"), []Role{RoleAuditor})
+		Env.SensitiveFields = []string{"password", "profile.ssn"}
+		defer func() {
+			Env.SensitiveFields = nil
+		}()
+
+		for _, opts := range []ListOptions{
+			{Count: 5, Filter: "profile.ssn^=1"},
+			{Count: 5, Filter: "id^=v,profile==null"},
+			{Count: 5, Sort: "-profile.ssn"},
+			{Count: 5, Sort: "profile"},
+		} {
+			_, err := handler.GetUserList(auditorContext, opts)
+			So(errors.Is(err, BadInput), ShouldBeTrue)
+			So(statusFromError(err), ShouldEqual, http.StatusBadRequest)
+
+			var queryError *QueryError
+			So(errors.As(err, &queryError), ShouldBeTrue)
+			So(queryError.Message, ShouldContainSubstring, string(PermissionReadSecrets))
+
+			_, err = handler.GetUserList(adminContext, opts)
+			So(err, ShouldBeNil)
+		}
+
+		_, err := handler.GetUserList(auditorContext, ListOptions{Count: 5, Filter: "profile.city==Paris", Sort: "profile.ssnless"})
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestBaseHandler_SensitiveFields2(t *testing.T) {
+	Convey("The configured sensitive fields must be removed from every read user, exported ones included", t, func() {
+		handler := NewAPIHandler()
+		adminContext := ContextWithLoggedUser(context.Background(), "admin")
+		Env.SensitiveFields = []string{"password", "data"}
+		defer func() {
+			Env.SensitiveFields = nil
+		}()
+
+		userData, err := handler.GetUser(adminContext, "vidar", GetUserOptions{})
+		So(err, ShouldBeNil)
+		So(userData.Id(), ShouldEqual, "vidar")
+		So(userData.Data(), ShouldBeEmpty)
+		So(userData.Password(), ShouldBeEmpty)
+
+		exported := 0
+		err = handler.ExportUsers(adminContext, ExportOptions{}, func(user UserData) error {
+			exported++
+			So(user.Id(), ShouldNotBeEmpty)
+			So(user.Data(), ShouldBeEmpty)
+			So(user.Password(), ShouldBeEmpty)
+			return nil
+		})
+		So(err, ShouldBeNil)
+		So(exported, ShouldBeGreaterThan, 0)
+
+		userData, err = handler.GetUser(adminContext, "vidar", GetUserOptions{IncludeSecrets: true})
 		So(err, ShouldBeNil)
+		So(userData.Data(), ShouldNotBeEmpty)
 	})
 }
@@ -1,9 +1,15 @@
 package ditt
 
 import (
-	"log"
+	"context"
+	"errors"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/gorilla/mux"
 )
 
 type statusCatcher struct {
@@ -16,6 +22,50 @@ func (catcher *statusCatcher) WriteHeader(statusCode int) {
 	catcher.ResponseWriter.WriteHeader(statusCode)
 }
 
+// Flush forwards the flush to the wrapped writer so that streamed responses are not held back
+func (catcher *statusCatcher) Flush() {
+	if flusher, ok := catcher.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+const (
+	requestIdHeader    = "X-Request-ID"
+	maxRequestIdLength = 128
+)
+
+// requestIdHttpMiddleware sets the request id in the context and in the response headers. The id sent by the client
+// in the "X-Request-ID" header is kept if it is made of at most 128 printable ASCII characters. Otherwise a new one is generated
+func requestIdHttpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(requestIdHeader)
+		if !validRequestId(requestId) {
+			var err error
+			requestId, err = randomHex(16)
+			if err != nil {
+				Env.Logger.Error("request id generation failed", "error", err)
+				writeHttpError(w, r, Internal)
+				return
+			}
+		}
+
+		w.Header().Set(requestIdHeader, requestId)
+		next.ServeHTTP(w, r.WithContext(ContextWithRequestId(r.Context(), requestId)))
+	})
+}
+
+func validRequestId(requestId string) bool {
+	if requestId == "" || len(requestId) > maxRequestIdLength {
+		return false
+	}
+	for _, c := range requestId {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
 func loggerHttpMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -26,23 +76,151 @@ func loggerHttpMiddleware(next http.Handler) http.Handler {
 
 		next.ServeHTTP(c, r)
 
-		duration := time.Since(start)
-		log.Printf("%s %s %s %s\n", r.Method, r.RequestURI, http.StatusText(c.status), duration)
+		// The status is implicit if the handler only wrote a body
+		status := c.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		Env.Logger.WithContext(r.Context()).Info("http request",
+			"method", r.Method,
+			"uri", r.RequestURI,
+			"status", status,
+			"duration", time.Since(start),
+		)
+	})
+}
+
+// metricsHttpMiddleware counts the requests and records their duration by route name. It is meant to be used by the
+// router so that the matched route is known. The requests that match no route are labeled "unmatched"
+func metricsHttpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		c := &statusCatcher{
+			status:         0,
+			ResponseWriter: w,
+		}
+
+		next.ServeHTTP(c, r)
+
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil && current.GetName() != "" {
+			route = current.GetName()
+		}
+		status := c.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		metrics.httpRequests.Inc(route, strconv.Itoa(status))
+		metrics.httpRequestDuration.Observe(time.Since(start).Seconds(), route)
 	})
 }
 
 const (
 	sessionName          = "auth-session"
 	sessionLoggedUserKey = "logged-user"
+	sessionIdKey         = "session-id"
 )
 
+// sessionHttpMiddleware authenticates the requests that hold an "Authorization: Bearer" header or whose cookie refers to a registered session.
+// Requests with an invalid bearer credential are rejected. The cookies of revoked or expired sessions are cleared
+// and the requests are handled as anonymous. The client address is set in the context of all the requests
 func sessionHttpMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(ContextWithClientAddress(r.Context(), clientAddress(r)))
+
+		if credential, found := bearerCredential(r); found {
+			ctx, err := bearerContext(r.Context(), credential)
+			if err != nil {
+				if errors.Is(err, NotAuthorized) {
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				}
+				writeHttpError(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		session, _ := Env.CookiesStore.Get(r, sessionName)
-		value, exists := session.Values[sessionLoggedUserKey]
-		if exists {
-			r = r.WithContext(ContextWithLoggedUser(r.Context(), value.(string)))
+		loggedUser, _ := session.Values[sessionLoggedUserKey].(string)
+		sessionId, _ := session.Values[sessionIdKey].(string)
+
+		if loggedUser != "" {
+			registered, err := resumeSession(r.Context(), sessionId, loggedUser)
+			if err != nil {
+				if !errors.Is(err, NotFound) {
+					writeHttpError(w, r, err)
+					return
+				}
+				clearHttpSession(w, r)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := ContextWithSessionId(r.Context(), registered.Id)
+			r = r.WithContext(contextWithAuthenticatedUser(ctx, loggedUser))
 		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// bearerCredential extracts the credential of the "Authorization: Bearer" header
+func bearerCredential(r *http.Request) (string, bool) {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(authorization[7:]), true
+}
+
+// bearerContext authenticates the API key or the access token. The permissions of an API key user are restricted to its scopes
+func bearerContext(ctx context.Context, credential string) (context.Context, error) {
+	if isAPIKey(credential) {
+		key, err := authenticateAPIKey(ctx, credential)
+		if err != nil {
+			return nil, err
+		}
+		ctx = ContextWithLoggedUserScopes(ctx, key.Scopes)
+		return contextWithAuthenticatedUser(ctx, key.User), nil
+	}
+
+	session, err := resumeTokenSession(ctx, credential, tokenUseAccess)
+	if err != nil {
+		return nil, err
+	}
+	ctx = ContextWithSessionId(ctx, session.Id)
+	return contextWithAuthenticatedUser(ctx, session.User), nil
+}
+
+// contextWithAuthenticatedUser sets the logged user and its roles in the context
+func contextWithAuthenticatedUser(ctx context.Context, loggedUser string) context.Context {
+	ctx = ContextWithLoggedUser(ctx, loggedUser)
+
+	roles, err := getUserRoles(ctx, loggedUser)
+	if err != nil {
+		Env.Logger.WithContext(ctx).Error("roles loading failed", "user", loggedUser, "error", err)
+		return ctx
+	}
+	return ContextWithLoggedUserRoles(ctx, roles)
+}
+
+// clearHttpSession expires the session cookie
+func clearHttpSession(w http.ResponseWriter, r *http.Request) {
+	session, _ := Env.CookiesStore.Get(r, sessionName)
+	delete(session.Values, sessionLoggedUserKey)
+	delete(session.Values, sessionIdKey)
+	session.Options.MaxAge = -1
+	err := session.Save(r, w)
+	if err != nil {
+		Env.Logger.WithContext(r.Context()).Error("session clearing failed", "error", err)
+	}
+}
+
+// clientAddress returns the host part of the request remote address
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -1,23 +1,54 @@
 package ditt
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/omecodes/ditt/info"
 	"io"
-	"log"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
-	endpointVarId    = "id"
-	queryParamOffset = "offset"
-	queryParamCount  = "count"
+	endpointVarId        = "id"
+	endpointVarSessionId = "session"
+	endpointVarKeyId     = "key"
+	queryParamOffset     = "offset"
+	queryParamCount      = "count"
+	queryParamCursor     = "cursor"
+	queryParamFilter     = "filter"
+	queryParamSort       = "sort"
+	queryParamFields     = "fields"
+
+	queryParamIncludeSecrets = "include_secrets"
+
+	queryParamOnConflict        = "on_conflict"
+	queryParamCSVIdColumn       = "csv_id"
+	queryParamCSVPasswordColumn = "csv_password"
+	queryParamCSVDataColumn     = "csv_data"
+
+	queryParamFormat           = "format"
+	queryParamIncludePasswords = "include_passwords"
+
+	exportFlushInterval = 100
 
 	// LoginEndpoint is the HTTP API endpoint to initialise an authenticated session
 	LoginEndpoint = "/login"
 
+	// LogoutEndpoint is the HTTP API endpoint to revoke the authenticated session
+	LogoutEndpoint = "/logout"
+
+	// TokenEndpoint is the HTTP API endpoint to get an access token and a refresh token
+	TokenEndpoint = "/token"
+
 	// AddUsersEndpoint is the HTTP API endpoint to add users
 	AddUsersEndpoint = "/add/users"
 
@@ -32,8 +63,65 @@ const (
 
 	// UpdateUserEndpoint is the HTTP API endpoint to add users
 	UpdateUserEndpoint = "/user/{id}"
+
+	// StartImportJobEndpoint is the HTTP API endpoint to add users asynchronously
+	StartImportJobEndpoint = "/import/jobs"
+
+	// GetImportJobEndpoint is the HTTP API endpoint to get the state of an import job
+	GetImportJobEndpoint = "/import/jobs/{id}"
+
+	// GetImportJobFailuresEndpoint is the HTTP API endpoint to get the users an import job could not add
+	GetImportJobFailuresEndpoint = "/import/jobs/{id}/failures"
+
+	// CancelImportJobEndpoint is the HTTP API endpoint to cancel an import job
+	CancelImportJobEndpoint = "/import/jobs/{id}"
+
+	// ExportUsersEndpoint is the HTTP API endpoint to download all the users
+	ExportUsersEndpoint = "/export/users"
+
+	// GetUserRolesEndpoint is the HTTP API endpoint to get the roles of a user
+	GetUserRolesEndpoint = "/user/{id}/roles"
+
+	// SetUserRolesEndpoint is the HTTP API endpoint to replace the roles of a user
+	SetUserRolesEndpoint = "/user/{id}/roles"
+
+	// ListUserSessionsEndpoint is the HTTP API endpoint to list the active sessions of a user
+	ListUserSessionsEndpoint = "/user/{id}/sessions"
+
+	// RevokeUserSessionsEndpoint is the HTTP API endpoint to revoke all the sessions of a user
+	RevokeUserSessionsEndpoint = "/user/{id}/sessions"
+
+	// RevokeSessionEndpoint is the HTTP API endpoint to revoke one session of a user
+	RevokeSessionEndpoint = "/user/{id}/sessions/{session}"
+
+	// CreateAPIKeyEndpoint is the HTTP API endpoint to create an API key for a user
+	CreateAPIKeyEndpoint = "/user/{id}/keys"
+
+	// ListAPIKeysEndpoint is the HTTP API endpoint to list the API keys of a user
+	ListAPIKeysEndpoint = "/user/{id}/keys"
+
+	// DeleteAPIKeyEndpoint is the HTTP API endpoint to delete an API key of a user
+	DeleteAPIKeyEndpoint = "/user/{id}/keys/{key}"
+
+	// UnlockUserEndpoint is the HTTP API endpoint to clear the login failures of an account
+	UnlockUserEndpoint = "/user/{id}/unlock"
+
+	// MetricsEndpoint is the HTTP endpoint that exposes the server metrics in the Prometheus text format. It is only served on the admin port
+	MetricsEndpoint = "/metrics"
+
+	// HealthEndpoint is the HTTP endpoint that tells whether the process is up
+	HealthEndpoint = "/healthz"
+
+	// ReadinessEndpoint is the HTTP endpoint that tells whether the storage backends can be reached
+	ReadinessEndpoint = "/readyz"
+
+	// VersionEndpoint is the HTTP endpoint that returns the build info
+	VersionEndpoint = "/version"
 )
 
+// readinessCheckTimeout bounds the duration of the storage backends health checks
+const readinessCheckTimeout = 5 * time.Second
+
 // HandleHttpLoginRequest initializes an APIHandler and calls its APIHandler.Login method
 // with user credentials parsed from the request body
 func HandleHttpLoginRequest(w http.ResponseWriter, r *http.Request) {
@@ -50,16 +138,14 @@ func HandleHttpLoginRequest(w http.ResponseWriter, r *http.Request) {
 
 		err := json.NewDecoder(r.Body).Decode(&credentials)
 		if err != nil {
-			log.Println("credentials parsing:", err)
-			w.WriteHeader(http.StatusBadRequest)
+			writeHttpError(w, r, newError(BadInput, "expected a JSON object with a login and a password", nil))
 			return
 		}
 
 	case "x-www-form-urlencoded":
 		err := r.ParseForm()
 		if err != nil {
-			log.Println("credentials parsing:", err)
-			w.WriteHeader(http.StatusBadRequest)
+			writeHttpError(w, r, newError(BadInput, "malformed form", nil))
 			return
 		}
 		credentials.Login = r.Form.Get("login")
@@ -68,8 +154,7 @@ func HandleHttpLoginRequest(w http.ResponseWriter, r *http.Request) {
 	case "multipart/form-data":
 		err := r.ParseMultipartForm(-1)
 		if err != nil {
-			log.Println("credentials parsing:", err)
-			w.WriteHeader(http.StatusBadRequest)
+			writeHttpError(w, r, newError(BadInput, "malformed form", nil))
 			return
 		}
 		credentials.Login = r.MultipartForm.Value["login"][0]
@@ -78,65 +163,220 @@ func HandleHttpLoginRequest(w http.ResponseWriter, r *http.Request) {
 
 	ok, err := api.Login(r.Context(), credentials.Login, credentials.Password)
 	if err != nil {
-		w.WriteHeader(statusFromError(err))
+		writeHttpError(w, r, err)
 		return
 	}
 
 	if !ok {
-		w.WriteHeader(http.StatusForbidden)
+		writeHttpError(w, r, newError(Forbidden, "wrong login or password", nil))
+		return
+	}
+
+	registered, err := createSession(r.Context(), credentials.Login)
+	if err != nil {
+		writeHttpError(w, r, err)
 		return
 	}
 
 	session, _ := Env.CookiesStore.Get(r, sessionName)
 	session.Values[sessionLoggedUserKey] = credentials.Login
+	session.Values[sessionIdKey] = registered.Id
+	if Env.SessionMaxAge > 0 {
+		session.Options.MaxAge = int(Env.SessionMaxAge.Seconds())
+	}
 	err = session.Save(r, w)
 	if err != nil {
-		log.Println("session saving:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeHttpError(w, r, err)
 		return
 	}
 }
 
-// HandleHttpAddUsersRequest initializes an APIHandler and calls its APIHandler.AddUsers with the request body content
-// The request body content is expected to be an encoded JSON object list
-func HandleHttpAddUsersRequest(w http.ResponseWriter, r *http.Request) {
+// HandleHttpTokenRequest issues an access token and a refresh token. The request body is a JSON object or a form holding a "grant_type":
+// "password" along with a "login" and a "password" verified with APIHandler.Login, or "refresh_token" along with a "refresh_token"
+// previously issued. The response body is the TokenPair encoded as JSON
+func HandleHttpTokenRequest(w http.ResponseWriter, r *http.Request) {
+	var request = &struct {
+		GrantType    string `json:"grant_type"`
+		Login        string `json:"login"`
+		Password     string `json:"password"`
+		RefreshToken string `json:"refresh_token"`
+	}{}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType == "application/x-www-form-urlencoded" {
+		err := r.ParseForm()
+		if err != nil {
+			writeHttpError(w, r, newError(BadInput, "malformed form", nil))
+			return
+		}
+		request.GrantType = r.PostForm.Get("grant_type")
+		request.Login = r.PostForm.Get("login")
+		request.Password = r.PostForm.Get("password")
+		request.RefreshToken = r.PostForm.Get("refresh_token")
+	} else {
+		err := json.NewDecoder(r.Body).Decode(request)
+		if err != nil {
+			writeHttpError(w, r, newError(BadInput, "expected a JSON object", nil))
+			return
+		}
+	}
 
 	var (
-		err     error
-		content io.Reader
+		tokens *TokenPair
+		err    error
 	)
-	api := NewAPIHandler()
 
-	contentType := r.Header.Get("Content-Type")
-	switch contentType {
-	case "multipart/form-data":
-		err := r.ParseMultipartForm(-1)
-		if err != nil {
-			log.Println("credentials parsing:", err)
-			w.WriteHeader(http.StatusBadRequest)
+	switch request.GrantType {
+	case "password":
+		api := NewAPIHandler()
+		ok, loginErr := api.Login(r.Context(), request.Login, request.Password)
+		if loginErr != nil {
+			writeHttpError(w, r, loginErr)
 			return
 		}
 
-		fh := r.MultipartForm.File["file"][0]
-		file, err := fh.Open()
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		if !ok {
+			writeHttpError(w, r, newError(Forbidden, "wrong login or password", nil))
+			return
+		}
+
+		var session *Session
+		session, err = createSession(r.Context(), request.Login)
+		if err == nil {
+			tokens, err = issueTokens(session)
+		}
+
+	case "refresh_token":
+		if request.RefreshToken == "" {
+			writeHttpError(w, r, newError(BadInput, "expected a 'refresh_token'", nil))
 			return
 		}
+		tokens, err = refreshTokens(r.Context(), request.RefreshToken)
 
-		defer func() {
-			_ = file.Close()
-		}()
-		content = file
 	default:
-		content = r.Body
+		writeHttpError(w, r, newError(BadInput, "expected 'password' or 'refresh_token' as 'grant_type'", nil))
+		return
 	}
 
-	err = api.AddUsers(r.Context(), content)
 	if err != nil {
-		w.WriteHeader(statusFromError(err))
+		writeHttpError(w, r, err)
+		return
 	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeHttpObjectResponse(w, tokens)
+}
+
+// HandleHttpLogoutRequest initializes an APIHandler and calls its APIHandler.Logout then clears the session cookie
+func HandleHttpLogoutRequest(w http.ResponseWriter, r *http.Request) {
+	api := NewAPIHandler()
+	err := api.Logout(r.Context())
+	if err != nil {
+		writeHttpError(w, r, err)
+		return
+	}
+
+	clearHttpSession(w, r)
+}
+
+// HandleHttpAddUsersRequest initializes an APIHandler and calls its APIHandler.AddUsers with the request body content
+// The request body content is expected to be a user data list in one of the registered formats, selected by the
+// request Content-Type: a JSON object list (default), NDJSON or CSV. The "csv_id", "csv_password" and "csv_data" query parameters
+// name the CSV columns that hold the user fields. The "on_conflict" query parameter
+// tells how to handle already registered users: "fail" (default) which stops the import at the first one, "skip" or "overwrite".
+// The response body is the AddUsersReport encoded as JSON or NDJSON depending on the "Accept" header
+func HandleHttpAddUsersRequest(w http.ResponseWriter, r *http.Request) {
+	api := NewAPIHandler()
+
+	content, contentType, err := addUsersRequestContent(r)
+	if err != nil {
+		writeHttpError(w, r, err)
+		return
+	}
+	defer func() {
+		_ = content.Close()
+	}()
+
+	report, err := api.AddUsers(r.Context(), content, addUsersRequestOptions(r, contentType))
+	if report == nil {
+		writeHttpError(w, r, err)
+		return
+	}
+
+	status := http.StatusOK
+	if err != nil {
+		status = statusFromError(err)
+	}
+	writeHttpAddUsersReport(w, r, status, report)
+}
+
+// addUsersRequestContent returns the user data list stream sent in the request body or in its "file" form part
+// along with its content type
+func addUsersRequestContent(r *http.Request) (io.ReadCloser, string, error) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != "multipart/form-data" {
+		return r.Body, contentType, nil
+	}
+
+	err := r.ParseMultipartForm(-1)
+	if err != nil {
+		return nil, "", newError(BadInput, "malformed multipart form", nil)
+	}
+
+	files := r.MultipartForm.File["file"]
+	if len(files) == 0 {
+		return nil, "", newError(BadInput, "expected a 'file' part", &ErrorDetails{Field: "file"})
+	}
+
+	file, err := files[0].Open()
+	if err != nil {
+		Env.Logger.WithContext(r.Context()).Error("multipart file opening failed", "error", err)
+		return nil, "", Internal
+	}
+
+	contentType, _, _ = mime.ParseMediaType(files[0].Header.Get("Content-Type"))
+	if contentType == "application/octet-stream" {
+		contentType = ""
+	}
+	return file, contentType, nil
+}
+
+// addUsersRequestOptions extracts AddUsersOptions from the request query parameters
+func addUsersRequestOptions(r *http.Request, contentType string) AddUsersOptions {
+	query := r.URL.Query()
+	return AddUsersOptions{
+		OnConflict: ConflictPolicy(query.Get(queryParamOnConflict)),
+		Format:     contentType,
+		CSVColumns: CSVColumns{
+			Id:       query.Get(queryParamCSVIdColumn),
+			Password: query.Get(queryParamCSVPasswordColumn),
+			Data:     query.Get(queryParamCSVDataColumn),
+		},
+	}
+}
+
+// writeHttpAddUsersReport encodes the report as a JSON object or, if the client accepts it, as NDJSON:
+// a line per failure followed by a line holding the counts
+func writeHttpAddUsersReport(w http.ResponseWriter, r *http.Request, status int, report *AddUsersReport) {
+	if !strings.Contains(r.Header.Get("Accept"), "application/x-ndjson") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(report)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	for _, failure := range report.Failures {
+		_ = encoder.Encode(failure)
+	}
+	_ = encoder.Encode(map[string]int{
+		"accepted": report.Accepted,
+		"rejected": report.Rejected,
+		"skipped":  report.Skipped,
+	})
 }
 
 // HandleHttpDeleteUserRequest initializes an APIHandler and calls its APIHandler.DeleteUser with userId extracted from the request URI path
@@ -147,7 +387,7 @@ func HandleHttpDeleteUserRequest(w http.ResponseWriter, r *http.Request) {
 	api := NewAPIHandler()
 	err := api.DeleteUser(r.Context(), userId)
 	if err != nil {
-		w.WriteHeader(statusFromError(err))
+		writeHttpError(w, r, err)
 	}
 }
 
@@ -157,10 +397,16 @@ func HandleHttpGetUserRequest(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userId := vars[endpointVarId]
 
+	includeSecrets, err := httpIncludeSecrets(r)
+	if err != nil {
+		writeHttpError(w, r, err)
+		return
+	}
+
 	api := NewAPIHandler()
-	user, err := api.GetUser(r.Context(), userId)
+	user, err := api.GetUser(r.Context(), userId, GetUserOptions{IncludeSecrets: includeSecrets})
 	if err != nil {
-		w.WriteHeader(statusFromError(err))
+		writeHttpError(w, r, err)
 		return
 	}
 
@@ -168,6 +414,24 @@ func HandleHttpGetUserRequest(w http.ResponseWriter, r *http.Request) {
 	_, err = w.Write([]byte(user))
 }
 
+// httpIncludeSecrets reads the "include_secrets" query parameter. "include_passwords" is still accepted in its place
+func httpIncludeSecrets(r *http.Request) (bool, error) {
+	query := r.URL.Query()
+	value := query.Get(queryParamIncludeSecrets)
+	if value == "" {
+		value = query.Get(queryParamIncludePasswords)
+	}
+	if value == "" {
+		return false, nil
+	}
+
+	include, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, newError(BadInput, "expected a boolean as value of 'include_secrets'", &ErrorDetails{Field: queryParamIncludeSecrets})
+	}
+	return include, nil
+}
+
 // HandleHttpGetUserListRequest initializes an APIHandler and calls its APIHandler.GetUserList
 // "r" is expected to be a POST request with an encoded JSON object list as body
 // The returned value by GetUserList is set as the HTTP response body
@@ -184,50 +448,547 @@ func HandleHttpGetUserListRequest(w http.ResponseWriter, r *http.Request) {
 	if offsetValue != "" {
 		offset, err = strconv.Atoi(offsetValue)
 		if err != nil {
-			writeHttpErrorResponseWithMessage(w, BadInput, "expected a number as value of 'offset'")
+			writeHttpError(w, r, newError(BadInput, "expected a number as value of 'offset'", &ErrorDetails{Field: queryParamOffset}))
 			return
 		}
 	}
 	if countValue != "" {
 		count, err = strconv.Atoi(countValue)
 		if err != nil {
-			writeHttpErrorResponseWithMessage(w, BadInput, "expected a number as value of 'count'")
+			writeHttpError(w, r, newError(BadInput, "expected a number as value of 'count'", &ErrorDetails{Field: queryParamCount}))
 			return
 		}
 	}
 
-	api := NewAPIHandler()
-	list, err := api.GetUserList(r.Context(), ListOptions{
+	opts := ListOptions{
 		Offset: offset,
 		Count:  count,
-	})
+		Cursor: query.Get(queryParamCursor),
+		Filter: query.Get(queryParamFilter),
+		Sort:   query.Get(queryParamSort),
+		Fields: query.Get(queryParamFields),
+	}
+
+	opts.IncludeSecrets, err = httpIncludeSecrets(r)
 	if err != nil {
-		w.WriteHeader(statusFromError(err))
+		writeHttpError(w, r, err)
 		return
 	}
 
-	w.Header().Add("Content-Type", "application/json")
-	_, _ = w.Write([]byte(fmt.Sprintf("{\"offset\": %d,", list.Offset)))
-	_, _ = w.Write([]byte("\"data\": ["))
-	for ind, userData := range list.UserDataList {
-		if ind > 0 {
-			_, _ = w.Write([]byte(","))
-		}
-		_, _ = w.Write([]byte(userData))
+	_, err = parseUserQuery(opts)
+	if err != nil {
+		writeHttpError(w, r, err)
+		return
 	}
-	_, _ = w.Write([]byte("]"))
-	_, _ = w.Write([]byte("}"))
+
+	if opts.Cursor != "" && opts.Sort != "" {
+		writeHttpError(w, r, newError(BadInput, "'cursor' cannot be combined with 'sort'", &ErrorDetails{Field: queryParamCursor}))
+		return
+	}
+
+	api := NewAPIHandler()
+	list, err := api.GetUserList(r.Context(), opts)
+	if err != nil {
+		writeHttpError(w, r, err)
+		return
+	}
+
+	for _, link := range userListLinks(r, opts, list) {
+		w.Header().Add("Link", link)
+	}
+	writeHttpObjectResponse(w, list)
+}
+
+// userListLinks returns the RFC 8288 links to the ranges that follow and precede "list". They reference
+// cursors when the list provides them or else offsets
+func userListLinks(r *http.Request, opts ListOptions, list *UserDataList) []string {
+	link := func(rel string, set func(query url.Values)) string {
+		query := r.URL.Query()
+		query.Del(queryParamCursor)
+		query.Del(queryParamOffset)
+		set(query)
+
+		target := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+		return fmt.Sprintf("<%s>; rel=\"%s\"", target.String(), rel)
+	}
+
+	count := listRangeCount(opts.Count)
+
+	var links []string
+	if list.Next != "" {
+		links = append(links, link("next", func(query url.Values) {
+			query.Set(queryParamCursor, list.Next)
+		}))
+	} else if list.HasMore && opts.Cursor == "" {
+		links = append(links, link("next", func(query url.Values) {
+			query.Set(queryParamOffset, strconv.Itoa(opts.Offset+count))
+		}))
+	}
+
+	if list.Prev != "" {
+		links = append(links, link("prev", func(query url.Values) {
+			query.Set(queryParamCursor, list.Prev)
+		}))
+	} else if opts.Offset > 0 && opts.Cursor == "" {
+		links = append(links, link("prev", func(query url.Values) {
+			offset := opts.Offset - count
+			if offset < 0 {
+				offset = 0
+			}
+			query.Set(queryParamOffset, strconv.Itoa(offset))
+		}))
+	}
+	return links
 }
 
 // HandleHttpUpdateUserRequest initializes an APIHandler and calls its APIHandler.UpdateUser with userId extracted from the request URI path
-// and the request content body. The request body content is expected to be a JSON encoded UserData object
+// and the request content body. The request body content is expected to be a JSON encoded UserData object, a JSON Merge Patch (RFC 7386)
+// or a JSON Patch (RFC 6902) depending on the request Content-Type
 func HandleHttpUpdateUserRequest(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userId := vars[endpointVarId]
 
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		Env.Logger.WithContext(r.Context()).Warn("request body reading failed", "error", err)
+		writeHttpError(w, r, newError(BadInput, "could not read the request body", nil))
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "" {
+		contentType, _, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			writeHttpError(w, r, newError(UnsupportedFormat, "malformed Content-Type", nil))
+			return
+		}
+	}
+
 	api := NewAPIHandler()
-	err := api.DeleteUser(r.Context(), userId)
+	err = api.UpdateUser(r.Context(), userId, UserData(body), UpdateUserOptions{Format: contentType})
+	if err != nil {
+		writeHttpError(w, r, err)
+	}
+}
+
+// HandleHttpStartImportJobRequest initializes an APIHandler and calls its APIHandler.StartImportJob with the request body content.
+// The request body content is expected to be the same as for HandleHttpAddUsersRequest. The created job is set as the HTTP response body
+func HandleHttpStartImportJobRequest(w http.ResponseWriter, r *http.Request) {
+	api := NewAPIHandler()
+
+	content, contentType, err := addUsersRequestContent(r)
+	if err != nil {
+		writeHttpError(w, r, err)
+		return
+	}
+	defer func() {
+		_ = content.Close()
+	}()
+
+	job, err := api.StartImportJob(r.Context(), content, addUsersRequestOptions(r, contentType))
+	if err != nil {
+		writeHttpError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", strings.Replace(GetImportJobEndpoint, "{"+endpointVarId+"}", job.Id, 1))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+// HandleHttpGetImportJobRequest initializes an APIHandler and calls its APIHandler.GetImportJob with the job id extracted from the request URI path.
+// The job state, without its failures, is set as the HTTP response body
+func HandleHttpGetImportJobRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobId := vars[endpointVarId]
+
+	api := NewAPIHandler()
+	job, err := api.GetImportJob(r.Context(), jobId)
 	if err != nil {
-		w.WriteHeader(statusFromError(err))
+		writeHttpError(w, r, err)
+		return
 	}
+
+	job.Failures = nil
+	writeHttpObjectResponse(w, job)
+}
+
+// HandleHttpGetImportJobFailuresRequest initializes an APIHandler and calls its APIHandler.GetImportJob with the job id extracted from the request URI path.
+// The list of the users the job could not add is set as the HTTP response body
+func HandleHttpGetImportJobFailuresRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobId := vars[endpointVarId]
+
+	api := NewAPIHandler()
+	job, err := api.GetImportJob(r.Context(), jobId)
+	if err != nil {
+		writeHttpError(w, r, err)
+		return
+	}
+
+	failures := job.Failures
+	if failures == nil {
+		failures = []UserFailure{}
+	}
+	writeHttpObjectResponse(w, failures)
+}
+
+// HandleHttpCancelImportJobRequest initializes an APIHandler and calls its APIHandler.CancelImportJob with the job id extracted from the request URI path
+func HandleHttpCancelImportJobRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobId := vars[endpointVarId]
+
+	api := NewAPIHandler()
+	err := api.CancelImportJob(r.Context(), jobId)
+	if err != nil {
+		writeHttpError(w, r, err)
+	}
+}
+
+var exportFormats = map[string]string{
+	"json":   FormatJSON,
+	"ndjson": FormatNDJSON,
+	"jsonl":  FormatJSONLines,
+	"csv":    FormatCSV,
+}
+
+// exportFormat gets the export content type from the "format" query parameter or else from the Accept header
+func exportFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get(queryParamFormat); format != "" {
+		contentType, found := exportFormats[format]
+		if !found {
+			return "", newError(UnsupportedFormat, "unsupported format '"+format+"'", &ErrorDetails{Field: queryParamFormat})
+		}
+		return contentType, nil
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case FormatJSON, FormatNDJSON, FormatJSONLines, FormatCSV:
+			return mediaType, nil
+		}
+	}
+	return FormatJSON, nil
+}
+
+// HandleHttpExportUsersRequest initializes an APIHandler and calls its APIHandler.ExportUsers. The users are streamed in the response body
+// as a JSON array, NDJSON or CSV depending on the "format" query parameter or the Accept header. The response is gzip compressed if the client accepts it
+func HandleHttpExportUsersRequest(w http.ResponseWriter, r *http.Request) {
+	contentType, err := exportFormat(r)
+	if err != nil {
+		writeHttpError(w, r, err)
+		return
+	}
+
+	var opts ExportOptions
+	opts.IncludeSecrets, err = httpIncludeSecrets(r)
+	if err != nil {
+		writeHttpError(w, r, err)
+		return
+	}
+
+	var (
+		writer     io.Writer = w
+		gzipWriter *gzip.Writer
+		encoder    userDataEncoder
+		count      int
+	)
+
+	useGzip := strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+	flusher, canFlush := w.(http.Flusher)
+
+	// The headers are sent with the first user so that an error met before can still be reported with its status
+	begin := func() error {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Vary", "Accept-Encoding")
+		if useGzip {
+			w.Header().Set("Content-Encoding", "gzip")
+			gzipWriter = gzip.NewWriter(w)
+			writer = gzipWriter
+		}
+		w.WriteHeader(http.StatusOK)
+
+		encoder, _ = newUserDataEncoder(writer, contentType, opts)
+		return encoder.Begin()
+	}
+
+	flush := func() {
+		if gzipWriter != nil {
+			_ = gzipWriter.Flush()
+		}
+		if canFlush {
+			flusher.Flush()
+		}
+	}
+
+	api := NewAPIHandler()
+	err = api.ExportUsers(r.Context(), opts, func(user UserData) error {
+		if encoder == nil {
+			if err := begin(); err != nil {
+				return err
+			}
+		}
+
+		if err := encoder.Encode(user); err != nil {
+			return err
+		}
+
+		// The first user is flushed at once so that the client gets the headers without waiting for a full batch
+		count++
+		if count == 1 || count%exportFlushInterval == 0 {
+			flush()
+		}
+		return nil
+	})
+
+	if encoder == nil {
+		if err != nil {
+			writeHttpError(w, r, err)
+			return
+		}
+		err = begin()
+	}
+
+	// Once the body has started, the error can only be logged. The client sees a truncated stream
+	if err != nil {
+		Env.Logger.WithContext(r.Context()).Warn("export interrupted", "exported", count, "error", err)
+		return
+	}
+
+	err = encoder.End()
+	if err == nil && gzipWriter != nil {
+		err = gzipWriter.Close()
+	}
+	if err != nil {
+		Env.Logger.WithContext(r.Context()).Warn("export interrupted", "exported", count, "error", err)
+	}
+}
+
+// HandleHttpGetUserRolesRequest initializes an APIHandler and calls its APIHandler.GetUserRoles with userId extracted from the request URI path.
+// The roles are set as the HTTP response body
+func HandleHttpGetUserRolesRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userId := vars[endpointVarId]
+
+	api := NewAPIHandler()
+	roles, err := api.GetUserRoles(r.Context(), userId)
+	if err != nil {
+		writeHttpError(w, r, err)
+		return
+	}
+
+	writeHttpObjectResponse(w, roles)
+}
+
+// HandleHttpSetUserRolesRequest initializes an APIHandler and calls its APIHandler.SetUserRoles with userId extracted from the request URI path
+// and the roles decoded from the request body, which is expected to be a JSON array of role names
+func HandleHttpSetUserRolesRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userId := vars[endpointVarId]
+
+	var roles []Role
+	err := json.NewDecoder(r.Body).Decode(&roles)
+	if err != nil {
+		writeHttpError(w, r, newError(BadInput, "expected a JSON array of roles", nil))
+		return
+	}
+
+	api := NewAPIHandler()
+	err = api.SetUserRoles(r.Context(), userId, roles)
+	if err != nil {
+		writeHttpError(w, r, err)
+	}
+}
+
+// HandleHttpListUserSessionsRequest initializes an APIHandler and calls its APIHandler.ListUserSessions with userId extracted from the request URI path
+// The sessions are set as the HTTP response body as a JSON array
+func HandleHttpListUserSessionsRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userId := vars[endpointVarId]
+
+	api := NewAPIHandler()
+	sessions, err := api.ListUserSessions(r.Context(), userId)
+	if err != nil {
+		writeHttpError(w, r, err)
+		return
+	}
+
+	writeHttpObjectResponse(w, sessions)
+}
+
+// HandleHttpRevokeUserSessionsRequest initializes an APIHandler and calls its APIHandler.RevokeUserSessions with userId extracted from the request URI path
+func HandleHttpRevokeUserSessionsRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userId := vars[endpointVarId]
+
+	api := NewAPIHandler()
+	err := api.RevokeUserSessions(r.Context(), userId)
+	if err != nil {
+		writeHttpError(w, r, err)
+	}
+}
+
+// HandleHttpRevokeSessionRequest initializes an APIHandler and calls its APIHandler.RevokeSession with userId and sessionId extracted from the request URI path
+func HandleHttpRevokeSessionRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userId := vars[endpointVarId]
+	sessionId := vars[endpointVarSessionId]
+
+	api := NewAPIHandler()
+	err := api.RevokeSession(r.Context(), userId, sessionId)
+	if err != nil {
+		writeHttpError(w, r, err)
+	}
+}
+
+// HandleHttpCreateAPIKeyRequest initializes an APIHandler and calls its APIHandler.CreateAPIKey with userId extracted from the request URI path
+// and the name and scopes decoded from the request body, which is expected to be a JSON object like {"name": "backup", "scopes": ["users:read"]}.
+// The created key, which holds the secret, is set as the HTTP response body
+func HandleHttpCreateAPIKeyRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userId := vars[endpointVarId]
+
+	var request = &struct {
+		Name   string       `json:"name"`
+		Scopes []Permission `json:"scopes"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(request)
+	if err != nil {
+		writeHttpError(w, r, newError(BadInput, "expected a JSON object with a name and scopes", nil))
+		return
+	}
+
+	api := NewAPIHandler()
+	key, err := api.CreateAPIKey(r.Context(), userId, request.Name, request.Scopes)
+	if err != nil {
+		writeHttpError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(key)
+}
+
+// HandleHttpListAPIKeysRequest initializes an APIHandler and calls its APIHandler.ListAPIKeys with userId extracted from the request URI path
+// The keys, without their secret, are set as the HTTP response body as a JSON array
+func HandleHttpListAPIKeysRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userId := vars[endpointVarId]
+
+	api := NewAPIHandler()
+	keys, err := api.ListAPIKeys(r.Context(), userId)
+	if err != nil {
+		writeHttpError(w, r, err)
+		return
+	}
+
+	writeHttpObjectResponse(w, keys)
+}
+
+// HandleHttpDeleteAPIKeyRequest initializes an APIHandler and calls its APIHandler.DeleteAPIKey with userId and keyId extracted from the request URI path
+func HandleHttpDeleteAPIKeyRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userId := vars[endpointVarId]
+	keyId := vars[endpointVarKeyId]
+
+	api := NewAPIHandler()
+	err := api.DeleteAPIKey(r.Context(), userId, keyId)
+	if err != nil {
+		writeHttpError(w, r, err)
+	}
+}
+
+// HandleHttpUnlockUserRequest initializes an APIHandler and calls its APIHandler.UnlockUser with the login extracted from the request URI path
+func HandleHttpUnlockUserRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	login := vars[endpointVarId]
+
+	api := NewAPIHandler()
+	err := api.UnlockUser(r.Context(), login)
+	if err != nil {
+		writeHttpError(w, r, err)
+	}
+}
+
+// HandleHttpNotFound writes a NotFound error response. It handles the requests that match no endpoint
+func HandleHttpNotFound(w http.ResponseWriter, r *http.Request) {
+	writeHttpError(w, r, NotFound)
+}
+
+// HandleHttpMetricsRequest writes the server metrics in the Prometheus text format
+func HandleHttpMetricsRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	err := metrics.registry.WriteText(w)
+	if err != nil {
+		Env.Logger.WithContext(r.Context()).Error("metrics writing failed", "error", err)
+	}
+}
+
+// HealthResponse is the body of the liveness and readiness responses. Checks holds the state of each storage backend
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// VersionResponse is the body of the version response
+type VersionResponse struct {
+	Version       string `json:"version"`
+	BuildRevision string `json:"build_revision"`
+	BuildStamp    string `json:"build_stamp"`
+}
+
+// HandleHttpHealthRequest tells that the process is up
+func HandleHttpHealthRequest(w http.ResponseWriter, _ *http.Request) {
+	writeHttpObjectResponse(w, &HealthResponse{Status: "ok"})
+}
+
+// HandleHttpReadinessRequest checks the health of the user data store and of the files. It answers 503 if one fails.
+// The failures are logged rather than returned as they may expose internal details
+func HandleHttpReadinessRequest(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+	defer cancel()
+
+	checks := map[string]func(context.Context) error{
+		"store": Env.DataStore.HealthCheck,
+		"files": Env.Files.HealthCheck,
+	}
+
+	response := &HealthResponse{Status: "ready", Checks: map[string]string{}}
+	for name, check := range checks {
+		err := check(ctx)
+		if err != nil {
+			Env.Logger.WithContext(ctx).Warn("health check failed", "backend", name, "error", err)
+			response.Status = "unavailable"
+			response.Checks[name] = "unavailable"
+			continue
+		}
+		response.Checks[name] = "ok"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if response.Status != "ready" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// HandleHttpVersionRequest writes the build info
+func HandleHttpVersionRequest(w http.ResponseWriter, _ *http.Request) {
+	writeHttpObjectResponse(w, &VersionResponse{
+		Version:       info.Version,
+		BuildRevision: info.BuildRevision,
+		BuildStamp:    info.BuildStamp,
+	})
+}
+
+// HandleHttpMethodNotAllowed writes a MethodNotAllowed error response. It handles the requests whose method is not supported by the endpoint
+func HandleHttpMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeHttpError(w, r, MethodNotAllowed)
 }
@@ -2,22 +2,35 @@ package ditt
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
+	"github.com/omecodes/ditt/info"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
 
 var (
-	_httpTestsCookies []*http.Cookie
-	// _testEndpointVarId = "{" + endpointVarId + "}"
+	_httpTestsCookies  []*http.Cookie
+	_testEndpointVarId = "{" + endpointVarId + "}"
 )
 
 func setupHttpTests() {
-	Env.AdminPassword = "password"
 	Env.CookiesStore = sessions.NewCookieStore([]byte("random-string"))
+	Env.TokenSigningKey = []byte("token-signing-key")
 }
 
 var (
@@ -57,6 +70,7 @@ func _httpTestGetHandler(f http.HandlerFunc) http.Handler {
 	handler = f
 	handler = sessionHttpMiddleware(handler)
 	handler = loggerHttpMiddleware(handler)
+	handler = requestIdHttpMiddleware(handler)
 	return handler
 }
 
@@ -105,6 +119,199 @@ func TestHandleHttpAddUsersRequest(t *testing.T) {
 	})
 }
 
+func TestHandleHttpAddUsersRequestSelfRegistration(t *testing.T) {
+	Convey("Add Users without being authenticated", t, func() {
+		setupHttpTests()
+
+		addUsers := func(bodyContent string) int {
+			r := httptest.NewRequest(http.MethodPost, AddUsersEndpoint, bytes.NewBufferString(bodyContent))
+			w := httptest.NewRecorder()
+			_httpTestGetHandler(HandleHttpAddUsersRequest).ServeHTTP(w, r)
+			return w.Code
+		}
+
+		status := addUsers(`[{"id": "self-1", "password": "self-pass-1"}]`)
+		So(status, ShouldEqual, http.StatusForbidden)
+
+		Env.SelfRegistration = true
+		defer func() {
+			Env.SelfRegistration = false
+		}()
+
+		status = addUsers(`[{"id": "self-1", "password": "self-pass-1", "data": "self-data-1"}]`)
+		So(status, ShouldEqual, http.StatusOK)
+
+		status = addUsers(`[{"id": "self-1", "password": "self-pass-2"}]`)
+		So(status, ShouldEqual, http.StatusConflict)
+
+		status = addUsers(_httpTestAddUsersBodyContent)
+		So(status, ShouldEqual, http.StatusBadRequest)
+
+		bodyContent := `{"login": "self-1", "password": "self-pass-1"}`
+		r := httptest.NewRequest(http.MethodPost, LoginEndpoint, bytes.NewBufferString(bodyContent))
+		r.Header.Add("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		_httpTestGetHandler(HandleHttpLoginRequest).ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, http.StatusOK)
+	})
+}
+
+func TestHandleHttpAddUsersRequestConflict(t *testing.T) {
+	Convey("Add already registered Users", t, func() {
+		setupHttpTests()
+		workers, queueSize := Env.RunnerWorkers, Env.RunnerQueueSize
+		Env.RunnerWorkers, Env.RunnerQueueSize = 1, 1
+		defer func() {
+			Env.RunnerWorkers, Env.RunnerQueueSize = workers, queueSize
+		}()
+
+		r := httptest.NewRequest(http.MethodPost, AddUsersEndpoint, bytes.NewBufferString(_httpTestAddUsersBodyContent))
+		for _, cookie := range _httpTestsCookies {
+			r.AddCookie(cookie)
+		}
+
+		w := httptest.NewRecorder()
+
+		handler := _httpTestGetHandler(HandleHttpAddUsersRequest)
+		handler.ServeHTTP(w, r)
+
+		res := w.Result()
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		So(res.StatusCode, ShouldEqual, http.StatusConflict)
+
+		var report *AddUsersReport
+		err := json.NewDecoder(res.Body).Decode(&report)
+		So(err, ShouldBeNil)
+		So(report.Accepted, ShouldEqual, 0)
+		So(report.Rejected, ShouldEqual, 1)
+		So(report.Failures, ShouldHaveLength, 1)
+		So(report.Failures[0].Index, ShouldEqual, 0)
+		So(report.Failures[0].UserId, ShouldEqual, "user-1")
+	})
+}
+
+func TestHandleHttpAddUsersRequestNDJSONReport(t *testing.T) {
+	Convey("Add Users with a NDJSON report", t, func() {
+		setupHttpTests()
+
+		r := httptest.NewRequest(http.MethodPost, AddUsersEndpoint+"?on_conflict=skip", bytes.NewBufferString(_httpTestAddUsersBodyContent))
+		r.Header.Set("Accept", "application/x-ndjson")
+		for _, cookie := range _httpTestsCookies {
+			r.AddCookie(cookie)
+		}
+
+		w := httptest.NewRecorder()
+
+		handler := _httpTestGetHandler(HandleHttpAddUsersRequest)
+		handler.ServeHTTP(w, r)
+
+		res := w.Result()
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		So(res.StatusCode, ShouldEqual, http.StatusOK)
+		So(res.Header.Get("Content-Type"), ShouldEqual, "application/x-ndjson")
+
+		var counts map[string]int
+		err := json.NewDecoder(res.Body).Decode(&counts)
+		So(err, ShouldBeNil)
+		So(counts["skipped"], ShouldEqual, 5)
+	})
+}
+
+func TestHandleHttpStartImportJobRequest(t *testing.T) {
+	Convey("Import Users in background", t, func() {
+		setupHttpTests()
+
+		bodyContent := `[{"id": "user-6", "password": "pass-6", "data": "data-6"}]`
+		r := httptest.NewRequest(http.MethodPost, StartImportJobEndpoint, bytes.NewBufferString(bodyContent))
+		for _, cookie := range _httpTestsCookies {
+			r.AddCookie(cookie)
+		}
+
+		w := httptest.NewRecorder()
+
+		handler := _httpTestGetHandler(HandleHttpStartImportJobRequest)
+		handler.ServeHTTP(w, r)
+
+		res := w.Result()
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		So(res.StatusCode, ShouldEqual, http.StatusAccepted)
+
+		var job *ImportJob
+		err := json.NewDecoder(res.Body).Decode(&job)
+		So(err, ShouldBeNil)
+		So(res.Header.Get("Location"), ShouldEqual, "/import/jobs/"+job.Id)
+
+		for job.State == ImportJobRunning {
+			time.Sleep(100 * time.Millisecond)
+
+			r = httptest.NewRequest(http.MethodGet, res.Header.Get("Location"), nil)
+			r = mux.SetURLVars(r, map[string]string{endpointVarId: job.Id})
+			for _, cookie := range _httpTestsCookies {
+				r.AddCookie(cookie)
+			}
+
+			w = httptest.NewRecorder()
+			handler = _httpTestGetHandler(HandleHttpGetImportJobRequest)
+			handler.ServeHTTP(w, r)
+
+			So(w.Code, ShouldEqual, http.StatusOK)
+			err = json.NewDecoder(w.Body).Decode(&job)
+			So(err, ShouldBeNil)
+		}
+		So(job.State, ShouldEqual, ImportJobDone)
+		So(job.Processed, ShouldEqual, 1)
+		So(job.Failed, ShouldEqual, 0)
+	})
+}
+
+func _httpTestAddUsers(target string, contentType string, bodyContent string) (*http.Response, *AddUsersReport) {
+	r := httptest.NewRequest(http.MethodPost, target, bytes.NewBufferString(bodyContent))
+	r.Header.Set("Content-Type", contentType)
+	for _, cookie := range _httpTestsCookies {
+		r.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	handler := _httpTestGetHandler(HandleHttpAddUsersRequest)
+	handler.ServeHTTP(w, r)
+
+	res := w.Result()
+	var report *AddUsersReport
+	_ = json.NewDecoder(res.Body).Decode(&report)
+	_ = res.Body.Close()
+	return res, report
+}
+
+func TestHandleHttpAddUsersRequestFormats(t *testing.T) {
+	Convey("Add Users in NDJSON and CSV formats", t, func() {
+		setupHttpTests()
+
+		bodyContent := `{"id": "user-7", "password": "pass-7", "data": "data-7"}
+{"id": "user-8", "password": "pass-8", "data": "data-8"}
+`
+		res, report := _httpTestAddUsers(AddUsersEndpoint, "application/x-ndjson", bodyContent)
+		So(res.StatusCode, ShouldEqual, http.StatusOK)
+		So(report.Accepted, ShouldEqual, 2)
+
+		bodyContent = "name,secret,notes\nuser-9,pass-9,data-9\n"
+		res, report = _httpTestAddUsers(AddUsersEndpoint+"?csv_id=name&csv_password=secret&csv_data=notes", "text/csv; charset=utf-8", bodyContent)
+		So(res.StatusCode, ShouldEqual, http.StatusOK)
+		So(report.Accepted, ShouldEqual, 1)
+
+		user := _httpTestGetUser("user-9")
+		So(user.Data, ShouldEqual, "data-9")
+
+		res, _ = _httpTestAddUsers(AddUsersEndpoint, "application/xml", "<users/>")
+		So(res.StatusCode, ShouldEqual, http.StatusUnsupportedMediaType)
+	})
+}
+
 func TestHandleHttpGetUserListRequest(t *testing.T) {
 	Convey("List Users", t, func() {
 		setupHttpTests()
@@ -126,10 +333,98 @@ func TestHandleHttpGetUserListRequest(t *testing.T) {
 
 		So(res.StatusCode, ShouldEqual, http.StatusOK)
 
+		var list struct {
+			Next    string           `json:"next"`
+			Total   int              `json:"total"`
+			Count   int              `json:"count"`
+			HasMore bool             `json:"has_more"`
+			Data    []*_httpTestUser `json:"data"`
+		}
+		err := json.NewDecoder(res.Body).Decode(&list)
+		So(err, ShouldBeNil)
+		So(list.Next, ShouldNotBeEmpty)
+		So(list.Count, ShouldEqual, len(list.Data))
+		So(list.Total, ShouldBeGreaterThan, list.Count)
+		So(list.HasMore, ShouldBeTrue)
+		next := list.Next
+		So(res.Header.Get("Link"), ShouldEqual, fmt.Sprintf(`<%s?cursor=%s>; rel="next"`, ListUsersEndpoint, next))
+
+		r = httptest.NewRequest(http.MethodGet, ListUsersEndpoint+"?cursor="+next, nil)
+		for _, cookie := range _httpTestsCookies {
+			r.AddCookie(cookie)
+		}
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, http.StatusOK)
+
+		lastId := list.Data[len(list.Data)-1].Id
+		err = json.NewDecoder(w.Body).Decode(&list)
+		So(err, ShouldBeNil)
+		So(list.Data[0].Id, ShouldBeGreaterThan, lastId)
+
+		r = httptest.NewRequest(http.MethodGet, ListUsersEndpoint+"?offset=1&cursor="+next, nil)
+		for _, cookie := range _httpTestsCookies {
+			r.AddCookie(cookie)
+		}
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, http.StatusBadRequest)
 	})
 }
 
-/*
+func _httpTestListUsers(query url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, ListUsersEndpoint+"?"+query.Encode(), nil)
+	for _, cookie := range _httpTestsCookies {
+		r.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	handler := _httpTestGetHandler(HandleHttpGetUserListRequest)
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestHandleHttpGetUserListRequestQuery(t *testing.T) {
+	Convey("List Users with a filter, a sort and a projection", t, func() {
+		setupHttpTests()
+
+		w := _httpTestListUsers(url.Values{
+			queryParamFilter: {"id^=user-"},
+			queryParamSort:   {"-id"},
+			queryParamFields: {"id"},
+			queryParamCount:  {"3"},
+		})
+		So(w.Code, ShouldEqual, http.StatusOK)
+
+		var list struct {
+			Next string                   `json:"next"`
+			Data []map[string]interface{} `json:"data"`
+		}
+		err := json.NewDecoder(w.Body).Decode(&list)
+		So(err, ShouldBeNil)
+		So(list.Next, ShouldBeEmpty)
+		So(list.Data, ShouldHaveLength, 3)
+		So(w.Header().Get("Link"), ShouldContainSubstring, "offset=3")
+		So(w.Header().Get("Link"), ShouldEndWith, `; rel="next"`)
+		for i, user := range list.Data {
+			So(user, ShouldHaveLength, 1)
+			So(user["id"], ShouldStartWith, "user-")
+			if i > 0 {
+				So(user["id"], ShouldBeLessThan, list.Data[i-1]["id"])
+			}
+		}
+
+		w = _httpTestListUsers(url.Values{queryParamFilter: {"id=user-1"}})
+		So(w.Code, ShouldEqual, http.StatusBadRequest)
+		So(w.Body.String(), ShouldContainSubstring, "expected '==' or '^='")
+
+		w = _httpTestListUsers(url.Values{queryParamSort: {"password"}})
+		So(w.Code, ShouldEqual, http.StatusBadRequest)
+
+		w = _httpTestListUsers(url.Values{queryParamSort: {"id"}, queryParamCursor: {(&listCursor{Id: "user-1"}).encode()}})
+		So(w.Code, ShouldEqual, http.StatusBadRequest)
+	})
+}
 
 type _httpTestUser struct {
 	Id       string `json:"id"`
@@ -137,120 +432,801 @@ type _httpTestUser struct {
 	Data     string `json:"data"`
 }
 
-func TestHandleHttpGetUserRequest(t *testing.T) {
-	Convey("Get User", t, func() {
+func TestHttpErrorResponses(t *testing.T) {
+	Convey("Errors must be returned as JSON objects with a code, a message, the request id and details", t, func() {
 		setupHttpTests()
 
-		endpoint := strings.Replace(GetUserEndpoint, _testEndpointVarId, "user-1", 1)
+		decode := func(w *httptest.ResponseRecorder) *ErrorResponse {
+			So(w.Header().Get("Content-Type"), ShouldEqual, "application/json")
+			var response *ErrorResponse
+			So(json.NewDecoder(w.Body).Decode(&response), ShouldBeNil)
+			return response
+		}
+
+		w := _httpTestListUsers(url.Values{queryParamOffset: {"first"}})
+		So(w.Code, ShouldEqual, http.StatusBadRequest)
+		response := decode(w)
+		So(response.Code, ShouldEqual, ErrorCode("bad_input"))
+		So(response.Message, ShouldEqual, "expected a number as value of 'offset'")
+		So(response.Details.Field, ShouldEqual, queryParamOffset)
 
-		r := httptest.NewRequest(http.MethodGet, endpoint, nil)
+		w = _httpTestListUsers(url.Values{queryParamFilter: {"id=user-1"}})
+		So(w.Code, ShouldEqual, http.StatusBadRequest)
+		response = decode(w)
+		So(response.Details.Field, ShouldEqual, queryParamFilter)
+		So(*response.Details.Position, ShouldEqual, 2)
+
+		r := httptest.NewRequest(http.MethodGet, "/user/nobody", nil)
+		r = mux.SetURLVars(r, map[string]string{endpointVarId: "nobody"})
+		r.Header.Set(requestIdHeader, "request-1")
 		for _, cookie := range _httpTestsCookies {
 			r.AddCookie(cookie)
 		}
+		w = httptest.NewRecorder()
+		_httpTestGetHandler(HandleHttpGetUserRequest).ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, http.StatusNotFound)
+		response = decode(w)
+		So(response.Code, ShouldEqual, ErrorCode("not_found"))
+		So(response.RequestId, ShouldEqual, "request-1")
+		So(w.Header().Get(requestIdHeader), ShouldEqual, "request-1")
+		So(response.Details, ShouldBeNil)
 
-		w := httptest.NewRecorder()
+		w = httptest.NewRecorder()
+		writeHttpError(w, httptest.NewRequest(http.MethodGet, "/", nil), fmt.Errorf("database: %s", "connection refused"))
+		So(w.Code, ShouldEqual, http.StatusInternalServerError)
+		response = decode(w)
+		So(response.Code, ShouldEqual, ErrorCode("internal"))
+		So(response.Message, ShouldEqual, "internal")
 
-		handler := _httpTestGetHandler(HandleHttpGetUserRequest)
-		handler.ServeHTTP(w, r)
+		w = httptest.NewRecorder()
+		HandleHttpMethodNotAllowed(w, httptest.NewRequest(http.MethodPut, LoginEndpoint, nil))
+		So(w.Code, ShouldEqual, http.StatusMethodNotAllowed)
+		So(decode(w).Code, ShouldEqual, ErrorCode("method_not_allowed"))
+	})
+}
 
-		res := w.Result()
+func TestHttpRequestId(t *testing.T) {
+	Convey("Requests must get an id that is set in the response and in the logs of the processing", t, func() {
+		setupHttpTests()
+		buf := &bytes.Buffer{}
+		logger := Env.Logger
+		Env.Logger = NewLogger(buf, LogLevelDebug, LogFormatLogfmt)
 		defer func() {
-			_ = res.Body.Close()
+			Env.Logger = logger
 		}()
-		So(res.StatusCode, ShouldEqual, http.StatusOK)
 
-		var user *_httpTestUser
-		err := json.NewDecoder(r.Body).Decode(&user)
-		So(err, ShouldBeNil)
+		r := httptest.NewRequest(http.MethodPost, AddUsersEndpoint, bytes.NewBufferString(`[{"id": "admin", "password": "admin-pass"}]`))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(requestIdHeader, "import-7")
+		for _, cookie := range _httpTestsCookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		_httpTestGetHandler(HandleHttpAddUsersRequest).ServeHTTP(w, r)
+		So(w.Header().Get(requestIdHeader), ShouldEqual, "import-7")
+		So(buf.String(), ShouldContainSubstring, `msg="user data rejected" request_id=import-7 index=0 user=admin`)
+		So(buf.String(), ShouldContainSubstring, `msg="http request" request_id=import-7 method=POST`)
+
+		for _, requestId := range []string{"", "with space", strings.Repeat("x", 129)} {
+			r = httptest.NewRequest(http.MethodGet, "/user/user-1", nil)
+			r.Header.Set(requestIdHeader, requestId)
+			w = httptest.NewRecorder()
+			_httpTestGetHandler(HandleHttpNotFound).ServeHTTP(w, r)
+			So(w.Header().Get(requestIdHeader), ShouldHaveLength, 32)
+			So(w.Header().Get(requestIdHeader), ShouldNotEqual, requestId)
+		}
+	})
+}
+
+func _httpTestGetUser(userId string) *_httpTestUser {
+	endpoint := strings.Replace(GetUserEndpoint, _testEndpointVarId, userId, 1)
+	r := httptest.NewRequest(http.MethodGet, endpoint, nil)
+	r = mux.SetURLVars(r, map[string]string{endpointVarId: userId})
+	for _, cookie := range _httpTestsCookies {
+		r.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	handler := _httpTestGetHandler(HandleHttpGetUserRequest)
+	handler.ServeHTTP(w, r)
+
+	res := w.Result()
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	So(res.StatusCode, ShouldEqual, http.StatusOK)
+
+	var user *_httpTestUser
+	err := json.NewDecoder(res.Body).Decode(&user)
+	So(err, ShouldBeNil)
+	return user
+}
 
+func TestHandleHttpGetUserRequestSecrets(t *testing.T) {
+	Convey("Get User must only return the password hash when the admin asks for it", t, func() {
+		setupHttpTests()
+
+		user := _httpTestGetUser("user-1")
 		So(user.Id, ShouldEqual, "user-1")
-		So(user.Password, ShouldEqual, "password-1")
-		So(user.Data, ShouldEqual, "data-1")
+		So(user.Password, ShouldBeEmpty)
+
+		endpoint := strings.Replace(GetUserEndpoint, _testEndpointVarId, "user-1", 1)
+		for query, status := range map[string]int{"?include_secrets=true": http.StatusOK, "?include_secrets=maybe": http.StatusBadRequest} {
+			r := httptest.NewRequest(http.MethodGet, endpoint+query, nil)
+			r = mux.SetURLVars(r, map[string]string{endpointVarId: "user-1"})
+			for _, cookie := range _httpTestsCookies {
+				r.AddCookie(cookie)
+			}
+
+			w := httptest.NewRecorder()
+			_httpTestGetHandler(HandleHttpGetUserRequest).ServeHTTP(w, r)
+			So(w.Code, ShouldEqual, status)
+			if status == http.StatusOK {
+				So(UserData(w.Body.String()).Password(), ShouldNotBeEmpty)
+			}
+		}
+
+		w := _httpTestListUsers(url.Values{queryParamCount: {"3"}})
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Body.String(), ShouldNotContainSubstring, `"password"`)
+
+		w = _httpTestListUsers(url.Values{queryParamCount: {"3"}, queryParamIncludeSecrets: {"true"}})
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Body.String(), ShouldContainSubstring, `"password"`)
 	})
 }
 
+func _httpTestUpdateUser(userId string, contentType string, bodyContent string) int {
+	endpoint := strings.Replace(UpdateUserEndpoint, _testEndpointVarId, userId, 1)
+	r := httptest.NewRequest(http.MethodPatch, endpoint, bytes.NewBufferString(bodyContent))
+	r = mux.SetURLVars(r, map[string]string{endpointVarId: userId})
+	r.Header.Set("Content-Type", contentType)
+	for _, cookie := range _httpTestsCookies {
+		r.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	handler := _httpTestGetHandler(HandleHttpUpdateUserRequest)
+	handler.ServeHTTP(w, r)
+
+	res := w.Result()
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	return res.StatusCode
+}
+
 func TestHandleHttpUpdateUserRequest(t *testing.T) {
 	Convey("Update User", t, func() {
 		setupHttpTests()
 
-		endpoint := strings.Replace(UpdateUserEndpoint, _testEndpointVarId, "user-1", 1)
+		user := _httpTestGetUser("user-1")
+		So(user.Id, ShouldEqual, "user-1")
+		So(user.Data, ShouldEqual, "data-1")
+		hashedPassword := user.Password
 
-		r := httptest.NewRequest(http.MethodPost, endpoint, bytes.NewBufferString(_httpTestAddUsersBodyContent))
-		w := httptest.NewRecorder()
+		status := _httpTestUpdateUser("user-1", "application/merge-patch+json", `{"data": "data-1-updated"}`)
+		So(status, ShouldEqual, http.StatusOK)
 
-		handler := _httpTestGetHandler(HandleHttpUpdateUserRequest)
-		handler.ServeHTTP(w, r)
+		user = _httpTestGetUser("user-1")
+		So(user.Data, ShouldEqual, "data-1-updated")
+		So(user.Password, ShouldEqual, hashedPassword)
 
-		res := w.Result()
-		defer func() {
-			_ = res.Body.Close()
-		}()
+		status = _httpTestUpdateUser("user-1", "application/json-patch+json", `[{"op": "replace", "path": "/data", "value": "data-1-patched"}]`)
+		So(status, ShouldEqual, http.StatusOK)
+
+		user = _httpTestGetUser("user-1")
+		So(user.Data, ShouldEqual, "data-1-patched")
+		So(user.Password, ShouldEqual, hashedPassword)
+
+		status = _httpTestUpdateUser("user-1", "application/json", `{"id": "user-2", "data": "data-2-updated"}`)
+		So(status, ShouldEqual, http.StatusBadRequest)
+
+		status = _httpTestUpdateUser("user-1", "text/plain", `data-1`)
+		So(status, ShouldEqual, http.StatusUnsupportedMediaType)
+	})
+}
+
+func _httpTestExportUsers(query string, accept string, acceptEncoding string) *http.Response {
+	r := httptest.NewRequest(http.MethodGet, ExportUsersEndpoint+query, nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	if acceptEncoding != "" {
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	for _, cookie := range _httpTestsCookies {
+		r.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	handler := _httpTestGetHandler(HandleHttpExportUsersRequest)
+	handler.ServeHTTP(w, r)
+	return w.Result()
+}
+
+func TestHandleHttpExportUsersRequest(t *testing.T) {
+	Convey("Export Users", t, func() {
+		setupHttpTests()
+
+		res := _httpTestExportUsers("", "", "")
+		So(res.StatusCode, ShouldEqual, http.StatusOK)
+		So(res.Header.Get("Content-Type"), ShouldEqual, FormatJSON)
+
+		var users []*_httpTestUser
+		err := json.NewDecoder(res.Body).Decode(&users)
+		_ = res.Body.Close()
+		So(err, ShouldBeNil)
+
+		exported := map[string]*_httpTestUser{}
+		for _, user := range users {
+			So(user.Password, ShouldBeEmpty)
+			exported[user.Id] = user
+		}
+		So(exported, ShouldContainKey, "user-2")
+		So(exported["user-2"].Data, ShouldEqual, "data-2")
+
+		res = _httpTestExportUsers("?include_passwords=true", FormatNDJSON, "gzip")
+		So(res.StatusCode, ShouldEqual, http.StatusOK)
+		So(res.Header.Get("Content-Type"), ShouldEqual, FormatNDJSON)
+		So(res.Header.Get("Content-Encoding"), ShouldEqual, "gzip")
+
+		gzipReader, err := gzip.NewReader(res.Body)
+		So(err, ShouldBeNil)
+		decoder := json.NewDecoder(gzipReader)
+		count := 0
+		for decoder.More() {
+			var user *_httpTestUser
+			So(decoder.Decode(&user), ShouldBeNil)
+			So(user.Password, ShouldNotBeEmpty)
+			count++
+		}
+		_ = res.Body.Close()
+		So(count, ShouldEqual, len(users))
+
+		res = _httpTestExportUsers("?format=csv", "", "")
 		So(res.StatusCode, ShouldEqual, http.StatusOK)
+		So(res.Header.Get("Content-Type"), ShouldEqual, FormatCSV)
+
+		records, err := csv.NewReader(res.Body).ReadAll()
+		_ = res.Body.Close()
+		So(err, ShouldBeNil)
+		So(records, ShouldHaveLength, len(users)+1)
+		So(records[0], ShouldResemble, []string{"id", "data"})
+
+		sensitive := Env.SensitiveFields
+		Env.SensitiveFields = []string{"data"}
+		res = _httpTestExportUsers("?format=csv", "", "")
+		Env.SensitiveFields = sensitive
+		records, err = csv.NewReader(res.Body).ReadAll()
+		_ = res.Body.Close()
+		So(err, ShouldBeNil)
+		So(records[0], ShouldResemble, []string{"id", "password"})
+		So(records[1][1], ShouldStartWith, "$2a$")
 
-		endpoint = strings.Replace(GetUserEndpoint, _testEndpointVarId, "user-2", 1)
+		res = _httpTestExportUsers("?format=xml", "", "")
+		_ = res.Body.Close()
+		So(res.StatusCode, ShouldEqual, http.StatusUnsupportedMediaType)
+	})
+}
+
+func TestHandleHttpExportUsersRequestFlush(t *testing.T) {
+	Convey("Export Users must flush the streamed users through the middlewares", t, func() {
+		setupHttpTests()
+
+		r := httptest.NewRequest(http.MethodGet, ExportUsersEndpoint+"?format=ndjson", nil)
+		for _, cookie := range _httpTestsCookies {
+			r.AddCookie(cookie)
+		}
+
+		w := httptest.NewRecorder()
+		newHttpHandler(false).ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Flushed, ShouldBeTrue)
+		So(w.Body.String(), ShouldContainSubstring, `"user-2"`)
+	})
+}
+
+func TestHandleHttpUserRolesRequests(t *testing.T) {
+	Convey("Set and get User roles", t, func() {
+		setupHttpTests()
+
+		endpoint := strings.Replace(SetUserRolesEndpoint, _testEndpointVarId, "user-2", 1)
+		r := httptest.NewRequest(http.MethodPut, endpoint, bytes.NewBufferString(`["operator", "auditor"]`))
+		r = mux.SetURLVars(r, map[string]string{endpointVarId: "user-2"})
+		for _, cookie := range _httpTestsCookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		_httpTestGetHandler(HandleHttpSetUserRolesRequest).ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, http.StatusOK)
 
 		r = httptest.NewRequest(http.MethodGet, endpoint, nil)
+		r = mux.SetURLVars(r, map[string]string{endpointVarId: "user-2"})
+		for _, cookie := range _httpTestsCookies {
+			r.AddCookie(cookie)
+		}
 		w = httptest.NewRecorder()
+		_httpTestGetHandler(HandleHttpGetUserRolesRequest).ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, http.StatusOK)
 
-		handler = _httpTestGetHandler(HandleHttpGetUserRequest)
-		handler.ServeHTTP(w, r)
+		var roles []Role
+		err := json.NewDecoder(w.Body).Decode(&roles)
+		So(err, ShouldBeNil)
+		So(roles, ShouldResemble, []Role{RoleOperator, RoleAuditor})
+
+		r = httptest.NewRequest(http.MethodPut, endpoint, bytes.NewBufferString(`"admin"`))
+		r = mux.SetURLVars(r, map[string]string{endpointVarId: "user-2"})
+		for _, cookie := range _httpTestsCookies {
+			r.AddCookie(cookie)
+		}
+		w = httptest.NewRecorder()
+		_httpTestGetHandler(HandleHttpSetUserRolesRequest).ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, http.StatusBadRequest)
+	})
+}
 
+func _httpTestLogin(login string, password string) []*http.Cookie {
+	r := httptest.NewRequest(http.MethodPost, LoginEndpoint, bytes.NewBufferString(fmt.Sprintf(`{"login": "%s", "password": "%s"}`, login, password)))
+	r.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	_httpTestGetHandler(HandleHttpLoginRequest).ServeHTTP(w, r)
+	So(w.Code, ShouldEqual, http.StatusOK)
+	return w.Result().Cookies()
+}
 
-		res2 := w.Result()
-		defer func() {
-			_ = res2.Body.Close()
-		}()
-		So(res2.StatusCode, ShouldEqual, http.StatusOK)
+func _httpTestGetUserStatus(userId string, cookies []*http.Cookie) int {
+	r := httptest.NewRequest(http.MethodGet, strings.Replace(GetUserEndpoint, _testEndpointVarId, userId, 1), nil)
+	r = mux.SetURLVars(r, map[string]string{endpointVarId: userId})
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	_httpTestGetHandler(HandleHttpGetUserRequest).ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestHandleHttpSessionRequests(t *testing.T) {
+	Convey("Logout, list and revoke sessions", t, func() {
+		setupHttpTests()
+
+		cookies := _httpTestLogin("user-4", "pass-4")
+		So(_httpTestGetUserStatus("user-4", cookies), ShouldEqual, http.StatusOK)
+
+		r := httptest.NewRequest(http.MethodPost, LogoutEndpoint, nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		_httpTestGetHandler(HandleHttpLogoutRequest).ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Result().Cookies()[0].MaxAge, ShouldBeLessThan, 0)
+
+		// The cookie of a revoked session is not honored even if the client keeps it
+		So(_httpTestGetUserStatus("user-4", cookies), ShouldEqual, http.StatusForbidden)
+
+		cookies = _httpTestLogin("user-4", "pass-4")
+		_ = _httpTestLogin("user-4", "pass-4")
+
+		endpoint := strings.Replace(ListUserSessionsEndpoint, _testEndpointVarId, "user-4", 1)
+		r = httptest.NewRequest(http.MethodGet, endpoint, nil)
+		r = mux.SetURLVars(r, map[string]string{endpointVarId: "user-4"})
+		for _, cookie := range _httpTestsCookies {
+			r.AddCookie(cookie)
+		}
+		w = httptest.NewRecorder()
+		_httpTestGetHandler(HandleHttpListUserSessionsRequest).ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, http.StatusOK)
 
-		var user *_httpTestUser
-		err := json.NewDecoder(r.Body).Decode(&user)
+		var sessions []Session
+		err := json.NewDecoder(w.Body).Decode(&sessions)
 		So(err, ShouldBeNil)
+		So(sessions, ShouldHaveLength, 2)
+		So(sessions[0].User, ShouldEqual, "user-4")
 
-		So(user.Id, ShouldEqual, "user-2")
-		So(user.Password, ShouldEqual, "pass-2-updated")
-		So(user.Data, ShouldEqual, "data-2-updated")
+		r = httptest.NewRequest(http.MethodGet, endpoint, nil)
+		r = mux.SetURLVars(r, map[string]string{endpointVarId: "user-4"})
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w = httptest.NewRecorder()
+		_httpTestGetHandler(HandleHttpListUserSessionsRequest).ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, http.StatusForbidden)
+
+		endpoint = strings.Replace(RevokeUserSessionsEndpoint, _testEndpointVarId, "user-4", 1)
+		r = httptest.NewRequest(http.MethodDelete, endpoint, nil)
+		r = mux.SetURLVars(r, map[string]string{endpointVarId: "user-4"})
+		for _, cookie := range _httpTestsCookies {
+			r.AddCookie(cookie)
+		}
+		w = httptest.NewRecorder()
+		_httpTestGetHandler(HandleHttpRevokeUserSessionsRequest).ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, http.StatusOK)
+
+		So(_httpTestGetUserStatus("user-4", cookies), ShouldEqual, http.StatusForbidden)
 	})
 }
 
-func TestHandleHttpDeleteUserRequest(t *testing.T) {
-	Convey("", t, func() {
+func _httpTestRequestTokens(bodyContent string) (int, *TokenPair) {
+	r := httptest.NewRequest(http.MethodPost, TokenEndpoint, bytes.NewBufferString(bodyContent))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	_httpTestGetHandler(HandleHttpTokenRequest).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+
+	tokens := &TokenPair{}
+	err := json.NewDecoder(w.Body).Decode(tokens)
+	So(err, ShouldBeNil)
+	return w.Code, tokens
+}
+
+func _httpTestBearerRequest(method string, endpoint string, userId string, credential string, body string, f http.HandlerFunc) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, strings.Replace(endpoint, _testEndpointVarId, userId, 1), bytes.NewBufferString(body))
+	r = mux.SetURLVars(r, map[string]string{endpointVarId: userId})
+	r.Header.Set("Authorization", "Bearer "+credential)
+	w := httptest.NewRecorder()
+	_httpTestGetHandler(f).ServeHTTP(w, r)
+	return w
+}
+
+func TestHandleHttpTokenRequest(t *testing.T) {
+	Convey("Access tokens and refresh tokens", t, func() {
+		setupHttpTests()
+
+		status, _ := _httpTestRequestTokens(`{"grant_type": "password", "login": "user-5", "password": "wrong"}`)
+		So(status, ShouldEqual, http.StatusForbidden)
+
+		status, _ = _httpTestRequestTokens(`{"grant_type": "client_credentials"}`)
+		So(status, ShouldEqual, http.StatusBadRequest)
+
+		status, tokens := _httpTestRequestTokens(`{"grant_type": "password", "login": "user-5", "password": "pass-5"}`)
+		So(status, ShouldEqual, http.StatusOK)
+		So(tokens.AccessToken, ShouldNotBeEmpty)
+		So(tokens.RefreshToken, ShouldNotBeEmpty)
+
+		w := _httpTestBearerRequest(http.MethodGet, GetUserEndpoint, "user-5", tokens.AccessToken, "", HandleHttpGetUserRequest)
+		So(w.Code, ShouldEqual, http.StatusOK)
+
+		w = _httpTestBearerRequest(http.MethodGet, GetUserEndpoint, "user-3", tokens.AccessToken, "", HandleHttpGetUserRequest)
+		So(w.Code, ShouldEqual, http.StatusUnauthorized)
+
+		w = _httpTestBearerRequest(http.MethodGet, GetUserEndpoint, "user-5", tokens.RefreshToken, "", HandleHttpGetUserRequest)
+		So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		So(w.Header().Get("WWW-Authenticate"), ShouldContainSubstring, "invalid_token")
+
+		status, refreshed := _httpTestRequestTokens(fmt.Sprintf(`{"grant_type": "refresh_token", "refresh_token": "%s"}`, tokens.RefreshToken))
+		So(status, ShouldEqual, http.StatusOK)
+
+		w = _httpTestBearerRequest(http.MethodGet, GetUserEndpoint, "user-5", refreshed.AccessToken, "", HandleHttpGetUserRequest)
+		So(w.Code, ShouldEqual, http.StatusOK)
+
+		w = _httpTestBearerRequest(http.MethodPost, LogoutEndpoint, "", refreshed.AccessToken, "", HandleHttpLogoutRequest)
+		So(w.Code, ShouldEqual, http.StatusOK)
+
+		// Logging out revokes the session the tokens are bound to
+		w = _httpTestBearerRequest(http.MethodGet, GetUserEndpoint, "user-5", tokens.AccessToken, "", HandleHttpGetUserRequest)
+		So(w.Code, ShouldEqual, http.StatusUnauthorized)
 
-		bodyContent := `{
-			"id": "user-2",
-			"password": "pass-2-updated",
-			"data": "data-2-updated"}`
+		status, _ = _httpTestRequestTokens(fmt.Sprintf(`{"grant_type": "refresh_token", "refresh_token": "%s"}`, tokens.RefreshToken))
+		So(status, ShouldEqual, http.StatusUnauthorized)
+	})
+}
 
-		endpoint := strings.Replace(DeleteUserEndpoint, _testEndpointVarId, "user-2", 1)
+func TestHandleHttpAPIKeyRequests(t *testing.T) {
+	Convey("Create, use, list and delete API keys", t, func() {
+		setupHttpTests()
 
-		r := httptest.NewRequest(http.MethodPatch, endpoint, bytes.NewBufferString(bodyContent))
+		endpoint := strings.Replace(CreateAPIKeyEndpoint, _testEndpointVarId, "user-5", 1)
+		r := httptest.NewRequest(http.MethodPost, endpoint, bytes.NewBufferString(`{"name": "reader", "scopes": ["self:read"]}`))
+		r = mux.SetURLVars(r, map[string]string{endpointVarId: "user-5"})
+		for _, cookie := range _httpTestsCookies {
+			r.AddCookie(cookie)
+		}
 		w := httptest.NewRecorder()
+		_httpTestGetHandler(HandleHttpCreateAPIKeyRequest).ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, http.StatusCreated)
 
-		handler := _httpTestGetHandler(HandleHttpDeleteUserRequest)
-		handler.ServeHTTP(w, r)
+		key := &APIKey{}
+		err := json.NewDecoder(w.Body).Decode(key)
+		So(err, ShouldBeNil)
+		So(key.Secret, ShouldNotBeEmpty)
 
-		res := w.Result()
+		w = _httpTestBearerRequest(http.MethodGet, GetUserEndpoint, "user-5", key.Secret, "", HandleHttpGetUserRequest)
+		So(w.Code, ShouldEqual, http.StatusOK)
+
+		w = _httpTestBearerRequest(http.MethodPatch, UpdateUserEndpoint, "user-5", key.Secret, `{"data": "from key"}`, HandleHttpUpdateUserRequest)
+		So(w.Code, ShouldEqual, http.StatusUnauthorized)
+
+		w = _httpTestBearerRequest(http.MethodGet, ListAPIKeysEndpoint, "user-5", key.Secret, "", HandleHttpListAPIKeysRequest)
+		So(w.Code, ShouldEqual, http.StatusUnauthorized)
+
+		endpoint = strings.Replace(ListAPIKeysEndpoint, _testEndpointVarId, "user-5", 1)
+		r = httptest.NewRequest(http.MethodGet, endpoint, nil)
+		r = mux.SetURLVars(r, map[string]string{endpointVarId: "user-5"})
+		for _, cookie := range _httpTestsCookies {
+			r.AddCookie(cookie)
+		}
+		w = httptest.NewRecorder()
+		_httpTestGetHandler(HandleHttpListAPIKeysRequest).ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Body.String(), ShouldNotContainSubstring, key.Secret)
+
+		var keys []APIKey
+		err = json.NewDecoder(w.Body).Decode(&keys)
+		So(err, ShouldBeNil)
+		So(keys, ShouldHaveLength, 1)
+		So(keys[0].Id, ShouldEqual, key.Id)
+
+		endpoint = strings.Replace(strings.Replace(DeleteAPIKeyEndpoint, _testEndpointVarId, "user-5", 1), "{"+endpointVarKeyId+"}", key.Id, 1)
+		r = httptest.NewRequest(http.MethodDelete, endpoint, nil)
+		r = mux.SetURLVars(r, map[string]string{endpointVarId: "user-5", endpointVarKeyId: key.Id})
+		for _, cookie := range _httpTestsCookies {
+			r.AddCookie(cookie)
+		}
+		w = httptest.NewRecorder()
+		_httpTestGetHandler(HandleHttpDeleteAPIKeyRequest).ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, http.StatusOK)
+
+		w = _httpTestBearerRequest(http.MethodGet, GetUserEndpoint, "user-5", key.Secret, "", HandleHttpGetUserRequest)
+		So(w.Code, ShouldEqual, http.StatusUnauthorized)
+	})
+}
+
+func TestHandleHttpLoginRequestLockout(t *testing.T) {
+	Convey("Login must answer 429 with Retry-After while the account is locked", t, func() {
+		setupHttpTests()
+
+		login := func(password string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodPost, LoginEndpoint, bytes.NewBufferString(fmt.Sprintf(`{"login": "user-3", "password": "%s"}`, password)))
+			r.Header.Add("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			_httpTestGetHandler(HandleHttpLoginRequest).ServeHTTP(w, r)
+			return w
+		}
+
+		for i := 0; i < DefaultLoginThrottlePolicy.MaxAccountFailures; i++ {
+			So(login("wrong").Code, ShouldEqual, http.StatusForbidden)
+		}
+
+		w := login("pass-3")
+		So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+		So(w.Header().Get("Retry-After"), ShouldNotBeEmpty)
+
+		endpoint := strings.Replace(UnlockUserEndpoint, _testEndpointVarId, "user-3", 1)
+		r := httptest.NewRequest(http.MethodPost, endpoint, nil)
+		r = mux.SetURLVars(r, map[string]string{endpointVarId: "user-3"})
+		for _, cookie := range _httpTestsCookies {
+			r.AddCookie(cookie)
+		}
+		w = httptest.NewRecorder()
+		_httpTestGetHandler(HandleHttpUnlockUserRequest).ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, http.StatusOK)
+
+		So(login("pass-3").Code, ShouldEqual, http.StatusOK)
+	})
+}
+
+func TestHandleHttpMetricsRequest(t *testing.T) {
+	Convey("The metrics endpoint must expose the requests by route, the logins and the storage operations", t, func() {
+		setupHttpTests()
+
+		dataStore, files := Env.DataStore, Env.Files
+		Env.DataStore = newInstrumentedDataStore(Env.DataStore)
+		Env.Files = newInstrumentedFiles(Env.Files)
+		defer func() {
+			Env.DataStore, Env.Files = dataStore, files
+		}()
+
+		server := httptest.NewServer(newHttpHandler(true))
+		defer server.Close()
+		adminServer := httptest.NewServer(newAdminHttpHandler())
+		defer adminServer.Close()
+
+		login := func(password string) int {
+			res, err := http.Post(server.URL+LoginEndpoint, "application/json", bytes.NewBufferString(fmt.Sprintf(`{"login": "user-4", "password": "%s"}`, password)))
+			So(err, ShouldBeNil)
+			_ = res.Body.Close()
+			return res.StatusCode
+		}
+		successes := metrics.logins.Value("success")
+		failures := metrics.logins.Value("failure")
+		So(login("pass-4"), ShouldEqual, http.StatusOK)
+		So(login("wrong"), ShouldEqual, http.StatusForbidden)
+		So(metrics.logins.Value("success"), ShouldEqual, successes+1)
+		So(metrics.logins.Value("failure"), ShouldEqual, failures+1)
+
+		res, err := http.Get(server.URL + "/unknown")
+		So(err, ShouldBeNil)
+		_ = res.Body.Close()
+		So(res.StatusCode, ShouldEqual, http.StatusNotFound)
+
+		res, err = http.Get(server.URL + MetricsEndpoint)
+		So(err, ShouldBeNil)
+		_ = res.Body.Close()
+		So(res.StatusCode, ShouldEqual, http.StatusNotFound)
+
+		res, err = http.Get(adminServer.URL + MetricsEndpoint)
+		So(err, ShouldBeNil)
 		defer func() {
 			_ = res.Body.Close()
 		}()
 		So(res.StatusCode, ShouldEqual, http.StatusOK)
+		So(res.Header.Get("Content-Type"), ShouldStartWith, "text/plain; version=0.0.4")
+
+		body, err := ioutil.ReadAll(res.Body)
+		So(err, ShouldBeNil)
+		text := string(body)
+		So(text, ShouldContainSubstring, "# TYPE ditt_http_requests_total counter\n")
+		So(text, ShouldContainSubstring, `ditt_http_requests_total{route="Login",code="200"} `)
+		So(text, ShouldContainSubstring, `ditt_http_requests_total{route="Login",code="403"} `)
+		So(text, ShouldContainSubstring, `ditt_http_requests_total{route="unmatched",code="404"} `)
+		So(text, ShouldContainSubstring, `ditt_http_request_duration_seconds_bucket{route="Login",le="+Inf"} `)
+		So(text, ShouldContainSubstring, `ditt_logins_total{result="success"} `)
+		So(text, ShouldContainSubstring, `ditt_import_records_processed_total `)
+		So(text, ShouldContainSubstring, `ditt_runner_queue_depth 0`)
+		So(text, ShouldContainSubstring, `ditt_password_hash_duration_seconds_count{algorithm="bcrypt",operation="verify"} `)
+		So(text, ShouldContainSubstring, `ditt_store_operation_duration_seconds_count{operation="Get"} `)
+	})
+}
 
-		// Loading update user data
+func _httpTestGet(handler http.Handler, target string) (int, []byte) {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Code, w.Body.Bytes()
+}
 
-		endpoint = strings.Replace(GetUserEndpoint, _testEndpointVarId, "user-2", 1)
+func TestHandleHttpHealthRequests(t *testing.T) {
+	Convey("Health, readiness and version endpoints must report the process and backends state", t, func() {
+		setupHttpTests()
 
-		r = httptest.NewRequest(http.MethodGet, endpoint, nil)
-		w = httptest.NewRecorder()
+		handler := newHttpHandler(true)
 
-		handler = _httpTestGetHandler(HandleHttpGetUserRequest)
-		handler.ServeHTTP(w, r)
+		code, body := _httpTestGet(handler, HealthEndpoint)
+		So(code, ShouldEqual, http.StatusOK)
+		var health HealthResponse
+		So(json.Unmarshal(body, &health), ShouldBeNil)
+		So(health.Status, ShouldEqual, "ok")
+
+		code, body = _httpTestGet(handler, ReadinessEndpoint)
+		So(code, ShouldEqual, http.StatusOK)
+		var readiness HealthResponse
+		So(json.Unmarshal(body, &readiness), ShouldBeNil)
+		So(readiness.Status, ShouldEqual, "ready")
+		So(readiness.Checks, ShouldResemble, map[string]string{"store": "ok", "files": "ok"})
+
+		files := Env.Files
+		Env.Files = NewDirFiles(filepath.Join(os.TempDir(), "ditt-missing-files-dir"))
+		code, body = _httpTestGet(handler, ReadinessEndpoint)
+		Env.Files = files
+		So(code, ShouldEqual, http.StatusServiceUnavailable)
+		readiness = HealthResponse{}
+		So(json.Unmarshal(body, &readiness), ShouldBeNil)
+		So(readiness.Status, ShouldEqual, "unavailable")
+		So(readiness.Checks, ShouldResemble, map[string]string{"store": "ok", "files": "unavailable"})
 
+		code, body = _httpTestGet(handler, VersionEndpoint)
+		So(code, ShouldEqual, http.StatusOK)
+		var version VersionResponse
+		So(json.Unmarshal(body, &version), ShouldBeNil)
+		So(version.Version, ShouldEqual, info.Version)
+		So(version.BuildRevision, ShouldEqual, info.BuildRevision)
 
-		res2 := w.Result()
+		Convey("They must only be served by the admin handler when the admin port is set", func() {
+			code, _ := _httpTestGet(newHttpHandler(false), HealthEndpoint)
+			So(code, ShouldEqual, http.StatusNotFound)
+
+			adminHandler := newAdminHttpHandler()
+			code, _ = _httpTestGet(adminHandler, HealthEndpoint)
+			So(code, ShouldEqual, http.StatusOK)
+			code, _ = _httpTestGet(adminHandler, MetricsEndpoint)
+			So(code, ShouldEqual, http.StatusOK)
+			code, _ = _httpTestGet(adminHandler, "/users/list")
+			So(code, ShouldEqual, http.StatusNotFound)
+		})
+	})
+}
+
+func TestServeShutdown(t *testing.T) {
+	Convey("Serve must wait for the running imports once its context is done", t, func() {
+		env := Env
 		defer func() {
-			_ = res2.Body.Close()
+			Env = env
 		}()
-		So(res2.StatusCode, ShouldEqual, http.StatusNotFound)
+
+		serve := func(gracePeriod time.Duration) (context.CancelFunc, chan error) {
+			ctx, cancel := context.WithCancel(context.Background())
+			served := make(chan error, 1)
+			go func() {
+				served <- Serve(ctx, &Config{
+					Port:                0,
+					TokenSigningKey:     env.TokenSigningKey,
+					Logger:              NewLogger(ioutil.Discard, LogLevelInfo, LogFormatLogfmt),
+					ShutdownGracePeriod: gracePeriod,
+				})
+			}()
+			return cancel, served
+		}
+
+		runningAddUsers.begin()
+		cancel, served := serve(time.Minute)
+		cancel()
+
+		select {
+		case <-served:
+			So("Serve returned before the import ended", ShouldBeEmpty)
+		case <-time.After(100 * time.Millisecond):
+		}
+		runningAddUsers.end()
+		So(<-served, ShouldBeNil)
+
+		Convey("The imports still running at the end of the grace period must be canceled", func() {
+			jobCtx, cancelJob := context.WithCancel(context.Background())
+			runningImportJobs.add("shutdown-job", cancelJob)
+			runningAddUsers.begin()
+			go func() {
+				<-jobCtx.Done()
+				runningImportJobs.remove("shutdown-job")
+				runningAddUsers.end()
+			}()
+
+			cancel, served := serve(50 * time.Millisecond)
+			cancel()
+			So(<-served, ShouldBeNil)
+			So(jobCtx.Err(), ShouldEqual, context.Canceled)
+		})
 	})
 }
 
-*/
+// _testClosingDataStore records the state of an import job when it is closed
+type _testClosingDataStore struct {
+	UserDataStore
+	jobId        string
+	stateAtClose ImportJobState
+}
+
+func (s *_testClosingDataStore) Close() error {
+	job, err := s.UserDataStore.GetImportJob(context.Background(), s.jobId)
+	if err != nil {
+		return err
+	}
+	s.stateAtClose = job.State
+	return nil
+}
+
+func TestServeShutdownImportJob(t *testing.T) {
+	Convey("Serve must not close the store before the canceled import jobs save their state", t, func() {
+		env := Env
+		defer func() {
+			Env = env
+		}()
+
+		records := make([]string, 200)
+		for i := range records {
+			records[i] = fmt.Sprintf(`{"id": "draugr-%d", "password": "draugr-pass"}`, i)
+		}
+
+		adminContext := ContextWithLoggedUser(context.Background(), "admin")
+		job, err := NewAPIHandler().StartImportJob(adminContext, strings.NewReader("["+strings.Join(records, ",")+"]"), AddUsersOptions{})
+		So(err, ShouldBeNil)
+
+		store := &_testClosingDataStore{UserDataStore: env.DataStore, jobId: job.Id}
+		Env.DataStore = store
+
+		ctx, cancel := context.WithCancel(context.Background())
+		served := make(chan error, 1)
+		go func() {
+			served <- Serve(ctx, &Config{
+				Port:                0,
+				TokenSigningKey:     env.TokenSigningKey,
+				Logger:              NewLogger(ioutil.Discard, LogLevelInfo, LogFormatLogfmt),
+				ShutdownGracePeriod: 10 * time.Millisecond,
+			})
+		}()
+		cancel()
+		So(<-served, ShouldBeNil)
+		So(store.stateAtClose, ShouldEqual, ImportJobCanceled)
+	})
+}
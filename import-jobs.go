@@ -0,0 +1,135 @@
+package ditt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ImportJobState is the state of an ImportJob
+type ImportJobState string
+
+const (
+	// ImportJobRunning is the state of a job whose users are being imported
+	ImportJobRunning ImportJobState = "running"
+
+	// ImportJobDone is the state of a job whose stream has been entirely processed
+	ImportJobDone ImportJobState = "done"
+
+	// ImportJobFailed is the state of a job that stopped because of an error
+	ImportJobFailed ImportJobState = "failed"
+
+	// ImportJobCanceled is the state of a job that has been canceled
+	ImportJobCanceled ImportJobState = "canceled"
+
+	// ImportJobInterrupted is the state of a job that was running when the server stopped
+	ImportJobInterrupted ImportJobState = "interrupted"
+)
+
+const (
+	importJobProgressSavingInterval = time.Second
+
+	// importJobMaxFailures is the number of failures kept in a job. It bounds the size of the saved job document
+	importJobMaxFailures = 1000
+)
+
+// ImportJob holds info about an asynchronous users import. Failures only holds the first failures,
+// Failed counts them all
+type ImportJob struct {
+	Id         string         `json:"id" bson:"id"`
+	Owner      string         `json:"owner" bson:"owner"`
+	State      ImportJobState `json:"state" bson:"state"`
+	OnConflict ConflictPolicy `json:"on_conflict" bson:"on_conflict"`
+	Processed  int            `json:"processed" bson:"processed"`
+	Failed     int            `json:"failed" bson:"failed"`
+	BytesRead  int64          `json:"bytes_read" bson:"bytes_read"`
+	TotalBytes int64          `json:"total_bytes" bson:"total_bytes"`
+	Error      string         `json:"error,omitempty" bson:"error,omitempty"`
+	CreatedAt  time.Time      `json:"created_at" bson:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at" bson:"updated_at"`
+	Failures   []UserFailure  `json:"failures,omitempty" bson:"failures,omitempty"`
+}
+
+// Finished tells whether the job is not running anymore
+func (j *ImportJob) Finished() bool {
+	return j.State != ImportJobRunning
+}
+
+func newImportJobId() (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// importJobRegistry references the cancel functions of the jobs running in this process
+type importJobRegistry struct {
+	sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+func (r *importJobRegistry) add(jobId string, cancel context.CancelFunc) {
+	r.Lock()
+	defer r.Unlock()
+	r.cancels[jobId] = cancel
+}
+
+func (r *importJobRegistry) remove(jobId string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.cancels, jobId)
+}
+
+func (r *importJobRegistry) running(jobId string) bool {
+	r.Lock()
+	defer r.Unlock()
+	_, found := r.cancels[jobId]
+	return found
+}
+
+func (r *importJobRegistry) cancel(jobId string) bool {
+	r.Lock()
+	defer r.Unlock()
+	cancel, found := r.cancels[jobId]
+	if found {
+		cancel()
+	}
+	return found
+}
+
+// cancelAll cancels all the running jobs
+func (r *importJobRegistry) cancelAll() {
+	r.Lock()
+	defer r.Unlock()
+	for _, cancel := range r.cancels {
+		cancel()
+	}
+}
+
+var runningImportJobs = &importJobRegistry{cancels: map[string]context.CancelFunc{}}
+
+// importJobReader counts the bytes read from the spool and stops the reading once the job context is done
+type importJobReader struct {
+	ctx       context.Context
+	reader    io.Reader
+	bytesRead int64
+}
+
+func (r *importJobReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(&r.bytesRead, int64(n))
+	return n, err
+}
+
+func (r *importJobReader) BytesRead() int64 {
+	return atomic.LoadInt64(&r.bytesRead)
+}
@@ -0,0 +1,219 @@
+package ditt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log record
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogLevelDebug: "debug",
+	LogLevelInfo:  "info",
+	LogLevelWarn:  "warn",
+	LogLevelError: "error",
+}
+
+func (l LogLevel) String() string {
+	if name, found := logLevelNames[l]; found {
+		return name
+	}
+	return strconv.Itoa(int(l))
+}
+
+// ParseLogLevel returns the level named "name": debug, info, warn or error
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return LogLevelInfo, fmt.Errorf("unknown log level '%s'", name)
+}
+
+// LogFormat is the encoding of the log records
+type LogFormat string
+
+const (
+	// LogFormatLogfmt writes a record per line as space separated key=value pairs
+	LogFormatLogfmt LogFormat = "logfmt"
+
+	// LogFormatJSON writes a record per line as a JSON object
+	LogFormatJSON LogFormat = "json"
+)
+
+// Valid tells whether the format is known
+func (f LogFormat) Valid() bool {
+	return f == LogFormatLogfmt || f == LogFormatJSON
+}
+
+// logOutput is shared by a Logger and the loggers derived from it
+type logOutput struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	level  LogLevel
+	format LogFormat
+}
+
+// Logger writes leveled records made of a message and of key-value fields. A nil Logger discards the records
+type Logger struct {
+	output *logOutput
+	fields []interface{}
+}
+
+// NewLogger creates a Logger that writes the records of at least "level" to the writer
+func NewLogger(writer io.Writer, level LogLevel, format LogFormat) *Logger {
+	return &Logger{output: &logOutput{writer: writer, level: level, format: format}}
+}
+
+// With returns a logger that adds the key-value pairs to each record
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{output: l.output, fields: fields}
+}
+
+// WithContext returns a logger that adds the request id held by the context to each record
+func (l *Logger) WithContext(ctx context.Context) *Logger {
+	if requestId := GetRequestId(ctx); requestId != "" {
+		return l.With("request_id", requestId)
+	}
+	return l
+}
+
+// Enabled tells whether the records of the level are written
+func (l *Logger) Enabled(level LogLevel) bool {
+	return l != nil && level >= l.output.level
+}
+
+func (l *Logger) Debug(message string, keyvals ...interface{}) {
+	l.log(LogLevelDebug, message, keyvals)
+}
+
+func (l *Logger) Info(message string, keyvals ...interface{}) {
+	l.log(LogLevelInfo, message, keyvals)
+}
+
+func (l *Logger) Warn(message string, keyvals ...interface{}) {
+	l.log(LogLevelWarn, message, keyvals)
+}
+
+func (l *Logger) Error(message string, keyvals ...interface{}) {
+	l.log(LogLevelError, message, keyvals)
+}
+
+func (l *Logger) log(level LogLevel, message string, keyvals []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	fields := []interface{}{
+		"time", time.Now().UTC().Format(time.RFC3339Nano),
+		"level", level.String(),
+		"msg", message,
+	}
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "")
+	}
+
+	buf := &bytes.Buffer{}
+	if l.output.format == LogFormatJSON {
+		encodeJSONLogRecord(buf, fields)
+	} else {
+		encodeLogfmtRecord(buf, fields)
+	}
+	buf.WriteByte('\n')
+
+	l.output.mutex.Lock()
+	defer l.output.mutex.Unlock()
+	_, _ = l.output.writer.Write(buf.Bytes())
+}
+
+// Sync flushes the records held by the writer if it buffers them
+func (l *Logger) Sync() error {
+	if l == nil {
+		return nil
+	}
+
+	l.output.mutex.Lock()
+	defer l.output.mutex.Unlock()
+	switch writer := l.output.writer.(type) {
+	case interface{ Sync() error }:
+		return writer.Sync()
+	case interface{ Flush() error }:
+		return writer.Flush()
+	default:
+		return nil
+	}
+}
+
+// logValue converts the errors, the durations and the other values that do not encode well
+func logValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
+
+func encodeJSONLogRecord(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		value, err := json.Marshal(logValue(fields[i+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(fields[i+1]))
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+}
+
+func encodeLogfmtRecord(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(fmt.Sprint(fields[i]))
+		buf.WriteByte('=')
+
+		value := fmt.Sprint(logValue(fields[i+1]))
+		if value == "" || strings.ContainsAny(value, " =\"\\\t\r\n") {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+}
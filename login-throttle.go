@@ -0,0 +1,242 @@
+package ditt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// LoginFailures holds the consecutive login failures recorded for an account or a client address
+type LoginFailures struct {
+	Count         int       `json:"count"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	LockedUntil   time.Time `json:"locked_until"`
+}
+
+// LoginThrottleStore is a convenience for login failure counters persistence.
+// Keys are built by loginAccountKey and loginAddressKey
+type LoginThrottleStore interface {
+
+	// Get retrieves the failures recorded for the key. It fails with NotFound if there is none
+	Get(ctx context.Context, key string) (*LoginFailures, error)
+
+	// AddFailure increments the failures count of the key and returns the updated failures.
+	// The count restarts from zero if the last failure happened more than "window" before "now"
+	AddFailure(ctx context.Context, key string, now time.Time, window time.Duration) (*LoginFailures, error)
+
+	// Lock rejects the logins of the key until the given time
+	Lock(ctx context.Context, key string, until time.Time) error
+
+	// Reset deletes the failures recorded for the key
+	Reset(ctx context.Context, key string) error
+}
+
+// LoginThrottlePolicy tells how many failures are tolerated and how long the lockouts last
+type LoginThrottlePolicy struct {
+	// MaxAccountFailures is the number of consecutive failures on an account before it gets locked
+	MaxAccountFailures int `json:"max_account_failures"`
+
+	// MaxAddressFailures is the number of consecutive failures from a client address before it gets locked
+	MaxAddressFailures int `json:"max_address_failures"`
+
+	// BaseLockout is the duration of the first lockout. It doubles with each further failure
+	BaseLockout time.Duration `json:"base_lockout"`
+
+	// MaxLockout caps the lockouts duration. 0 leaves them uncapped
+	MaxLockout time.Duration `json:"max_lockout"`
+
+	// Window is the duration after which the failures are forgotten
+	Window time.Duration `json:"window"`
+}
+
+// DefaultLoginThrottlePolicy is the policy applied when Env.LoginThrottlePolicy is not set
+var DefaultLoginThrottlePolicy = LoginThrottlePolicy{
+	MaxAccountFailures: 5,
+	MaxAddressFailures: 20,
+	BaseLockout:        30 * time.Second,
+	MaxLockout:         15 * time.Minute,
+	Window:             15 * time.Minute,
+}
+
+// LockoutError is returned by Login while the account or the client address is locked
+type LockoutError struct {
+	Until time.Time
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("too many login failures, retry after %s", e.Until.Format(time.RFC3339))
+}
+
+// Is makes a LockoutError match TooManyAttempts
+func (e *LockoutError) Is(target error) bool {
+	return errors.Is(target, TooManyAttempts)
+}
+
+// RetryAfter returns the number of seconds to wait before the lockout ends
+func (e *LockoutError) RetryAfter(now time.Time) int {
+	return int(math.Ceil(e.Until.Sub(now).Seconds()))
+}
+
+func loginAccountKey(login string) string {
+	return "account:" + login
+}
+
+func loginAddressKey(address string) string {
+	return "address:" + address
+}
+
+func loginThrottlePolicy() LoginThrottlePolicy {
+	if Env.LoginThrottlePolicy != nil {
+		return *Env.LoginThrottlePolicy
+	}
+	return DefaultLoginThrottlePolicy
+}
+
+// lockoutDuration returns how long a key that reached "failures" is locked. It is zero under "max" failures
+func (p *LoginThrottlePolicy) lockoutDuration(failures int, max int) time.Duration {
+	if max <= 0 || failures < max {
+		return 0
+	}
+
+	// An uncapped lockout stops doubling before it overflows
+	lockout := p.BaseLockout
+	for i := max; i < failures && (p.MaxLockout <= 0 || lockout < p.MaxLockout) && lockout <= math.MaxInt64/2; i++ {
+		lockout *= 2
+	}
+	if p.MaxLockout > 0 && lockout > p.MaxLockout {
+		lockout = p.MaxLockout
+	}
+	return lockout
+}
+
+// loginThrottleKeys returns the keys of the login attempt along with the failures tolerated for each
+func loginThrottleKeys(ctx context.Context, login string) map[string]int {
+	policy := loginThrottlePolicy()
+	keys := map[string]int{
+		loginAccountKey(login): policy.MaxAccountFailures,
+	}
+
+	if address := GetClientAddress(ctx); address != "" {
+		keys[loginAddressKey(address)] = policy.MaxAddressFailures
+	}
+	return keys
+}
+
+// checkLoginAllowed fails with a LockoutError if the account or the client address is locked
+func checkLoginAllowed(ctx context.Context, login string) error {
+	now := time.Now()
+	for key := range loginThrottleKeys(ctx, login) {
+		failures, err := Env.LoginThrottle.Get(ctx, key)
+		if err != nil {
+			if errors.Is(err, NotFound) {
+				continue
+			}
+			return err
+		}
+
+		if failures.LockedUntil.After(now) {
+			return &LockoutError{Until: failures.LockedUntil}
+		}
+	}
+	return nil
+}
+
+// recordLoginFailure counts the failure for the account and the client address and locks those that exceeded the policy
+func recordLoginFailure(ctx context.Context, login string) error {
+	policy := loginThrottlePolicy()
+	now := time.Now()
+
+	for key, max := range loginThrottleKeys(ctx, login) {
+		failures, err := Env.LoginThrottle.AddFailure(ctx, key, now, policy.Window)
+		if err != nil {
+			return err
+		}
+
+		lockout := policy.lockoutDuration(failures.Count, max)
+		if lockout > 0 {
+			err = Env.LoginThrottle.Lock(ctx, key, now.Add(lockout))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resetLoginFailures forgets the failures of the account. The failures of the client address are kept
+// so that a known account cannot be used to reset them
+func resetLoginFailures(ctx context.Context, login string) error {
+	return Env.LoginThrottle.Reset(ctx, loginAccountKey(login))
+}
+
+type memoryLoginThrottleStore struct {
+	mutex     sync.Mutex
+	failures  map[string]LoginFailures
+	lastSweep time.Time
+}
+
+func (m *memoryLoginThrottleStore) Get(_ context.Context, key string) (*LoginFailures, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	failures, found := m.failures[key]
+	if !found {
+		return nil, NotFound
+	}
+	return &failures, nil
+}
+
+func (m *memoryLoginThrottleStore) AddFailure(_ context.Context, key string, now time.Time, window time.Duration) (*LoginFailures, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.sweep(now, window)
+
+	failures := m.failures[key]
+	if window > 0 && now.Sub(failures.LastFailureAt) > window {
+		failures.Count = 0
+	}
+	failures.Count++
+	failures.LastFailureAt = now
+	m.failures[key] = failures
+	return &failures, nil
+}
+
+// sweep deletes the counters that are neither recent nor locked, at most once per window
+func (m *memoryLoginThrottleStore) sweep(now time.Time, window time.Duration) {
+	if window <= 0 || now.Sub(m.lastSweep) < window {
+		return
+	}
+	m.lastSweep = now
+
+	for key, failures := range m.failures {
+		if now.Sub(failures.LastFailureAt) > window && !failures.LockedUntil.After(now) {
+			delete(m.failures, key)
+		}
+	}
+}
+
+func (m *memoryLoginThrottleStore) Lock(_ context.Context, key string, until time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	failures := m.failures[key]
+	failures.LockedUntil = until
+	m.failures[key] = failures
+	return nil
+}
+
+func (m *memoryLoginThrottleStore) Reset(_ context.Context, key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.failures, key)
+	return nil
+}
+
+// NewLoginThrottleMemoryStore creates a LoginThrottleStore that keeps the counters in memory
+func NewLoginThrottleMemoryStore() LoginThrottleStore {
+	return &memoryLoginThrottleStore{
+		failures: make(map[string]LoginFailures),
+	}
+}
@@ -0,0 +1,209 @@
+package ditt
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// instrumentedDataStore records the duration of each operation of the wrapped UserDataStore
+type instrumentedDataStore struct {
+	store UserDataStore
+}
+
+// newInstrumentedDataStore wraps the store so that the durations of its operations are exposed by the metrics endpoint
+func newInstrumentedDataStore(store UserDataStore) UserDataStore {
+	if _, ok := store.(*instrumentedDataStore); ok {
+		return store
+	}
+	return &instrumentedDataStore{store: store}
+}
+
+func (s *instrumentedDataStore) observe(operation string, start time.Time) {
+	metrics.storeOperationDuration.Observe(time.Since(start).Seconds(), operation)
+}
+
+func (s *instrumentedDataStore) SaveImportJob(ctx context.Context, job *ImportJob) error {
+	defer s.observe("SaveImportJob", time.Now())
+	return s.store.SaveImportJob(ctx, job)
+}
+
+func (s *instrumentedDataStore) GetImportJob(ctx context.Context, id string) (*ImportJob, error) {
+	defer s.observe("GetImportJob", time.Now())
+	return s.store.GetImportJob(ctx, id)
+}
+
+func (s *instrumentedDataStore) SaveRoles(ctx context.Context, userId string, roles []Role) error {
+	defer s.observe("SaveRoles", time.Now())
+	return s.store.SaveRoles(ctx, userId, roles)
+}
+
+func (s *instrumentedDataStore) GetRoles(ctx context.Context, userId string) ([]Role, error) {
+	defer s.observe("GetRoles", time.Now())
+	return s.store.GetRoles(ctx, userId)
+}
+
+func (s *instrumentedDataStore) SaveAdmin(ctx context.Context, admin *AdminAccount) error {
+	defer s.observe("SaveAdmin", time.Now())
+	return s.store.SaveAdmin(ctx, admin)
+}
+
+func (s *instrumentedDataStore) GetAdmin(ctx context.Context, login string) (*AdminAccount, error) {
+	defer s.observe("GetAdmin", time.Now())
+	return s.store.GetAdmin(ctx, login)
+}
+
+func (s *instrumentedDataStore) DeleteAdmin(ctx context.Context, login string) error {
+	defer s.observe("DeleteAdmin", time.Now())
+	return s.store.DeleteAdmin(ctx, login)
+}
+
+func (s *instrumentedDataStore) CountAdmins(ctx context.Context) (int, error) {
+	defer s.observe("CountAdmins", time.Now())
+	return s.store.CountAdmins(ctx)
+}
+
+func (s *instrumentedDataStore) SaveSession(ctx context.Context, session *Session) error {
+	defer s.observe("SaveSession", time.Now())
+	return s.store.SaveSession(ctx, session)
+}
+
+func (s *instrumentedDataStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	defer s.observe("GetSession", time.Now())
+	return s.store.GetSession(ctx, id)
+}
+
+func (s *instrumentedDataStore) TouchSession(ctx context.Context, id string, lastSeenAt time.Time) error {
+	defer s.observe("TouchSession", time.Now())
+	return s.store.TouchSession(ctx, id, lastSeenAt)
+}
+
+func (s *instrumentedDataStore) ListSessions(ctx context.Context, userId string) ([]Session, error) {
+	defer s.observe("ListSessions", time.Now())
+	return s.store.ListSessions(ctx, userId)
+}
+
+func (s *instrumentedDataStore) DeleteSession(ctx context.Context, id string) error {
+	defer s.observe("DeleteSession", time.Now())
+	return s.store.DeleteSession(ctx, id)
+}
+
+func (s *instrumentedDataStore) DeleteUserSessions(ctx context.Context, userId string) error {
+	defer s.observe("DeleteUserSessions", time.Now())
+	return s.store.DeleteUserSessions(ctx, userId)
+}
+
+func (s *instrumentedDataStore) SaveAPIKey(ctx context.Context, key *APIKey) error {
+	defer s.observe("SaveAPIKey", time.Now())
+	return s.store.SaveAPIKey(ctx, key)
+}
+
+func (s *instrumentedDataStore) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	defer s.observe("GetAPIKey", time.Now())
+	return s.store.GetAPIKey(ctx, id)
+}
+
+func (s *instrumentedDataStore) ListAPIKeys(ctx context.Context, userId string) ([]APIKey, error) {
+	defer s.observe("ListAPIKeys", time.Now())
+	return s.store.ListAPIKeys(ctx, userId)
+}
+
+func (s *instrumentedDataStore) DeleteAPIKey(ctx context.Context, id string) error {
+	defer s.observe("DeleteAPIKey", time.Now())
+	return s.store.DeleteAPIKey(ctx, id)
+}
+
+func (s *instrumentedDataStore) DeleteUserAPIKeys(ctx context.Context, userId string) error {
+	defer s.observe("DeleteUserAPIKeys", time.Now())
+	return s.store.DeleteUserAPIKeys(ctx, userId)
+}
+
+func (s *instrumentedDataStore) Create(ctx context.Context, data UserData) error {
+	defer s.observe("Create", time.Now())
+	return s.store.Create(ctx, data)
+}
+
+func (s *instrumentedDataStore) Replace(ctx context.Context, data UserData) error {
+	defer s.observe("Replace", time.Now())
+	return s.store.Replace(ctx, data)
+}
+
+func (s *instrumentedDataStore) Upsert(ctx context.Context, data UserData) error {
+	defer s.observe("Upsert", time.Now())
+	return s.store.Upsert(ctx, data)
+}
+
+func (s *instrumentedDataStore) Delete(ctx context.Context, id string) error {
+	defer s.observe("Delete", time.Now())
+	return s.store.Delete(ctx, id)
+}
+
+func (s *instrumentedDataStore) Get(ctx context.Context, id string) (UserData, error) {
+	defer s.observe("Get", time.Now())
+	return s.store.Get(ctx, id)
+}
+
+func (s *instrumentedDataStore) List(ctx context.Context, query *UserQuery, offset, count int, callback UserDataCallback) error {
+	defer s.observe("List", time.Now())
+	return s.store.List(ctx, query, offset, count, callback)
+}
+
+func (s *instrumentedDataStore) Count(ctx context.Context, query *UserQuery) (int, error) {
+	defer s.observe("Count", time.Now())
+	return s.store.Count(ctx, query)
+}
+
+func (s *instrumentedDataStore) Seek(ctx context.Context, query *UserQuery, from string, direction SeekDirection, count int, callback UserDataCallback) error {
+	defer s.observe("Seek", time.Now())
+	return s.store.Seek(ctx, query, from, direction, count, callback)
+}
+
+func (s *instrumentedDataStore) HealthCheck(ctx context.Context) error {
+	defer s.observe("HealthCheck", time.Now())
+	return s.store.HealthCheck(ctx)
+}
+
+// Close closes the wrapped store if it can be closed
+func (s *instrumentedDataStore) Close() error {
+	if closer, ok := s.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// instrumentedFiles records the duration of each operation of the wrapped Files
+type instrumentedFiles struct {
+	files Files
+}
+
+// newInstrumentedFiles wraps the files so that the durations of their operations are exposed by the metrics endpoint
+func newInstrumentedFiles(files Files) Files {
+	if _, ok := files.(*instrumentedFiles); ok {
+		return files
+	}
+	return &instrumentedFiles{files: files}
+}
+
+func (f *instrumentedFiles) observe(operation string, start time.Time) {
+	metrics.filesOperationDuration.Observe(time.Since(start).Seconds(), operation)
+}
+
+func (f *instrumentedFiles) Save(ctx context.Context, userId string, data string) error {
+	defer f.observe("Save", time.Now())
+	return f.files.Save(ctx, userId, data)
+}
+
+func (f *instrumentedFiles) Delete(ctx context.Context, userId string) error {
+	defer f.observe("Delete", time.Now())
+	return f.files.Delete(ctx, userId)
+}
+
+func (f *instrumentedFiles) Get(ctx context.Context, userId string) (string, error) {
+	defer f.observe("Get", time.Now())
+	return f.files.Get(ctx, userId)
+}
+
+func (f *instrumentedFiles) HealthCheck(ctx context.Context) error {
+	defer f.observe("HealthCheck", time.Now())
+	return f.files.HealthCheck(ctx)
+}
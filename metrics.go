@@ -0,0 +1,351 @@
+package ditt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultDurationBuckets are the upper bounds in seconds of the duration histograms
+var DefaultDurationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricsCollector is a metric family that can write its samples in the Prometheus text format
+type metricsCollector interface {
+	writeText(w *bufio.Writer)
+}
+
+// MetricsRegistry holds metric families and writes them in the Prometheus text format
+type MetricsRegistry struct {
+	mutex      sync.Mutex
+	collectors []metricsCollector
+}
+
+// NewMetricsRegistry creates an empty registry
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{}
+}
+
+func (r *MetricsRegistry) register(collector metricsCollector) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.collectors = append(r.collectors, collector)
+}
+
+// WriteText writes all the metric families in the order they were registered
+func (r *MetricsRegistry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	collectors := append([]metricsCollector(nil), r.collectors...)
+	r.mutex.Unlock()
+
+	writer := bufio.NewWriter(w)
+	for _, collector := range collectors {
+		collector.writeText(writer)
+	}
+	return writer.Flush()
+}
+
+// metricFamily holds what the metric types have in common. The samples are indexed by their label values
+type metricFamily struct {
+	mutex      sync.Mutex
+	name       string
+	help       string
+	metricType string
+	labels     []string
+}
+
+func (f *metricFamily) key(labelValues []string) string {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+func (f *metricFamily) writeHeader(w *bufio.Writer) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n", f.name, strings.NewReplacer("\\", `\\`, "\n", `\n`).Replace(f.help))
+	_, _ = fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.metricType)
+}
+
+// labelsText formats the label pairs of a sample. "extra" is appended as is, like the "le" label of the histogram buckets
+func (f *metricFamily) labelsText(labelValues []string, extra string) string {
+	var pairs []string
+	for i, label := range f.labels {
+		pairs = append(pairs, label+`="`+escapeLabelValue(labelValues[i])+`"`)
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer("\\", `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// sortedKeys returns the keys of the samples so that they are written in a stable order
+func sortedKeys(keys map[string][]string) []string {
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// CounterVec is a family of counters partitioned by label values
+type CounterVec struct {
+	metricFamily
+	values      map[string]float64
+	labelValues map[string][]string
+}
+
+// NewCounter registers a counter family
+func (r *MetricsRegistry) NewCounter(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		metricFamily: metricFamily{name: name, help: help, metricType: "counter", labels: labels},
+		values:       map[string]float64{},
+		labelValues:  map[string][]string{},
+	}
+	r.register(c)
+	return c
+}
+
+// Add increases the counter of the label values. Negative values are ignored
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		return
+	}
+	key := c.key(labelValues)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[key] += value
+	c.labelValues[key] = labelValues
+}
+
+// Inc increases the counter of the label values by one
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Value returns the counter of the label values
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.values[key]
+}
+
+func (c *CounterVec) writeText(w *bufio.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.writeHeader(w)
+	for _, key := range sortedKeys(c.labelValues) {
+		_, _ = fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelsText(c.labelValues[key], ""), formatMetricValue(c.values[key]))
+	}
+}
+
+// GaugeVec is a family of gauges partitioned by label values
+type GaugeVec struct {
+	metricFamily
+	values      map[string]float64
+	labelValues map[string][]string
+}
+
+// NewGauge registers a gauge family
+func (r *MetricsRegistry) NewGauge(name string, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{
+		metricFamily: metricFamily{name: name, help: help, metricType: "gauge", labels: labels},
+		values:       map[string]float64{},
+		labelValues:  map[string][]string{},
+	}
+	r.register(g)
+	return g
+}
+
+// Add changes the gauge of the label values by "value", which may be negative
+func (g *GaugeVec) Add(value float64, labelValues ...string) {
+	key := g.key(labelValues)
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values[key] += value
+	g.labelValues[key] = labelValues
+}
+
+// Set sets the gauge of the label values
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	key := g.key(labelValues)
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values[key] = value
+	g.labelValues[key] = labelValues
+}
+
+// Value returns the gauge of the label values
+func (g *GaugeVec) Value(labelValues ...string) float64 {
+	key := g.key(labelValues)
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.values[key]
+}
+
+func (g *GaugeVec) writeText(w *bufio.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.writeHeader(w)
+	if len(g.labels) == 0 && len(g.values) == 0 {
+		_, _ = fmt.Fprintf(w, "%s 0\n", g.name)
+		return
+	}
+	for _, key := range sortedKeys(g.labelValues) {
+		_, _ = fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelsText(g.labelValues[key], ""), formatMetricValue(g.values[key]))
+	}
+}
+
+// histogramSample holds the observations of a label values set. The bucket counts are not cumulative
+type histogramSample struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+// HistogramVec is a family of histograms partitioned by label values
+type HistogramVec struct {
+	metricFamily
+	buckets []float64
+	samples map[string]*histogramSample
+}
+
+// NewHistogram registers a histogram family. "buckets" are the sorted upper bounds of the buckets, without +Inf
+func (r *MetricsRegistry) NewHistogram(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		metricFamily: metricFamily{name: name, help: help, metricType: "histogram", labels: labels},
+		buckets:      buckets,
+		samples:      map[string]*histogramSample{},
+	}
+	r.register(h)
+	return h
+}
+
+// Observe adds the value to the histogram of the label values
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	sample, found := h.samples[key]
+	if !found {
+		sample = &histogramSample{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.samples[key] = sample
+	}
+
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		sample.counts[i]++
+	}
+	sample.sum += value
+	sample.count++
+}
+
+// Count returns the number of observations of the label values
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	key := h.key(labelValues)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if sample, found := h.samples[key]; found {
+		return sample.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) writeText(w *bufio.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.writeHeader(w)
+
+	keys := make(map[string][]string, len(h.samples))
+	for key, sample := range h.samples {
+		keys[key] = sample.labelValues
+	}
+	for _, key := range sortedKeys(keys) {
+		sample := h.samples[key]
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += sample.counts[i]
+			le := `le="` + formatMetricValue(bound) + `"`
+			_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelsText(sample.labelValues, le), cumulative)
+		}
+		_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelsText(sample.labelValues, `le="+Inf"`), sample.count)
+		_, _ = fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelsText(sample.labelValues, ""), formatMetricValue(sample.sum))
+		_, _ = fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelsText(sample.labelValues, ""), sample.count)
+	}
+}
+
+// serverMetrics holds the metrics exposed by the metrics endpoint
+type serverMetrics struct {
+	registry *MetricsRegistry
+
+	httpRequests           *CounterVec
+	httpRequestDuration    *HistogramVec
+	logins                 *CounterVec
+	importRecordsProcessed *CounterVec
+	importRecordsFailed    *CounterVec
+	runnerQueueDepth       *GaugeVec
+	passwordHashDuration   *HistogramVec
+	storeOperationDuration *HistogramVec
+	filesOperationDuration *HistogramVec
+}
+
+func newServerMetrics(registry *MetricsRegistry) *serverMetrics {
+	return &serverMetrics{
+		registry: registry,
+		httpRequests: registry.NewCounter("ditt_http_requests_total",
+			"Number of HTTP requests by route and status code.", "route", "code"),
+		httpRequestDuration: registry.NewHistogram("ditt_http_request_duration_seconds",
+			"Duration of the HTTP requests by route.", DefaultDurationBuckets, "route"),
+		logins: registry.NewCounter("ditt_logins_total",
+			"Number of login attempts by result: success, failure or locked.", "result"),
+		importRecordsProcessed: registry.NewCounter("ditt_import_records_processed_total",
+			"Number of users processed by the imports."),
+		importRecordsFailed: registry.NewCounter("ditt_import_records_failed_total",
+			"Number of users the imports could not add."),
+		runnerQueueDepth: registry.NewGauge("ditt_runner_queue_depth",
+			"Number of users waiting for a processing worker."),
+		passwordHashDuration: registry.NewHistogram("ditt_password_hash_duration_seconds",
+			"Duration of the password hash computations by algorithm and operation: hash or verify.", DefaultDurationBuckets, "algorithm", "operation"),
+		storeOperationDuration: registry.NewHistogram("ditt_store_operation_duration_seconds",
+			"Duration of the user data store operations.", DefaultDurationBuckets, "operation"),
+		filesOperationDuration: registry.NewHistogram("ditt_files_operation_duration_seconds",
+			"Duration of the user files operations.", DefaultDurationBuckets, "operation"),
+	}
+}
+
+var metrics = newServerMetrics(NewMetricsRegistry())
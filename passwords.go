@@ -0,0 +1,373 @@
+package ditt
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/tidwall/sjson"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordPolicy tells which passwords are accepted for the users
+type PasswordPolicy struct {
+	// MinLength is the minimum number of characters
+	MinLength int `json:"min_length"`
+
+	// MinCharacterClasses is the minimum number of classes among lowercase letters, uppercase letters, digits and others
+	MinCharacterClasses int `json:"min_character_classes"`
+
+	// Breached holds the passwords known to be leaked. They are rejected
+	Breached map[string]bool `json:"-"`
+}
+
+// DefaultPasswordPolicy is the policy applied when Env.PasswordPolicy is not set. It only rejects empty passwords
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength: 1,
+}
+
+// PasswordPolicyError tells why a password does not comply with the PasswordPolicy
+type PasswordPolicyError struct {
+	Message string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return "password rejected: " + e.Message
+}
+
+// Is makes a PasswordPolicyError match BadInput
+func (e *PasswordPolicyError) Is(target error) bool {
+	return errors.Is(target, BadInput)
+}
+
+// ErrorDetails tells that the error is about the password field
+func (e *PasswordPolicyError) ErrorDetails() *ErrorDetails {
+	return &ErrorDetails{Field: "password"}
+}
+
+// LoadBreachedPasswords reads a file that holds a password per line
+func LoadBreachedPasswords(filename string) (map[string]bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	passwords := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line != "" {
+			passwords[line] = true
+		}
+	}
+	return passwords, scanner.Err()
+}
+
+func passwordPolicy() *PasswordPolicy {
+	if Env.PasswordPolicy != nil {
+		return Env.PasswordPolicy
+	}
+	return &DefaultPasswordPolicy
+}
+
+// Check fails with a PasswordPolicyError if the password does not comply with the policy
+func (p *PasswordPolicy) Check(password string) error {
+	if length := utf8.RuneCountInString(password); length < p.MinLength {
+		return &PasswordPolicyError{Message: fmt.Sprintf("expected at least %d characters", p.MinLength)}
+	}
+
+	classes := map[string]bool{}
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			classes["lower"] = true
+		case unicode.IsUpper(r):
+			classes["upper"] = true
+		case unicode.IsDigit(r):
+			classes["digit"] = true
+		default:
+			classes["other"] = true
+		}
+	}
+	if len(classes) < p.MinCharacterClasses {
+		return &PasswordPolicyError{Message: fmt.Sprintf("expected characters of at least %d classes among lowercase letters, uppercase letters, digits and others", p.MinCharacterClasses)}
+	}
+
+	if p.Breached[password] {
+		return &PasswordPolicyError{Message: "the password is known to be leaked"}
+	}
+	return nil
+}
+
+// PasswordHashAlgorithm is an algorithm the passwords are hashed with
+type PasswordHashAlgorithm string
+
+const (
+	// PasswordHashBcrypt hashes the passwords with bcrypt
+	PasswordHashBcrypt PasswordHashAlgorithm = "bcrypt"
+
+	// PasswordHashArgon2id hashes the passwords with argon2id
+	PasswordHashArgon2id PasswordHashAlgorithm = "argon2id"
+)
+
+// PasswordHashing holds the algorithm and the parameters new password hashes are computed with
+type PasswordHashing struct {
+	Algorithm PasswordHashAlgorithm `json:"algorithm"`
+
+	// BcryptCost is the bcrypt cost
+	BcryptCost int `json:"bcrypt_cost"`
+
+	// Argon2Time is the number of argon2id passes over the memory
+	Argon2Time uint32 `json:"argon2_time"`
+
+	// Argon2Memory is the argon2id memory size in KiB
+	Argon2Memory uint32 `json:"argon2_memory"`
+
+	// Argon2Threads is the argon2id degree of parallelism
+	Argon2Threads uint8 `json:"argon2_threads"`
+}
+
+// DefaultPasswordHashing is the hashing applied when Env.PasswordHashing is not set
+var DefaultPasswordHashing = PasswordHashing{
+	Algorithm:     PasswordHashBcrypt,
+	BcryptCost:    12,
+	Argon2Time:    1,
+	Argon2Memory:  64 * 1024,
+	Argon2Threads: 4,
+}
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+func passwordHashing() *PasswordHashing {
+	if Env.PasswordHashing != nil {
+		return Env.PasswordHashing
+	}
+	return &DefaultPasswordHashing
+}
+
+// Valid tells whether the algorithm is known
+func (a PasswordHashAlgorithm) Valid() bool {
+	return a == PasswordHashBcrypt || a == PasswordHashArgon2id
+}
+
+// Validate checks that the algorithm is known and that its parameters can be used to compute hashes
+func (h *PasswordHashing) Validate() error {
+	switch h.Algorithm {
+	case PasswordHashBcrypt:
+		if h.BcryptCost < bcrypt.MinCost || h.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("the bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+
+	case PasswordHashArgon2id:
+		if h.Argon2Time < 1 {
+			return fmt.Errorf("the argon2id time must be at least 1")
+		}
+		if h.Argon2Memory == 0 {
+			return fmt.Errorf("the argon2id memory must not be 0")
+		}
+		if h.Argon2Threads < 1 {
+			return fmt.Errorf("the argon2id threads must be at least 1")
+		}
+
+	default:
+		return fmt.Errorf("unknown password hash algorithm '%s'", h.Algorithm)
+	}
+	return nil
+}
+
+// Hash computes the hash of the password with the configured algorithm
+func (h *PasswordHashing) Hash(password string) (string, error) {
+	switch h.Algorithm {
+	case PasswordHashBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		return string(hash), err
+
+	case PasswordHashArgon2id:
+		salt := make([]byte, argon2SaltLength)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", err
+		}
+
+		key := argon2.IDKey([]byte(password), salt, h.Argon2Time, h.Argon2Memory, h.Argon2Threads, argon2KeyLength)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, h.Argon2Memory, h.Argon2Time, h.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+
+	default:
+		return "", fmt.Errorf("unknown password hash algorithm '%s'", h.Algorithm)
+	}
+}
+
+// argon2Hash holds the parts of an encoded argon2id hash
+type argon2Hash struct {
+	version uint32
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2Hash(encoded string) (*argon2Hash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != string(PasswordHashArgon2id) {
+		return nil, fmt.Errorf("malformed argon2id hash")
+	}
+
+	h := &argon2Hash{}
+	_, err := fmt.Sscanf(parts[2], "v=%d", &h.version)
+	if err != nil {
+		return nil, fmt.Errorf("malformed argon2id hash version")
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads)
+	if err != nil {
+		return nil, fmt.Errorf("malformed argon2id hash parameters")
+	}
+
+	h.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, fmt.Errorf("malformed argon2id hash salt")
+	}
+
+	h.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, fmt.Errorf("malformed argon2id hash key")
+	}
+	return h, nil
+}
+
+// Verify compares the password with the hash, which may have been computed with any known algorithm.
+// "upgrade" tells whether the hash should be computed again because the configured algorithm or parameters changed
+func (h *PasswordHashing) Verify(hash string, password string) (ok bool, upgrade bool, err error) {
+	if hashAlgorithm(hash) == PasswordHashArgon2id {
+		parsed, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false, false, err
+		}
+
+		key := argon2.IDKey([]byte(password), parsed.salt, parsed.time, parsed.memory, parsed.threads, uint32(len(parsed.key)))
+		if subtle.ConstantTimeCompare(key, parsed.key) != 1 {
+			return false, false, nil
+		}
+
+		upgrade = h.Algorithm != PasswordHashArgon2id || parsed.version != argon2.Version ||
+			parsed.memory != h.Argon2Memory || parsed.time != h.Argon2Time || parsed.threads != h.Argon2Threads
+		return true, upgrade, nil
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err != nil {
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, false, nil
+		}
+		return false, false, err
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false, false, err
+	}
+	return true, h.Algorithm != PasswordHashBcrypt || cost != h.BcryptCost, nil
+}
+
+// hashAlgorithm tells which algorithm the hash was computed with
+func hashAlgorithm(hash string) PasswordHashAlgorithm {
+	if strings.HasPrefix(hash, "$"+string(PasswordHashArgon2id)+"$") {
+		return PasswordHashArgon2id
+	}
+	return PasswordHashBcrypt
+}
+
+// hashPasswordValue computes the hash of the password with the configured hashing
+func hashPasswordValue(password string) (string, error) {
+	hashing := passwordHashing()
+	defer observePasswordHash(hashing.Algorithm, "hash", time.Now())
+	return hashing.Hash(password)
+}
+
+// verifyPasswordValue compares the password with the hash using the configured hashing
+func verifyPasswordValue(hash string, password string) (bool, bool, error) {
+	defer observePasswordHash(hashAlgorithm(hash), "verify", time.Now())
+	return passwordHashing().Verify(hash, password)
+}
+
+// dummyPasswordHashes caches a hash per hashing configuration for verifyDummyPassword
+var dummyPasswordHashes = struct {
+	sync.Mutex
+	hashes map[PasswordHashing]string
+}{hashes: map[PasswordHashing]string{}}
+
+// dummyPasswordHash gets the hash of a fixed password computed with the configured hashing. It is computed on the first call
+func dummyPasswordHash() (string, error) {
+	hashing := passwordHashing()
+
+	dummyPasswordHashes.Lock()
+	defer dummyPasswordHashes.Unlock()
+
+	hash, found := dummyPasswordHashes.hashes[*hashing]
+	if found {
+		return hash, nil
+	}
+
+	hash, err := hashing.Hash("ditt-dummy-password")
+	if err != nil {
+		return "", err
+	}
+	dummyPasswordHashes.hashes[*hashing] = hash
+	return hash, nil
+}
+
+// verifyDummyPassword verifies the password against a hash of the configured hashing. It is called for the unknown logins
+// so that they take as long as the registered ones and the login duration does not reveal which users exist
+func verifyDummyPassword(password string) {
+	hash, err := dummyPasswordHash()
+	if err != nil {
+		return
+	}
+	_, _, _ = passwordHashing().Verify(hash, password)
+}
+
+func observePasswordHash(algorithm PasswordHashAlgorithm, operation string, start time.Time) {
+	metrics.passwordHashDuration.Observe(time.Since(start).Seconds(), string(algorithm), operation)
+}
+
+// checkPasswordPolicy is a UserDataProcessor that rejects the users whose password does not comply with the policy
+func checkPasswordPolicy(_ context.Context, data UserData) (UserData, error) {
+	if data == "" {
+		return data, nil
+	}
+	return data, passwordPolicy().Check(data.Password())
+}
+
+// upgradeUserPasswordHash replaces the stored password hash of the user with one computed with the configured hashing
+func upgradeUserPasswordHash(ctx context.Context, data UserData, password string) error {
+	hash, err := hashPasswordValue(password)
+	if err != nil {
+		return err
+	}
+
+	upgraded, err := sjson.Set(string(data), "password", hash)
+	if err != nil {
+		return err
+	}
+	return Env.DataStore.Replace(ctx, UserData(upgraded))
+}
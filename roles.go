@@ -0,0 +1,193 @@
+package ditt
+
+import (
+	"context"
+	"errors"
+)
+
+// Role is a set of permissions granted to a user
+type Role string
+
+const (
+	// RoleAdmin grants all the permissions
+	RoleAdmin Role = "admin"
+
+	// RoleOperator grants reading and updating any user, but not deleting them
+	RoleOperator Role = "operator"
+
+	// RoleAuditor grants reading any user
+	RoleAuditor Role = "auditor"
+
+	// RoleSelf grants reading, updating and deleting one's own user. It is the role of the users who have no saved roles
+	RoleSelf Role = "self"
+)
+
+// Permission is the right to call an APIHandler method on some users
+type Permission string
+
+const (
+	// PermissionReadSelf allows getting one's own user and listing it
+	PermissionReadSelf Permission = "self:read"
+
+	// PermissionUpdateSelf allows updating one's own user
+	PermissionUpdateSelf Permission = "self:update"
+
+	// PermissionDeleteSelf allows deleting one's own user
+	PermissionDeleteSelf Permission = "self:delete"
+
+	// PermissionReadAll allows getting and listing any user
+	PermissionReadAll Permission = "users:read"
+
+	// PermissionUpdateAll allows updating any user
+	PermissionUpdateAll Permission = "users:update"
+
+	// PermissionDeleteAll allows deleting any user
+	PermissionDeleteAll Permission = "users:delete"
+
+	// PermissionCreateUsers allows adding users in bulk
+	PermissionCreateUsers Permission = "users:create"
+
+	// PermissionExport allows exporting all the users
+	PermissionExport Permission = "users:export"
+
+	// PermissionReadSecrets allows reading the sensitive fields of the users the caller can read
+	PermissionReadSecrets Permission = "users:secrets"
+
+	// PermissionManageRoles allows getting and setting the roles of any user
+	PermissionManageRoles Permission = "roles:manage"
+
+	// PermissionManageSessions allows listing and revoking the sessions of any user
+	PermissionManageSessions Permission = "sessions:manage"
+
+	// PermissionUnlockUsers allows clearing the login failures of any account
+	PermissionUnlockUsers Permission = "users:unlock"
+
+	// PermissionManageSelfAPIKeys allows creating, listing and deleting one's own API keys
+	PermissionManageSelfAPIKeys Permission = "self:keys"
+
+	// PermissionManageAPIKeys allows creating, listing and deleting the API keys of any user
+	PermissionManageAPIKeys Permission = "keys:manage"
+)
+
+// rolePermissions is the permission matrix. A permission on all the users implies the same permission on one's own user
+// as stated by allUsersPermissions
+var rolePermissions = map[Role][]Permission{
+	RoleAdmin: {
+		PermissionReadAll,
+		PermissionUpdateAll,
+		PermissionDeleteAll,
+		PermissionCreateUsers,
+		PermissionExport,
+		PermissionReadSecrets,
+		PermissionManageRoles,
+		PermissionManageSessions,
+		PermissionManageAPIKeys,
+		PermissionUnlockUsers,
+	},
+	RoleOperator: {
+		PermissionReadAll,
+		PermissionUpdateAll,
+	},
+	RoleAuditor: {
+		PermissionReadAll,
+	},
+	RoleSelf: {
+		PermissionReadSelf,
+		PermissionUpdateSelf,
+		PermissionDeleteSelf,
+		PermissionManageSelfAPIKeys,
+	},
+}
+
+// allUsersPermissions maps the permissions on one's own user to the permissions on all the users that imply them
+var allUsersPermissions = map[Permission]Permission{
+	PermissionReadSelf:          PermissionReadAll,
+	PermissionUpdateSelf:        PermissionUpdateAll,
+	PermissionDeleteSelf:        PermissionDeleteAll,
+	PermissionManageSelfAPIKeys: PermissionManageAPIKeys,
+}
+
+var defaultRoles = []Role{RoleSelf}
+
+// Valid tells whether the role is one of the known roles
+func (r Role) Valid() bool {
+	_, found := rolePermissions[r]
+	return found
+}
+
+// Valid tells whether the permission is granted by one of the known roles
+func (p Permission) Valid() bool {
+	for _, permissions := range rolePermissions {
+		if permissionsInclude(permissions, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// permissionsInclude tells whether the permission, or a permission that implies it, is part of "permissions"
+func permissionsInclude(permissions []Permission, permission Permission) bool {
+	for _, granted := range permissions {
+		if granted == permission || granted == allUsersPermissions[permission] {
+			return true
+		}
+	}
+	return false
+}
+
+// rolesHavePermission tells whether one of the roles grants the permission
+func rolesHavePermission(roles []Role, permission Permission) bool {
+	for _, role := range roles {
+		if permissionsInclude(rolePermissions[role], permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// getUserRoles loads the roles of the user. Admin accounts are always admins and
+// the users who have no saved roles get the default ones
+func getUserRoles(ctx context.Context, userId string) ([]Role, error) {
+	admin, err := isAdmin(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	if admin {
+		return []Role{RoleAdmin}, nil
+	}
+
+	roles, err := Env.DataStore.GetRoles(ctx, userId)
+	if errors.Is(err, NotFound) {
+		return defaultRoles, nil
+	}
+	return roles, err
+}
+
+// getLoggedUserRoles returns the roles carried by the context or else loads them from the store
+func getLoggedUserRoles(ctx context.Context) ([]Role, error) {
+	if roles, found := GetLoggedUserRoles(ctx); found {
+		return roles, nil
+	}
+
+	loggedUser := GetLoggedUser(ctx)
+	if loggedUser == "" {
+		return nil, nil
+	}
+	return getUserRoles(ctx, loggedUser)
+}
+
+// loggedUserHasPermission tells whether the roles of the logged user grant the permission.
+// When the user is authenticated with an API key, the permission must also be one of the key scopes
+func loggedUserHasPermission(ctx context.Context, permission Permission) (bool, error) {
+	roles, err := getLoggedUserRoles(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if !rolesHavePermission(roles, permission) {
+		return false, nil
+	}
+
+	scopes, scoped := GetLoggedUserScopes(ctx)
+	return !scoped || permissionsInclude(scopes, permission), nil
+}
@@ -4,8 +4,14 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
-	"log"
+	"io"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -13,36 +19,308 @@ import (
 type Config struct {
 	Port      int `json:"port"`
 	TlsConfig *tls.Config
+
+	// AdminPort is the port of a separate HTTP server for the health, readiness, version and metrics endpoints.
+	// If it is not set, the health, readiness and version endpoints are served on Port along with the API.
+	// The metrics endpoint is only served on AdminPort since it has no access control
+	AdminPort int `json:"admin_port"`
+
+	// ImportWorkers is the number of routines that process imported users concurrently
+	ImportWorkers int `json:"import_workers"`
+
+	// ImportQueueSize is the number of parsed users that can wait for an import worker
+	ImportQueueSize int `json:"import_queue_size"`
+
+	// SelfRegistration allows unauthenticated callers to add their own user
+	SelfRegistration bool `json:"self_registration"`
+
+	// SessionIdleTimeout is the inactivity duration after which a session is revoked. Zero disables it
+	SessionIdleTimeout time.Duration `json:"session_idle_timeout"`
+
+	// SessionMaxAge is the duration after which a session is revoked whatever its activity. Zero disables it
+	SessionMaxAge time.Duration `json:"session_max_age"`
+
+	// TokenSigningKey is the HMAC key of the access and refresh tokens
+	TokenSigningKey []byte `json:"-"`
+
+	// AccessTokenTTL is the lifetime of the access tokens. DefaultAccessTokenTTL applies if it is not set
+	AccessTokenTTL time.Duration `json:"access_token_ttl"`
+
+	// RefreshTokenTTL is the lifetime of the refresh tokens. DefaultRefreshTokenTTL applies if it is not set
+	RefreshTokenTTL time.Duration `json:"refresh_token_ttl"`
+
+	// LoginThrottlePolicy tells when logins get locked. DefaultLoginThrottlePolicy applies if it is not set
+	LoginThrottlePolicy *LoginThrottlePolicy `json:"login_throttle_policy"`
+
+	// PasswordPolicy tells which user passwords are accepted. DefaultPasswordPolicy applies if it is not set
+	PasswordPolicy *PasswordPolicy `json:"password_policy"`
+
+	// PasswordHashing tells how the passwords are hashed. DefaultPasswordHashing applies if it is not set
+	PasswordHashing *PasswordHashing `json:"password_hashing"`
+
+	// SensitiveFields are the paths of the fields removed from the users that are read. DefaultSensitiveFields applies if it is not set
+	SensitiveFields []string `json:"sensitive_fields"`
+
+	// Logger writes the server logs. Env.Logger is kept if it is not set
+	Logger *Logger `json:"-"`
+
+	// ShutdownGracePeriod is how long the running requests and user imports are waited for on shutdown.
+	// DefaultShutdownGracePeriod applies if it is not set
+	ShutdownGracePeriod time.Duration `json:"shutdown_grace_period"`
+}
+
+const (
+	// DefaultShutdownGracePeriod is the grace period applied when Config.ShutdownGracePeriod is not set
+	DefaultShutdownGracePeriod = 30 * time.Second
+
+	// shutdownCancelTimeout is how long the imports canceled at the end of the grace period are given to save their state
+	shutdownCancelTimeout = 5 * time.Second
+)
+
+// Serve serves the HTTP API until "ctx" is done or the process receives SIGINT or SIGTERM. It then stops accepting
+// connections and waits up to the grace period for the running requests and user imports before closing the user data store
+func Serve(ctx context.Context, config *Config) error {
+	if config.PasswordHashing != nil {
+		err := config.PasswordHashing.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	if config.AdminPort > 0 && config.AdminPort == config.Port {
+		return fmt.Errorf("the admin port must differ from the API port %d", config.Port)
+	}
+
+	Env.RunnerWorkers = config.ImportWorkers
+	Env.RunnerQueueSize = config.ImportQueueSize
+	Env.SelfRegistration = config.SelfRegistration
+	Env.SessionIdleTimeout = config.SessionIdleTimeout
+	Env.SessionMaxAge = config.SessionMaxAge
+	Env.TokenSigningKey = config.TokenSigningKey
+	Env.AccessTokenTTL = config.AccessTokenTTL
+	Env.RefreshTokenTTL = config.RefreshTokenTTL
+	Env.LoginThrottlePolicy = config.LoginThrottlePolicy
+	Env.PasswordPolicy = config.PasswordPolicy
+	Env.PasswordHashing = config.PasswordHashing
+	Env.SensitiveFields = config.SensitiveFields
+	if config.Logger != nil {
+		Env.Logger = config.Logger
+	}
+
+	Env.DataStore = newInstrumentedDataStore(Env.DataStore)
+	Env.Files = newInstrumentedFiles(Env.Files)
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// The requests contexts derive from baseCtx so that the requests still running at the end of the grace period are canceled
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	baseContext := func(net.Listener) context.Context {
+		return baseCtx
+	}
+
+	servers := []*http.Server{{
+		Addr:        fmt.Sprintf(":%d", config.Port),
+		Handler:     newHttpHandler(config.AdminPort <= 0),
+		TLSConfig:   config.TlsConfig,
+		BaseContext: baseContext,
+	}}
+	if config.AdminPort > 0 {
+		servers = append(servers, &http.Server{
+			Addr:        fmt.Sprintf(":%d", config.AdminPort),
+			Handler:     newAdminHttpHandler(),
+			BaseContext: baseContext,
+		})
+	}
+
+	// All the addresses are bound before serving so that a busy port is reported without starting any server
+	var listeners []net.Listener
+	for _, srv := range servers {
+		listener, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			for _, listener := range listeners {
+				_ = listener.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+
+	serveErrors := make(chan error, len(servers))
+	for i, srv := range servers {
+		srv, listener := srv, listeners[i]
+		Env.Logger.Info("listening", "address", listener.Addr().String())
+		go func() {
+			serveErrors <- srv.Serve(listener)
+		}()
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+		Env.Logger.Info("shutting down", "grace_period", shutdownGracePeriod(config))
+	case err = <-serveErrors:
+		Env.Logger.Error("server stopped", "error", err)
+	}
+
+	shutdown(servers, shutdownGracePeriod(config), cancelRequests)
+	return err
 }
 
-func Serve(config *Config) error {
+func shutdownGracePeriod(config *Config) time.Duration {
+	if config.ShutdownGracePeriod > 0 {
+		return config.ShutdownGracePeriod
+	}
+	return DefaultShutdownGracePeriod
+}
+
+// shutdown stops accepting connections and waits up to the grace period for the running requests and user imports.
+// Those still running afterwards are canceled. The user data store is then closed and the logs are flushed
+func shutdown(servers []*http.Server, gracePeriod time.Duration, cancelRequests context.CancelFunc) {
+	graceCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	for _, srv := range servers {
+		err := srv.Shutdown(graceCtx)
+		if err != nil {
+			Env.Logger.Warn("server shutdown interrupted", "address", srv.Addr, "error", err)
+		}
+	}
+
+	err := runningAddUsers.wait(graceCtx)
+	if err != nil {
+		Env.Logger.Warn("grace period expired, canceling the running imports")
+		cancelRequests()
+		runningImportJobs.cancelAll()
+
+		// The canceled imports stop once their workers are done with the users being processed
+		cancelCtx, cancel := context.WithTimeout(context.Background(), shutdownCancelTimeout)
+		defer cancel()
+		err = runningAddUsers.wait(cancelCtx)
+		if err != nil {
+			Env.Logger.Error("imports still running at shutdown", "error", err)
+		}
+	}
+
+	if closer, ok := Env.DataStore.(io.Closer); ok {
+		err = closer.Close()
+		if err != nil {
+			Env.Logger.Error("user data store closing failed", "error", err)
+		}
+	}
+
+	Env.Logger.Info("server stopped")
+	_ = Env.Logger.Sync()
+}
+
+// activityTracker counts running tasks and lets the shutdown wait until there is none
+type activityTracker struct {
+	mutex  sync.Mutex
+	active int
+	idle   chan struct{}
+}
+
+func (t *activityTracker) begin() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.active == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.active++
+}
+
+func (t *activityTracker) end() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.active--
+	if t.active == 0 {
+		close(t.idle)
+	}
+}
+
+// wait returns once no task is running. It fails with the context error if "ctx" is done first
+func (t *activityTracker) wait(ctx context.Context) error {
+	t.mutex.Lock()
+	idle := t.idle
+	active := t.active
+	t.mutex.Unlock()
+
+	if active == 0 {
+		return nil
+	}
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runningAddUsers tracks the user imports, synchronous or not, that the shutdown waits for
+var runningAddUsers = &activityTracker{}
+
+// newHttpHandler routes the requests to the HTTP API handlers through the middlewares.
+// "adminRoutes" tells whether the health, readiness and version endpoints are served as well. The metrics endpoint
+// is left to the admin handler so that it is never reachable by the API clients
+func newHttpHandler(adminRoutes bool) http.Handler {
 	var handler http.Handler
 	router := mux.NewRouter()
+	router.Use(metricsHttpMiddleware)
 
 	router.Name("Login").Path(LoginEndpoint).Methods(http.MethodPost).HandlerFunc(HandleHttpLoginRequest)
+	router.Name("Logout").Path(LogoutEndpoint).Methods(http.MethodPost).HandlerFunc(HandleHttpLogoutRequest)
+	router.Name("Token").Path(TokenEndpoint).Methods(http.MethodPost).HandlerFunc(HandleHttpTokenRequest)
 	router.Name("Create").Path(AddUsersEndpoint).Methods(http.MethodPost).HandlerFunc(HandleHttpAddUsersRequest)
 	router.Name("Delete").Path(DeleteUserEndpoint).Methods(http.MethodDelete).HandlerFunc(HandleHttpDeleteUserRequest)
 	router.Name("Read").Path(GetUserEndpoint).Methods(http.MethodGet).HandlerFunc(HandleHttpGetUserRequest)
 	router.Name("List").Path(ListUsersEndpoint).Methods(http.MethodGet).HandlerFunc(HandleHttpGetUserListRequest)
 	router.Name("Update").Path(UpdateUserEndpoint).Methods(http.MethodPatch).HandlerFunc(HandleHttpUpdateUserRequest)
+	router.Name("StartImport").Path(StartImportJobEndpoint).Methods(http.MethodPost).HandlerFunc(HandleHttpStartImportJobRequest)
+	router.Name("GetImport").Path(GetImportJobEndpoint).Methods(http.MethodGet).HandlerFunc(HandleHttpGetImportJobRequest)
+	router.Name("GetImportFailures").Path(GetImportJobFailuresEndpoint).Methods(http.MethodGet).HandlerFunc(HandleHttpGetImportJobFailuresRequest)
+	router.Name("CancelImport").Path(CancelImportJobEndpoint).Methods(http.MethodDelete).HandlerFunc(HandleHttpCancelImportJobRequest)
+	router.Name("Export").Path(ExportUsersEndpoint).Methods(http.MethodGet).HandlerFunc(HandleHttpExportUsersRequest)
+	router.Name("GetRoles").Path(GetUserRolesEndpoint).Methods(http.MethodGet).HandlerFunc(HandleHttpGetUserRolesRequest)
+	router.Name("SetRoles").Path(SetUserRolesEndpoint).Methods(http.MethodPut).HandlerFunc(HandleHttpSetUserRolesRequest)
+	router.Name("ListSessions").Path(ListUserSessionsEndpoint).Methods(http.MethodGet).HandlerFunc(HandleHttpListUserSessionsRequest)
+	router.Name("RevokeSessions").Path(RevokeUserSessionsEndpoint).Methods(http.MethodDelete).HandlerFunc(HandleHttpRevokeUserSessionsRequest)
+	router.Name("RevokeSession").Path(RevokeSessionEndpoint).Methods(http.MethodDelete).HandlerFunc(HandleHttpRevokeSessionRequest)
+	router.Name("CreateKey").Path(CreateAPIKeyEndpoint).Methods(http.MethodPost).HandlerFunc(HandleHttpCreateAPIKeyRequest)
+	router.Name("ListKeys").Path(ListAPIKeysEndpoint).Methods(http.MethodGet).HandlerFunc(HandleHttpListAPIKeysRequest)
+	router.Name("DeleteKey").Path(DeleteAPIKeyEndpoint).Methods(http.MethodDelete).HandlerFunc(HandleHttpDeleteAPIKeyRequest)
+	router.Name("Unlock").Path(UnlockUserEndpoint).Methods(http.MethodPost).HandlerFunc(HandleHttpUnlockUserRequest)
+	if adminRoutes {
+		addHealthRoutes(router)
+	}
+	router.NotFoundHandler = metricsHttpMiddleware(http.HandlerFunc(HandleHttpNotFound))
+	router.MethodNotAllowedHandler = metricsHttpMiddleware(http.HandlerFunc(HandleHttpMethodNotAllowed))
 
 	handler = router
 	handler = sessionHttpMiddleware(handler)
 	handler = loggerHttpMiddleware(handler)
+	handler = requestIdHttpMiddleware(handler)
+	return handler
+}
 
-	srv := http.Server{
-		Addr:      fmt.Sprintf(":%d", config.Port),
-		Handler:   handler,
-		TLSConfig: config.TlsConfig,
-	}
-	defer func() {
-		_ = srv.Shutdown(context.Background())
-	}()
+// newAdminHttpHandler routes the requests to the health, readiness, version and metrics endpoints. They need no session
+func newAdminHttpHandler() http.Handler {
+	var handler http.Handler
+	router := mux.NewRouter()
+	router.Use(metricsHttpMiddleware)
 
-	log.Println("Listen ", srv.Addr)
-	err := srv.ListenAndServe()
-	if err != nil {
-		log.Println(err)
-	}
-	return err
+	addHealthRoutes(router)
+	router.Name("Metrics").Path(MetricsEndpoint).Methods(http.MethodGet).HandlerFunc(HandleHttpMetricsRequest)
+	router.NotFoundHandler = metricsHttpMiddleware(http.HandlerFunc(HandleHttpNotFound))
+	router.MethodNotAllowedHandler = metricsHttpMiddleware(http.HandlerFunc(HandleHttpMethodNotAllowed))
+
+	handler = router
+	handler = loggerHttpMiddleware(handler)
+	handler = requestIdHttpMiddleware(handler)
+	return handler
+}
+
+func addHealthRoutes(router *mux.Router) {
+	router.Name("Health").Path(HealthEndpoint).Methods(http.MethodGet).HandlerFunc(HandleHttpHealthRequest)
+	router.Name("Readiness").Path(ReadinessEndpoint).Methods(http.MethodGet).HandlerFunc(HandleHttpReadinessRequest)
+	router.Name("Version").Path(VersionEndpoint).Methods(http.MethodGet).HandlerFunc(HandleHttpVersionRequest)
 }
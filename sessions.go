@@ -0,0 +1,85 @@
+package ditt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Session holds info about an authenticated HTTP session
+type Session struct {
+	Id         string    `json:"id" bson:"id"`
+	User       string    `json:"user" bson:"user"`
+	CreatedAt  time.Time `json:"created_at" bson:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at" bson:"last_seen_at"`
+}
+
+// Expired tells whether the session exceeded the idle or the absolute timeout. A zero timeout never expires
+func (s *Session) Expired(now time.Time, idleTimeout time.Duration, maxAge time.Duration) bool {
+	if idleTimeout > 0 && now.Sub(s.LastSeenAt) > idleTimeout {
+		return true
+	}
+	return maxAge > 0 && now.Sub(s.CreatedAt) > maxAge
+}
+
+func newSessionId() (string, error) {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// createSession registers a new session for the user
+func createSession(ctx context.Context, userId string) (*Session, error) {
+	id, err := newSessionId()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &Session{
+		Id:         id,
+		User:       userId,
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+	err = Env.DataStore.SaveSession(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// resumeSession loads the session identified by "sessionId" and marks it as seen. It fails with NotFound
+// if the session was revoked, does not belong to the user or has expired
+func resumeSession(ctx context.Context, sessionId string, userId string) (*Session, error) {
+	session, err := Env.DataStore.GetSession(ctx, sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if session.User != userId {
+		return nil, NotFound
+	}
+
+	now := time.Now()
+	if session.Expired(now, Env.SessionIdleTimeout, Env.SessionMaxAge) {
+		err = Env.DataStore.DeleteSession(ctx, sessionId)
+		if err != nil && !errors.Is(err, NotFound) {
+			return nil, err
+		}
+		return nil, NotFound
+	}
+
+	// The session may have been revoked since it was loaded. Touching it must not bring it back
+	err = Env.DataStore.TouchSession(ctx, sessionId, now)
+	if err != nil {
+		return nil, err
+	}
+	session.LastSeenAt = now
+	return session, nil
+}
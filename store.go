@@ -1,46 +1,181 @@
 package ditt
 
 import (
+	"context"
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
-	"log"
+	"sort"
 	"sync"
+	"time"
 )
 
+// SeekDirection tells in which order the users are walked through from a seek position
+type SeekDirection int
+
+const (
+	// SeekForward walks through the users in increasing id order
+	SeekForward SeekDirection = iota
+
+	// SeekBackward walks through the users in decreasing id order
+	SeekBackward
+)
+
+// ImportJobStore is a convenience for ImportJob persistence management
+type ImportJobStore interface {
+
+	// SaveImportJob creates or replaces the import job
+	SaveImportJob(ctx context.Context, job *ImportJob) error
+
+	// GetImportJob retrieves the import job matching the given id
+	GetImportJob(ctx context.Context, id string) (*ImportJob, error)
+}
+
+// RoleStore is a convenience for user roles persistence management
+type RoleStore interface {
+
+	// SaveRoles replaces the roles of the user. An empty list removes them
+	SaveRoles(ctx context.Context, userId string, roles []Role) error
+
+	// GetRoles retrieves the roles of the user. It fails with NotFound if none were saved
+	GetRoles(ctx context.Context, userId string) ([]Role, error)
+}
+
+// AdminStore is a convenience for AdminAccount persistence management
+type AdminStore interface {
+
+	// SaveAdmin creates or replaces the admin account
+	SaveAdmin(ctx context.Context, admin *AdminAccount) error
+
+	// GetAdmin retrieves the admin account matching the given login
+	GetAdmin(ctx context.Context, login string) (*AdminAccount, error)
+
+	// DeleteAdmin deletes the admin account matching the given login
+	DeleteAdmin(ctx context.Context, login string) error
+
+	// CountAdmins returns the number of admin accounts
+	CountAdmins(ctx context.Context) (int, error)
+}
+
+// SessionStore is a convenience for Session persistence management
+type SessionStore interface {
+
+	// SaveSession creates or replaces the session
+	SaveSession(ctx context.Context, session *Session) error
+
+	// GetSession retrieves the session matching the given id
+	GetSession(ctx context.Context, id string) (*Session, error)
+
+	// TouchSession sets the last time the session was seen. Unlike SaveSession it never recreates
+	// a deleted session and fails with NotFound instead
+	TouchSession(ctx context.Context, id string, lastSeenAt time.Time) error
+
+	// ListSessions retrieves the sessions of the user ordered by creation date
+	ListSessions(ctx context.Context, userId string) ([]Session, error)
+
+	// DeleteSession deletes the session matching the given id
+	DeleteSession(ctx context.Context, id string) error
+
+	// DeleteUserSessions deletes all the sessions of the user
+	DeleteUserSessions(ctx context.Context, userId string) error
+}
+
+// APIKeyStore is a convenience for APIKey persistence management
+type APIKeyStore interface {
+
+	// SaveAPIKey creates or replaces the API key
+	SaveAPIKey(ctx context.Context, key *APIKey) error
+
+	// GetAPIKey retrieves the API key matching the given id
+	GetAPIKey(ctx context.Context, id string) (*APIKey, error)
+
+	// ListAPIKeys retrieves the API keys of the user ordered by creation date
+	ListAPIKeys(ctx context.Context, userId string) ([]APIKey, error)
+
+	// DeleteAPIKey deletes the API key matching the given id
+	DeleteAPIKey(ctx context.Context, id string) error
+
+	// DeleteUserAPIKeys deletes all the API keys of the user
+	DeleteUserAPIKeys(ctx context.Context, userId string) error
+}
+
 // UserDataStore is a convenience for UserData persistence management
 type UserDataStore interface {
+	ImportJobStore
+	RoleStore
+	AdminStore
+	SessionStore
+	APIKeyStore
+
+	// Create saves user data. It fails with Conflict if a user with the same id is already registered
+	Create(ctx context.Context, data UserData) error
+
+	// Replace replaces the data of an already registered user. It fails with NotFound if there is none
+	Replace(ctx context.Context, data UserData) error
 
-	// Save saves user data
-	Save(data UserData) error
+	// Upsert creates or replaces user data
+	Upsert(ctx context.Context, data UserData) error
 
 	// Delete deletes the userData matching the given id
-	Delete(id string) error
+	Delete(ctx context.Context, id string) error
 
 	// Get retrieves userData matching the given id
-	Get(id string) (UserData, error)
+	Get(ctx context.Context, id string) (UserData, error)
 
-	// ListForUser fetches a range of UserData that matches the userId
-	// and pass each pass each parsed userdata to the callback
-	ListForUser(userId string, offset, count int, callback UserDataCallback) error
+	// List fetches a range of the UserData matched by the query and pass each pass each
+	// parsed userdata to the callback. A nil query matches all the UserData ordered by id.
+	// A zero count fetches all the remaining UserData
+	List(ctx context.Context, query *UserQuery, offset, count int, callback UserDataCallback) error
 
-	// List fetches a range of UserData and pass each pass each
-	// parsed userdata to the callback
-	List(offset, count int, callback UserDataCallback) error
+	// Count returns the number of UserData matched by the query filter
+	Count(ctx context.Context, query *UserQuery) (int, error)
+
+	// Seek fetches at most count UserData matched by the query whose id comes after "from" in the given direction
+	// and pass each parsed userdata to the callback. An empty "from" starts from the first id of the direction.
+	// The query sort keys are ignored
+	Seek(ctx context.Context, query *UserQuery, from string, direction SeekDirection, count int, callback UserDataCallback) error
+
+	// HealthCheck fails if the store cannot be reached
+	HealthCheck(ctx context.Context) error
 }
 
 type memoryDataStore struct {
 	sync.Mutex
-	records map[string]UserData
+	records    map[string]UserData
+	importJobs map[string]ImportJob
+	roles      map[string][]Role
+	admins     map[string]AdminAccount
+	sessions   map[string]Session
+	apiKeys    map[string]APIKey
+}
+
+func (m *memoryDataStore) Create(_ context.Context, data UserData) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, found := m.records[data.Id()]; found {
+		return Conflict
+	}
+	m.records[data.Id()] = data
+	return nil
+}
+
+func (m *memoryDataStore) Replace(_ context.Context, data UserData) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, found := m.records[data.Id()]; !found {
+		return NotFound
+	}
+	m.records[data.Id()] = data
+	return nil
 }
 
-func (m *memoryDataStore) Save(data UserData) error {
+func (m *memoryDataStore) Upsert(_ context.Context, data UserData) error {
 	m.Lock()
 	defer m.Unlock()
 	m.records[data.Id()] = data
 	return nil
 }
 
-func (m *memoryDataStore) Delete(id string) error {
+func (m *memoryDataStore) Delete(_ context.Context, id string) error {
 	m.Lock()
 	defer m.Unlock()
 	_, found := m.records[id]
@@ -51,7 +186,7 @@ func (m *memoryDataStore) Delete(id string) error {
 	return nil
 }
 
-func (m *memoryDataStore) Get(id string) (UserData, error) {
+func (m *memoryDataStore) Get(_ context.Context, id string) (UserData, error) {
 	m.Lock()
 	defer m.Unlock()
 	data, found := m.records[id]
@@ -61,86 +196,456 @@ func (m *memoryDataStore) Get(id string) (UserData, error) {
 	return data, nil
 }
 
-func (m *memoryDataStore) ListForUser(userId string, offset, count int, callback UserDataCallback) error {
+func (m *memoryDataStore) List(ctx context.Context, query *UserQuery, offset, count int, callback UserDataCallback) error {
+	records, err := m.selectRecords(ctx, query, offset, count)
+	if err != nil {
+		return err
+	}
+	return passUserDataList(ctx, records, callback)
+}
+
+// selectRecords copies the projections of the range of users that match the query
+func (m *memoryDataStore) selectRecords(ctx context.Context, query *UserQuery, offset, count int) ([]UserData, error) {
 	m.Lock()
 	defer m.Unlock()
 
-	loadedCount := 0
+	var records []UserData
+	for _, id := range m.selectIds(query) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
-	for id, data := range m.records {
-		if userId == id {
-			if offset == 0 {
-				err := callback(data)
-				if err != nil {
-					return err
-				}
-				loadedCount++
-				if loadedCount == count {
-					return nil
-				}
-			} else {
-				offset--
+		if offset == 0 {
+			data, err := query.project(m.records[id])
+			if err != nil {
+				return nil, err
+			}
+
+			records = append(records, data)
+			if len(records) == count {
+				break
+			}
+		} else {
+			offset--
+		}
+	}
+	return records, nil
+}
+
+func (m *memoryDataStore) Seek(ctx context.Context, query *UserQuery, from string, direction SeekDirection, count int, callback UserDataCallback) error {
+	records, err := m.seekRecords(ctx, query, from, direction, count)
+	if err != nil {
+		return err
+	}
+	return passUserDataList(ctx, records, callback)
+}
+
+// seekRecords copies the projections of the users that match the query and follow "from" in the direction
+func (m *memoryDataStore) seekRecords(ctx context.Context, query *UserQuery, from string, direction SeekDirection, count int) ([]UserData, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	ids := m.selectIds(&UserQuery{Filter: query.filter()})
+
+	var next func(position int) int
+	position := 0
+	if direction == SeekBackward {
+		next = func(position int) int { return position - 1 }
+		position = len(ids) - 1
+		if from != "" {
+			position = sort.SearchStrings(ids, from) - 1
+		}
+	} else {
+		next = func(position int) int { return position + 1 }
+		if from != "" {
+			position = sort.SearchStrings(ids, from)
+			if position < len(ids) && ids[position] == from {
+				position++
 			}
 		}
 	}
 
+	var records []UserData
+	for ; position >= 0 && position < len(ids); position = next(position) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		data, err := query.project(m.records[ids[position]])
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, data)
+		if len(records) == count {
+			break
+		}
+	}
+	return records, nil
+}
+
+// passUserDataList passes the users to the callback. The store lock must not be held so that a slow callback
+// does not block the other store calls
+func passUserDataList(ctx context.Context, records []UserData, callback UserDataCallback) error {
+	for _, data := range records {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := callback(data)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (m *memoryDataStore) List(offset, count int, callback UserDataCallback) error {
+func (m *memoryDataStore) Count(ctx context.Context, query *UserQuery) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	m.Lock()
 	defer m.Unlock()
-	loadedCount := 0
 
+	count := 0
 	for _, data := range m.records {
-		if offset == 0 {
-			err := callback(data)
-			if err != nil {
-				return err
-			}
-			loadedCount++
-			if loadedCount == count {
-				return nil
-			}
-		} else {
-			offset--
+		if query.match(data) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *memoryDataStore) HealthCheck(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// selectIds returns the ids of the records matched by the query in the query order. It must be called with the lock held
+func (m *memoryDataStore) selectIds(query *UserQuery) []string {
+	ids := make([]string, 0, len(m.records))
+	for id, data := range m.records {
+		if query.match(data) {
+			ids = append(ids, id)
+		}
+	}
+	query.sortIds(ids, m.records)
+	return ids
+}
+
+func (m *memoryDataStore) SaveRoles(_ context.Context, userId string, roles []Role) error {
+	m.Lock()
+	defer m.Unlock()
+	if len(roles) == 0 {
+		delete(m.roles, userId)
+		return nil
+	}
+	m.roles[userId] = append([]Role(nil), roles...)
+	return nil
+}
+
+func (m *memoryDataStore) GetRoles(_ context.Context, userId string) ([]Role, error) {
+	m.Lock()
+	defer m.Unlock()
+	roles, found := m.roles[userId]
+	if !found {
+		return nil, NotFound
+	}
+	return append([]Role(nil), roles...), nil
+}
+
+func (m *memoryDataStore) SaveAdmin(_ context.Context, admin *AdminAccount) error {
+	m.Lock()
+	defer m.Unlock()
+	m.admins[admin.Login] = *admin
+	return nil
+}
+
+func (m *memoryDataStore) GetAdmin(_ context.Context, login string) (*AdminAccount, error) {
+	m.Lock()
+	defer m.Unlock()
+	admin, found := m.admins[login]
+	if !found {
+		return nil, NotFound
+	}
+	return &admin, nil
+}
+
+func (m *memoryDataStore) DeleteAdmin(_ context.Context, login string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, found := m.admins[login]; !found {
+		return NotFound
+	}
+	delete(m.admins, login)
+	return nil
+}
+
+func (m *memoryDataStore) CountAdmins(_ context.Context) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.admins), nil
+}
+
+func (m *memoryDataStore) SaveSession(_ context.Context, session *Session) error {
+	m.Lock()
+	defer m.Unlock()
+	m.sessions[session.Id] = *session
+	return nil
+}
+
+func (m *memoryDataStore) GetSession(_ context.Context, id string) (*Session, error) {
+	m.Lock()
+	defer m.Unlock()
+	session, found := m.sessions[id]
+	if !found {
+		return nil, NotFound
+	}
+	return &session, nil
+}
+
+func (m *memoryDataStore) TouchSession(_ context.Context, id string, lastSeenAt time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+	session, found := m.sessions[id]
+	if !found {
+		return NotFound
+	}
+	session.LastSeenAt = lastSeenAt
+	m.sessions[id] = session
+	return nil
+}
+
+func (m *memoryDataStore) ListSessions(_ context.Context, userId string) ([]Session, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	sessions := []Session{}
+	for _, session := range m.sessions {
+		if session.User == userId {
+			sessions = append(sessions, session)
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].CreatedAt.Equal(sessions[j].CreatedAt) {
+			return sessions[i].Id < sessions[j].Id
+		}
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+	return sessions, nil
+}
+
+func (m *memoryDataStore) DeleteSession(_ context.Context, id string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, found := m.sessions[id]; !found {
+		return NotFound
+	}
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *memoryDataStore) DeleteUserSessions(_ context.Context, userId string) error {
+	m.Lock()
+	defer m.Unlock()
+	for id, session := range m.sessions {
+		if session.User == userId {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (m *memoryDataStore) SaveAPIKey(_ context.Context, key *APIKey) error {
+	m.Lock()
+	defer m.Unlock()
+	saved := *key
+	saved.Secret = ""
+	m.apiKeys[key.Id] = saved
+	return nil
+}
+
+func (m *memoryDataStore) GetAPIKey(_ context.Context, id string) (*APIKey, error) {
+	m.Lock()
+	defer m.Unlock()
+	key, found := m.apiKeys[id]
+	if !found {
+		return nil, NotFound
+	}
+	return &key, nil
+}
+
+func (m *memoryDataStore) ListAPIKeys(_ context.Context, userId string) ([]APIKey, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	keys := []APIKey{}
+	for _, key := range m.apiKeys {
+		if key.User == userId {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].Id < keys[j].Id
+		}
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (m *memoryDataStore) DeleteAPIKey(_ context.Context, id string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, found := m.apiKeys[id]; !found {
+		return NotFound
+	}
+	delete(m.apiKeys, id)
+	return nil
+}
+
+func (m *memoryDataStore) DeleteUserAPIKeys(_ context.Context, userId string) error {
+	m.Lock()
+	defer m.Unlock()
+	for id, key := range m.apiKeys {
+		if key.User == userId {
+			delete(m.apiKeys, id)
 		}
 	}
 	return nil
 }
 
+func (m *memoryDataStore) SaveImportJob(_ context.Context, job *ImportJob) error {
+	m.Lock()
+	defer m.Unlock()
+	saved := *job
+	saved.Failures = append([]UserFailure(nil), job.Failures...)
+	m.importJobs[job.Id] = saved
+	return nil
+}
+
+func (m *memoryDataStore) GetImportJob(_ context.Context, id string) (*ImportJob, error) {
+	m.Lock()
+	defer m.Unlock()
+	job, found := m.importJobs[id]
+	if !found {
+		return nil, NotFound
+	}
+	return &job, nil
+}
+
 // NewUserDataMemoryStore constructs a memory based UserDataStore
 func NewUserDataMemoryStore() UserDataStore {
-	return &memoryDataStore{records: make(map[string]UserData)}
+	return &memoryDataStore{
+		records:    make(map[string]UserData),
+		importJobs: make(map[string]ImportJob),
+		roles:      make(map[string][]Role),
+		admins:     make(map[string]AdminAccount),
+		sessions:   make(map[string]Session),
+		apiKeys:    make(map[string]APIKey),
+	}
 }
 
 const (
-	databaseName   = "ditt"
-	collectionName = "users"
+	databaseName             = "ditt"
+	collectionName           = "users"
+	importJobsCollectionName = "import_jobs"
+	rolesCollectionName      = "user_roles"
+	adminsCollectionName     = "admins"
+	sessionsCollectionName   = "sessions"
+	apiKeysCollectionName    = "api_keys"
 )
 
 type mongoDataStore struct {
-	usersCollection *mgo.Collection
-	db              *mgo.Database
-	session         *mgo.Session
+	usersCollection      *mgo.Collection
+	importJobsCollection *mgo.Collection
+	rolesCollection      *mgo.Collection
+	adminsCollection     *mgo.Collection
+	sessionsCollection   *mgo.Collection
+	apiKeysCollection    *mgo.Collection
+	db                   *mgo.Database
+	session              *mgo.Session
+	logger               *Logger
 }
 
-func (m *mongoDataStore) Save(data UserData) error {
-	var doc interface{}
+// document decodes data into a mongo document. The "_id" field is removed as it is managed by the database
+func (m *mongoDataStore) document(data UserData) (bson.M, error) {
+	var doc bson.M
 	err := bson.UnmarshalJSON([]byte(data), &doc)
 	if err != nil {
-		return BadInput
+		return nil, BadInput
+	}
+	delete(doc, "_id")
+	return doc, nil
+}
+
+func (m *mongoDataStore) Create(ctx context.Context, data UserData) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	doc, err := m.document(data)
+	if err != nil {
+		return err
 	}
 
 	err = m.usersCollection.Insert(doc)
 	if err != nil {
-		log.Println("mongo save:", err)
+		if mgo.IsDup(err) {
+			return Conflict
+		}
+		m.logger.WithContext(ctx).Error("mongo create", "error", err)
+		return Internal
+	}
+	return nil
+}
+
+func (m *mongoDataStore) Replace(ctx context.Context, data UserData) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	doc, err := m.document(data)
+	if err != nil {
+		return err
+	}
+
+	err = m.usersCollection.Update(bson.M{"id": data.Id()}, doc)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return NotFound
+		}
+		m.logger.WithContext(ctx).Error("mongo replace", "error", err)
 		return Internal
 	}
 	return nil
 }
 
-func (m *mongoDataStore) Delete(id string) error {
+func (m *mongoDataStore) Upsert(ctx context.Context, data UserData) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	doc, err := m.document(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.usersCollection.Upsert(bson.M{"id": data.Id()}, doc)
+	if err != nil {
+		m.logger.WithContext(ctx).Error("mongo upsert", "error", err)
+		return Internal
+	}
+	return nil
+}
+
+func (m *mongoDataStore) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	err := m.usersCollection.Remove(bson.M{"id": id})
 	if err != nil {
 		if err == mgo.ErrNotFound {
@@ -151,7 +656,11 @@ func (m *mongoDataStore) Delete(id string) error {
 	return nil
 }
 
-func (m *mongoDataStore) Get(id string) (UserData, error) {
+func (m *mongoDataStore) Get(ctx context.Context, id string) (UserData, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
 	var result interface{}
 	err := m.usersCollection.Find(bson.M{"id": id}).One(&result)
 	if err != nil {
@@ -165,50 +674,412 @@ func (m *mongoDataStore) Get(id string) (UserData, error) {
 	return UserData(data), err
 }
 
-func (m *mongoDataStore) ListForUser(userId string, offset, count int, callback UserDataCallback) error {
-	iter := m.usersCollection.Find(bson.M{"id": userId}).Limit(count).Skip(offset).Iter()
+// iterate passes each document matched by the query to the callback. The iteration runs on a copy of the
+// store session which is closed as soon as "ctx" is done in order to abort pending reads
+func (m *mongoDataStore) iterate(ctx context.Context, query func(col *mgo.Collection) *mgo.Query, callback UserDataCallback) error {
+	session := m.session.Copy()
+	defer session.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Close()
+		case <-done:
+		}
+	}()
+
+	iter := query(m.usersCollection.With(session)).Iter()
 	defer func() {
 		_ = iter.Close()
 	}()
 
 	var result interface{}
 	for iter.Next(&result) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		data, err := bson.MarshalJSON(result)
 		if err != nil {
 			return err
 		}
+
 		userData := UserData(data)
 		err = callback(userData)
 		if err != nil {
 			return err
 		}
 	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := iter.Err(); err != nil {
+		m.logger.WithContext(ctx).Error("mongo list", "error", err)
+		return Internal
+	}
 	return nil
 }
 
-func (m *mongoDataStore) List(offset, count int, callback UserDataCallback) error {
-	iter := m.usersCollection.Find(bson.M{}).Limit(count).Skip(offset).Iter()
-	defer func() {
-		_ = iter.Close()
+func (m *mongoDataStore) List(ctx context.Context, query *UserQuery, offset, count int, callback UserDataCallback) error {
+	return m.iterate(ctx, func(col *mgo.Collection) *mgo.Query {
+		return col.Find(query.selector()).Select(query.projection()).Sort(query.sortFields()...).Limit(count).Skip(offset)
+	}, callback)
+}
+
+func (m *mongoDataStore) Count(ctx context.Context, query *UserQuery) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	count, err := m.usersCollection.Find(query.selector()).Count()
+	if err != nil {
+		m.logger.WithContext(ctx).Error("mongo count", "error", err)
+		return 0, Internal
+	}
+	return count, nil
+}
+
+// Close closes the database session
+func (m *mongoDataStore) Close() error {
+	m.session.Close()
+	return nil
+}
+
+// HealthCheck pings the database. It returns as soon as "ctx" is done, without waiting for the ping to complete
+func (m *mongoDataStore) HealthCheck(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	session := m.session.Copy()
+	pinged := make(chan error, 1)
+	go func() {
+		defer session.Close()
+		pinged <- session.Ping()
 	}()
 
-	var result interface{}
-	for iter.Next(&result) {
-		data, err := bson.MarshalJSON(result)
-		if err != nil {
-			return err
+	select {
+	case err := <-pinged:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *mongoDataStore) Seek(ctx context.Context, query *UserQuery, from string, direction SeekDirection, count int, callback UserDataCallback) error {
+	return m.iterate(ctx, func(col *mgo.Collection) *mgo.Query {
+		sortKey := "id"
+		operator := "$gt"
+		if direction == SeekBackward {
+			sortKey = "-id"
+			operator = "$lt"
 		}
 
-		userData := UserData(data)
-		err = callback(userData)
-		if err != nil {
-			return err
+		selector := query.selector()
+		if from != "" {
+			selector = bson.M{"$and": []bson.M{selector, {"id": bson.M{operator: from}}}}
+		}
+		return col.Find(selector).Select(query.projection()).Sort(sortKey).Limit(count)
+	}, callback)
+}
+
+func (m *mongoDataStore) SaveImportJob(ctx context.Context, job *ImportJob) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	_, err := m.importJobsCollection.Upsert(bson.M{"id": job.Id}, job)
+	if err != nil {
+		m.logger.WithContext(ctx).Error("mongo save import job", "error", err)
+		return Internal
+	}
+	return nil
+}
+
+func (m *mongoDataStore) GetImportJob(ctx context.Context, id string) (*ImportJob, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	job := &ImportJob{}
+	err := m.importJobsCollection.Find(bson.M{"id": id}).One(job)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, NotFound
+		}
+		return nil, Internal
+	}
+	return job, nil
+}
+
+// userRoles is the mongo document that holds the roles of a user
+type userRoles struct {
+	Id    string `bson:"id"`
+	Roles []Role `bson:"roles"`
+}
+
+func (m *mongoDataStore) SaveRoles(ctx context.Context, userId string, roles []Role) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var err error
+	if len(roles) == 0 {
+		err = m.rolesCollection.Remove(bson.M{"id": userId})
+		if err == mgo.ErrNotFound {
+			err = nil
+		}
+	} else {
+		_, err = m.rolesCollection.Upsert(bson.M{"id": userId}, &userRoles{Id: userId, Roles: roles})
+	}
+
+	if err != nil {
+		m.logger.WithContext(ctx).Error("mongo save roles", "error", err)
+		return Internal
+	}
+	return nil
+}
+
+func (m *mongoDataStore) GetRoles(ctx context.Context, userId string) ([]Role, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	doc := &userRoles{}
+	err := m.rolesCollection.Find(bson.M{"id": userId}).One(doc)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, NotFound
+		}
+		return nil, Internal
+	}
+	return doc.Roles, nil
+}
+
+func (m *mongoDataStore) SaveAdmin(ctx context.Context, admin *AdminAccount) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	_, err := m.adminsCollection.Upsert(bson.M{"login": admin.Login}, admin)
+	if err != nil {
+		m.logger.WithContext(ctx).Error("mongo save admin", "error", err)
+		return Internal
+	}
+	return nil
+}
+
+func (m *mongoDataStore) GetAdmin(ctx context.Context, login string) (*AdminAccount, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	admin := &AdminAccount{}
+	err := m.adminsCollection.Find(bson.M{"login": login}).One(admin)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, NotFound
+		}
+		return nil, Internal
+	}
+	return admin, nil
+}
+
+func (m *mongoDataStore) DeleteAdmin(ctx context.Context, login string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := m.adminsCollection.Remove(bson.M{"login": login})
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return NotFound
 		}
+		m.logger.WithContext(ctx).Error("mongo delete admin", "error", err)
+		return Internal
 	}
 	return nil
 }
 
-func NewMongoUserDataStore(uri string) (UserDataStore, error) {
+func (m *mongoDataStore) CountAdmins(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	count, err := m.adminsCollection.Count()
+	if err != nil {
+		m.logger.WithContext(ctx).Error("mongo count admins", "error", err)
+		return 0, Internal
+	}
+	return count, nil
+}
+
+func (m *mongoDataStore) SaveSession(ctx context.Context, session *Session) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	_, err := m.sessionsCollection.Upsert(bson.M{"id": session.Id}, session)
+	if err != nil {
+		m.logger.WithContext(ctx).Error("mongo save session", "error", err)
+		return Internal
+	}
+	return nil
+}
+
+func (m *mongoDataStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	session := &Session{}
+	err := m.sessionsCollection.Find(bson.M{"id": id}).One(session)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, NotFound
+		}
+		return nil, Internal
+	}
+	return session, nil
+}
+
+func (m *mongoDataStore) TouchSession(ctx context.Context, id string, lastSeenAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := m.sessionsCollection.Update(bson.M{"id": id}, bson.M{"$set": bson.M{"last_seen_at": lastSeenAt}})
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return NotFound
+		}
+		m.logger.WithContext(ctx).Error("mongo touch session", "error", err)
+		return Internal
+	}
+	return nil
+}
+
+func (m *mongoDataStore) ListSessions(ctx context.Context, userId string) ([]Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	sessions := []Session{}
+	err := m.sessionsCollection.Find(bson.M{"user": userId}).Sort("created_at", "id").All(&sessions)
+	if err != nil {
+		m.logger.WithContext(ctx).Error("mongo list sessions", "error", err)
+		return nil, Internal
+	}
+	return sessions, nil
+}
+
+func (m *mongoDataStore) DeleteSession(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := m.sessionsCollection.Remove(bson.M{"id": id})
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return NotFound
+		}
+		m.logger.WithContext(ctx).Error("mongo delete session", "error", err)
+		return Internal
+	}
+	return nil
+}
+
+func (m *mongoDataStore) DeleteUserSessions(ctx context.Context, userId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	_, err := m.sessionsCollection.RemoveAll(bson.M{"user": userId})
+	if err != nil {
+		m.logger.WithContext(ctx).Error("mongo delete user sessions", "error", err)
+		return Internal
+	}
+	return nil
+}
+
+func (m *mongoDataStore) SaveAPIKey(ctx context.Context, key *APIKey) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	_, err := m.apiKeysCollection.Upsert(bson.M{"id": key.Id}, key)
+	if err != nil {
+		m.logger.WithContext(ctx).Error("mongo save api key", "error", err)
+		return Internal
+	}
+	return nil
+}
+
+func (m *mongoDataStore) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	key := &APIKey{}
+	err := m.apiKeysCollection.Find(bson.M{"id": id}).One(key)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, NotFound
+		}
+		return nil, Internal
+	}
+	return key, nil
+}
+
+func (m *mongoDataStore) ListAPIKeys(ctx context.Context, userId string) ([]APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	keys := []APIKey{}
+	err := m.apiKeysCollection.Find(bson.M{"user": userId}).Sort("created_at", "id").All(&keys)
+	if err != nil {
+		m.logger.WithContext(ctx).Error("mongo list api keys", "error", err)
+		return nil, Internal
+	}
+	return keys, nil
+}
+
+func (m *mongoDataStore) DeleteAPIKey(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := m.apiKeysCollection.Remove(bson.M{"id": id})
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return NotFound
+		}
+		m.logger.WithContext(ctx).Error("mongo delete api key", "error", err)
+		return Internal
+	}
+	return nil
+}
+
+func (m *mongoDataStore) DeleteUserAPIKeys(ctx context.Context, userId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	_, err := m.apiKeysCollection.RemoveAll(bson.M{"user": userId})
+	if err != nil {
+		m.logger.WithContext(ctx).Error("mongo delete user api keys", "error", err)
+		return Internal
+	}
+	return nil
+}
+
+// NewMongoUserDataStore constructs a UserDataStore that saves the data in the Mongo database at "uri". The database errors are written to the logger
+func NewMongoUserDataStore(uri string, logger *Logger) (UserDataStore, error) {
 	session, err := mgo.Dial(uri)
 	if err != nil {
 		return nil, err
@@ -225,9 +1096,70 @@ func NewMongoUserDataStore(uri string) (UserDataStore, error) {
 		return nil, err
 	}
 
+	importJobsCol := db.C(importJobsCollectionName)
+	err = importJobsCol.EnsureIndex(mgo.Index{
+		Key:    []string{"id"},
+		Unique: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rolesCol := db.C(rolesCollectionName)
+	err = rolesCol.EnsureIndex(mgo.Index{
+		Key:    []string{"id"},
+		Unique: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	adminsCol := db.C(adminsCollectionName)
+	err = adminsCol.EnsureIndex(mgo.Index{
+		Key:    []string{"login"},
+		Unique: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sessionsCol := db.C(sessionsCollectionName)
+	err = sessionsCol.EnsureIndex(mgo.Index{
+		Key:    []string{"id"},
+		Unique: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = sessionsCol.EnsureIndexKey("user")
+	if err != nil {
+		return nil, err
+	}
+
+	apiKeysCol := db.C(apiKeysCollectionName)
+	err = apiKeysCol.EnsureIndex(mgo.Index{
+		Key:    []string{"id"},
+		Unique: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = apiKeysCol.EnsureIndexKey("user")
+	if err != nil {
+		return nil, err
+	}
+
 	return &mongoDataStore{
-		session:         session,
-		usersCollection: col,
-		db:              db,
+		session:              session,
+		usersCollection:      col,
+		importJobsCollection: importJobsCol,
+		rolesCollection:      rolesCol,
+		adminsCollection:     adminsCol,
+		sessionsCollection:   sessionsCol,
+		apiKeysCollection:    apiKeysCol,
+		db:                   db,
+		logger:               logger,
 	}, nil
 }
@@ -0,0 +1,178 @@
+package ditt
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultAccessTokenTTL is the lifetime of the access tokens when Env.AccessTokenTTL is not set
+	DefaultAccessTokenTTL = 15 * time.Minute
+
+	// DefaultRefreshTokenTTL is the lifetime of the refresh tokens when Env.RefreshTokenTTL is not set
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+
+	tokenUseAccess  = "access"
+	tokenUseRefresh = "refresh"
+)
+
+// jwtHeader is the only JOSE header the tokens are signed with
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// TokenPair holds the tokens issued by the token endpoint
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// tokenClaims are the claims of the access and refresh tokens. Both are bound to a registered session
+// so that revoking the session revokes them
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	SessionId string `json:"sid"`
+	Use       string `json:"token_use"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func accessTokenTTL() time.Duration {
+	if Env.AccessTokenTTL > 0 {
+		return Env.AccessTokenTTL
+	}
+	return DefaultAccessTokenTTL
+}
+
+func refreshTokenTTL() time.Duration {
+	if Env.RefreshTokenTTL > 0 {
+		return Env.RefreshTokenTTL
+	}
+	return DefaultRefreshTokenTTL
+}
+
+func tokenSignature(signingInput string) (string, error) {
+	if len(Env.TokenSigningKey) == 0 {
+		Env.Logger.Error("token signing failed: no signing key is configured")
+		return "", Internal
+	}
+
+	mac := hmac.New(sha256.New, Env.TokenSigningKey)
+	_, _ = mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// signToken encodes the claims as a JWT signed with HMAC SHA-256
+func signToken(claims *tokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature, err := tokenSignature(signingInput)
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + signature, nil
+}
+
+// parseToken verifies the signature, the expiration and the use of the token and returns its claims.
+// It fails with NotAuthorized if the token is not valid
+func parseToken(token string, use string) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, NotAuthorized
+	}
+
+	signature, err := tokenSignature(parts[0] + "." + parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(parts[2])) {
+		return nil, NotAuthorized
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, NotAuthorized
+	}
+
+	claims := &tokenClaims{}
+	err = json.Unmarshal(payload, claims)
+	if err != nil {
+		return nil, NotAuthorized
+	}
+
+	if claims.Use != use || claims.Subject == "" || time.Now().Unix() >= claims.ExpiresAt {
+		return nil, NotAuthorized
+	}
+	return claims, nil
+}
+
+// issueTokens signs an access token and a refresh token bound to the session
+func issueTokens(session *Session) (*TokenPair, error) {
+	now := time.Now()
+
+	access := &tokenClaims{
+		Subject:   session.User,
+		SessionId: session.Id,
+		Use:       tokenUseAccess,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(accessTokenTTL()).Unix(),
+	}
+	accessToken, err := signToken(access)
+	if err != nil {
+		return nil, err
+	}
+
+	refresh := &tokenClaims{
+		Subject:   session.User,
+		SessionId: session.Id,
+		Use:       tokenUseRefresh,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(refreshTokenTTL()).Unix(),
+	}
+	refreshToken, err := signToken(refresh)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTTL().Seconds()),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// resumeTokenSession verifies the token and resumes the session it is bound to. It fails with NotAuthorized
+// if the token is not valid or if its session was revoked or has expired
+func resumeTokenSession(ctx context.Context, token string, use string) (*Session, error) {
+	claims, err := parseToken(token, use)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := resumeSession(ctx, claims.SessionId, claims.Subject)
+	if errors.Is(err, NotFound) {
+		return nil, NotAuthorized
+	}
+	return session, err
+}
+
+// refreshTokens issues a new token pair for the session the refresh token is bound to
+func refreshTokens(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	session, err := resumeTokenSession(ctx, refreshToken, tokenUseRefresh)
+	if err != nil {
+		return nil, err
+	}
+	return issueTokens(session)
+}